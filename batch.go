@@ -0,0 +1,234 @@
+package ircfw
+
+import (
+	"time"
+)
+
+const (
+	NetsplitBatch    = "netsplit"
+	NetjoinBatch     = "netjoin"
+	ChathistoryBatch = "chathistory"
+)
+
+// Servers and bouncers may never end a batch, so buffering is limited
+const (
+	maxOpenBatches     = 32
+	maxBatchedMessages = 8192
+)
+
+// Called in separate goroutine for every completed top-level batch
+type BatchHandler func(batch *Batch)
+
+// Raw IRC message as received from server
+type Line struct {
+	Time    time.Time
+	Tags    map[string]string
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+// https://ircv3.net/specs/extensions/batch
+type Batch struct {
+	ID     string
+	Type   string
+	Params []string
+	Tags   map[string]string
+	// messages and nested batches in order of arrival
+	Messages []Line
+	Batches  []*Batch
+	parent   *Batch
+	inner    []batchItem
+	// messages buffered for the batch and order of opening
+	size, seq int
+	complete  bool
+	// set for draft/multiline batches
+	multiline *multilineBatch
+}
+
+// Inner message or nested batch in order of arrival
+type batchItem struct {
+	msg   message
+	batch *Batch
+}
+
+func newLine(msg message) Line {
+	return Line{
+		Time:    msg.Time(),
+		Tags:    msg.Tags(),
+		Prefix:  msg.Prefix(),
+		Command: msg.Cmd(),
+		Params:  msg.Params(),
+	}
+}
+
+func (l Line) Nick() string {
+	nick, _ := pop(l.Prefix, "!")
+	return nick
+}
+
+func (b *Batch) add(msg message) {
+	if b.multiline != nil {
+		b.multiline.add(msg)
+		return
+	}
+	b.inner = append(b.inner, batchItem{msg: msg})
+	b.Messages = append(b.Messages, newLine(msg))
+}
+
+// Nicks of users quit in netsplit or joined in netjoin
+func (b *Batch) Nicks() (nicks []string) {
+	seen := NewSet()
+	for _, line := range b.Messages {
+		if nick := line.Nick(); nick != "" && !seen.Has(nick) {
+			seen.Add(nick)
+			nicks = append(nicks, nick)
+		}
+	}
+	return
+}
+
+// Buffers messages of open batches, returns true if msg was consumed
+func (c *Client) collectBatch(msg message) bool {
+	if msg.Cmd() == "BATCH" {
+		return c.handleBatch(msg)
+	}
+	id, ok := msg.Tag("batch")
+	if !ok {
+		return false
+	}
+	batch, ok := c.batches[id]
+	if !ok {
+		c.Debug("Got message for unknown batch %q: %#v", id, msg)
+		return false
+	}
+	if c.batched >= maxBatchedMessages {
+		c.Debug("Dropping message of batch %q, %d messages are buffered", id, c.batched)
+		return true
+	}
+	c.batched++
+	batch.size++
+	batch.add(msg)
+	return true
+}
+
+// Forgets the oldest open batch to make room for a new one
+func (c *Client) evictBatch() {
+	var oldest *Batch
+	for _, batch := range c.batches {
+		if oldest == nil || batch.seq < oldest.seq {
+			oldest = batch
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	c.Debug("Dropping batch %q which was never ended", oldest.ID)
+	delete(c.batches, oldest.ID)
+	c.batched -= oldest.size
+}
+
+func (c *Client) handleBatch(msg message) bool {
+	params := msg.Params()
+	if len(params) == 0 || len(params[0]) < 2 {
+		c.Debug("Got malformed BATCH: %#v", msg)
+		return true
+	}
+	id := params[0][1:]
+	switch params[0][0] {
+	case '+':
+		if len(params) < 2 {
+			c.Debug("Got BATCH without type: %#v", msg)
+			return true
+		}
+		batch := &Batch{
+			ID:     id,
+			Type:   params[1],
+			Params: params[2:],
+			Tags:   msg.Tags(),
+		}
+		if batch.Type == MultilineBatch && len(batch.Params) > 0 {
+			batch.multiline = &multilineBatch{target: batch.Params[0], tags: batch.Tags}
+		}
+		if parentID, ok := msg.Tag("batch"); ok {
+			batch.parent = c.batches[parentID]
+			if batch.parent != nil && batch.multiline == nil {
+				// nested batch is applied where it started
+				batch.parent.inner = append(batch.parent.inner, batchItem{batch: batch})
+			}
+		}
+		if len(c.batches) >= maxOpenBatches {
+			c.evictBatch()
+		}
+		c.batchSeq++
+		batch.seq = c.batchSeq
+		c.batches[id] = batch
+	case '-':
+		batch, ok := c.batches[id]
+		if !ok {
+			c.Debug("Got end of unknown batch %q", id)
+			return true
+		}
+		delete(c.batches, id)
+		c.batched -= batch.size
+		batch.complete = true
+		c.completeBatch(batch)
+	default:
+		c.Debug("Got malformed BATCH: %#v", msg)
+	}
+	return true
+}
+
+func (c *Client) completeBatch(batch *Batch) {
+	if batch.multiline != nil {
+		assembled := batch.multiline.message()
+		if label, ok := batch.Tags["label"]; ok && assembled != nil {
+			c.requests.resolve(label, []Line{newLine(assembled)})
+		}
+		switch {
+		case assembled == nil:
+		case batch.parent != nil:
+			batch.parent.add(assembled)
+		default:
+			c.dispatch(assembled)
+		}
+		return
+	}
+	if batch.parent != nil {
+		batch.parent.Batches = append(batch.parent.Batches, batch)
+		return
+	}
+	c.deliverBatch(batch)
+}
+
+// Applies inner messages and hands batch to subscribers
+func (c *Client) deliverBatch(batch *Batch) {
+	c.applyBatch(batch)
+	if label, ok := batch.Tags["label"]; ok {
+		c.requests.resolve(label, batchLines(batch))
+	} else if batch.Type == ChathistoryBatch {
+		c.requests.resolveBatch(batch)
+	}
+	if batch.Type == NetsplitBatch || batch.Type == NetjoinBatch {
+		c.Logf("%s %q: %d users", batch.Type, batch.Params, len(batch.Nicks()))
+	}
+	for _, handler := range c.batchHandlers {
+		go handler(batch)
+	}
+}
+
+// Dispatches inner messages to update state, history playback is skipped
+// so that it is not mistaken for live events
+func (c *Client) applyBatch(batch *Batch) {
+	if batch.Type == ChathistoryBatch {
+		return
+	}
+	for _, item := range batch.inner {
+		switch {
+		case item.msg != nil:
+			c.dispatch(item.msg)
+		case item.batch.complete:
+			c.applyBatch(item.batch)
+		}
+	}
+}
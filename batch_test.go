@@ -0,0 +1,144 @@
+package ircfw
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gitea.demsh.org/demsh/ircfw/ircfwtest"
+)
+
+func feed(t *testing.T, client *Client, lines []string) {
+	for _, line := range lines {
+		msg, err := parseUTF8Message([]byte(line), time.Time{}, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !client.collectBatch(msg) {
+			t.Fatalf("%q was not consumed", line)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	server := ircfwtest.New(ircfwtest.Caps(map[string]string{"batch": ""}))
+	defer server.Close()
+	batches := make(chan *Batch, 4)
+	client := newServerClient(t, server, "ircfw", OnBatch(func(b *Batch) { batches <- b }))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancel()
+	for _, nick := range []string{"demsh", "other"} {
+		if _, err := newServerClient(t, server, nick).Join(ctx, jchannel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	channel, err := client.Join(ctx, jchannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		":irc.demsh.org BATCH +split netsplit irc.demsh.org hub.demsh.org",
+		"@batch=split :demsh!~demsh@12a8e790 QUIT :irc.demsh.org hub.demsh.org",
+		"@batch=split :other!~other@12a8e790 QUIT :irc.demsh.org hub.demsh.org",
+		":irc.demsh.org BATCH -split",
+	} {
+		server.Inject(line)
+	}
+	batch := nextBatch(t, batches, NetsplitBatch)
+	if len(batch.Nicks()) != 2 || len(batch.Params) != 2 {
+		t.Fatalf("bad netsplit batch: %#v", batch)
+	}
+	if channel.names.Has("demsh") || channel.names.Has("other") {
+		t.Fatalf("netsplit was not applied: %s", channel.names.String())
+	}
+
+	for _, line := range []string{
+		":irc.demsh.org BATCH +history chathistory " + jchannel,
+		"@batch=history :demsh!~demsh@12a8e790 JOIN " + jchannel,
+		"@batch=history :irc.demsh.org BATCH +ml draft/multiline " + jchannel,
+		"@batch=ml :demsh!~demsh@12a8e790 PRIVMSG " + jchannel + " :first",
+		"@batch=ml :demsh!~demsh@12a8e790 PRIVMSG " + jchannel + " :second",
+		":irc.demsh.org BATCH -ml",
+		"@batch=history :irc.demsh.org BATCH +inner example",
+		":irc.demsh.org BATCH -inner",
+		":irc.demsh.org BATCH -history",
+	} {
+		server.Inject(line)
+	}
+	batch = nextBatch(t, batches, ChathistoryBatch)
+	if len(batch.Messages) != 2 || len(batch.Batches) != 1 {
+		t.Fatalf("bad chathistory batch: %#v", batch)
+	}
+	if text := batch.Messages[1].Params[1]; text != "first\nsecond" {
+		t.Fatalf("multiline was not reassembled: %q", text)
+	}
+	if channel.names.Has("demsh") {
+		t.Fatalf("history playback was applied as live event")
+	}
+}
+
+// Skips batches of other types, e.g. sent by the server on join
+func nextBatch(t *testing.T, batches chan *Batch, batchType string) *Batch {
+	for {
+		select {
+		case batch := <-batches:
+			if batch.Type == batchType {
+				return batch
+			}
+		case <-time.After(timeout * time.Second):
+			t.Fatalf("no %s batch", batchType)
+		}
+	}
+}
+
+func TestNestedBatchOrder(t *testing.T) {
+	client := newTestClient(t, nil)
+	client.channels[jchannel] = newChannel(jchannel, client)
+	feed(t, client, []string{
+		":irc.demsh.org BATCH +outer example",
+		"@batch=outer :demsh!~demsh@12a8e790 JOIN #ircfw-test",
+		"@batch=outer :irc.demsh.org BATCH +inner example",
+		"@batch=inner :demsh!~demsh@12a8e790 PART #ircfw-test",
+		"@batch=outer :demsh!~demsh@12a8e790 JOIN #ircfw-test",
+		":irc.demsh.org BATCH -inner",
+		":irc.demsh.org BATCH -outer",
+	})
+	// JOIN, nested PART, JOIN as sent by server
+	if !client.channels["#ircfw-test"].names.Has("demsh") {
+		t.Fatalf("nested batch was applied out of order")
+	}
+	if len(client.batches) != 0 {
+		t.Fatalf("batches leaked: %#v", client.batches)
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	client := newTestClient(t, nil)
+	client.channels[jchannel] = newChannel(jchannel, client)
+	for i := 0; i <= maxOpenBatches; i++ {
+		feed(t, client, []string{fmt.Sprintf(":irc.demsh.org BATCH +b%d example", i)})
+	}
+	if len(client.batches) != maxOpenBatches || client.batches["b0"] != nil {
+		t.Fatalf("%d batches are open", len(client.batches))
+	}
+	lines := []string{":irc.demsh.org BATCH +big example"}
+	for i := 0; i <= maxBatchedMessages; i++ {
+		lines = append(lines, "@batch=big :demsh!~demsh@12a8e790 FLOOD #ircfw-test")
+	}
+	feed(t, client, lines)
+	if big := client.batches["big"]; len(big.Messages) != maxBatchedMessages {
+		t.Fatalf("%d messages buffered", len(big.Messages))
+	}
+	feed(t, client, []string{":irc.demsh.org BATCH -big"})
+	if client.batched != 0 {
+		t.Fatalf("%d messages counted after batch ended", client.batched)
+	}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(v ...interface{})                  {}
+func (nopLogger) Logf(format string, v ...interface{})  {}
+func (nopLogger) Debug(format string, v ...interface{}) {}
@@ -0,0 +1,149 @@
+package ircfw
+
+import (
+	"strings"
+)
+
+// Capabilities requested by default when server offers them
+var defaultCaps = []string{
+	MessageTagsCap,
+	"batch",
+	"draft/multiline",
+	"labeled-response",
+	"server-time",
+	"draft/chathistory",
+	EchoMessageCap,
+	ExtendedJoinCap,
+	AccountNotifyCap,
+	AccountTagCap,
+	AwayNotifyCap,
+	ChghostCap,
+	SetnameCap,
+}
+
+const ServerTimeCap = "server-time"
+
+// https://ircv3.net/specs/extensions/capability-negotiation
+func (c *Client) sendCapLS() {
+	c.sendMessage("CAP", []string{"LS", "302"})
+}
+
+func (c *Client) endCapNegotiation() {
+	select {
+	case <-c.capsDone:
+		return
+	default:
+	}
+	c.sendMessage("CAP", []string{"END"})
+	safeClose(c.capsDone)
+}
+
+func (c *Client) wantsCap(name string) bool {
+	for _, want := range c.wantCaps {
+		if want == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Requests wanted capabilities out of offered ones, returns false if there is nothing to request
+func (c *Client) requestCaps(offered []string) bool {
+	var request []string
+	for _, name := range offered {
+		if c.wantsCap(name) && !c.enabledCaps.Has(name) {
+			request = append(request, name)
+		}
+	}
+	if len(request) == 0 {
+		return false
+	}
+	c.sendMessage("CAP", []string{"REQ", join(request, " ")})
+	return true
+}
+
+// Parses "name=value" capability list of CAP LS and CAP NEW
+func (c *Client) offerCaps(list string) (names []string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, item := range strings.Fields(list) {
+		name, value := pop(item, "=")
+		c.availCaps[name] = value
+		names = append(names, name)
+	}
+	return
+}
+
+func (c *Client) capValue(name string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	value, ok := c.availCaps[name]
+	return value, ok
+}
+
+// Parses comma-separated key=value capability value
+func capParams(value string) map[string]string {
+	params := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		if item == "" {
+			continue
+		}
+		key, value := pop(item, "=")
+		params[key] = value
+	}
+	return params
+}
+
+func handleCap(msg message) {
+	client := msg.Client()
+	params := msg.Params()
+	if len(params) < 3 {
+		client.Debug("Got CAP with less than 3 parameters: %#v", msg)
+		return
+	}
+	subcmd, list := strings.ToUpper(params[1]), params[len(params)-1]
+	// "CAP * LS * :caps" means more lines follow
+	more := len(params) > 3 && params[2] == "*"
+	switch subcmd {
+	case "LS":
+		client.pendingCaps = append(client.pendingCaps, client.offerCaps(list)...)
+		if more {
+			return
+		}
+		offered := client.pendingCaps
+		client.pendingCaps = nil
+		if client.applySTS() {
+			return
+		}
+		if !client.requestCaps(offered) {
+			client.endCapNegotiation()
+		}
+	case "ACK":
+		for _, name := range strings.Fields(list) {
+			if strings.HasPrefix(name, "-") {
+				client.enabledCaps.Remove(name[1:])
+				continue
+			}
+			client.enabledCaps.Add(name)
+		}
+		client.endCapNegotiation()
+	case "NAK":
+		client.Debug("Server refused capabilities %q", list)
+		client.endCapNegotiation()
+	case "NEW":
+		offered := client.offerCaps(list)
+		if client.applySTS() {
+			return
+		}
+		client.requestCaps(offered)
+	case "DEL":
+		client.Lock()
+		for _, name := range strings.Fields(list) {
+			delete(client.availCaps, name)
+			client.enabledCaps.Remove(name)
+		}
+		client.Unlock()
+	default:
+		client.Debug("Unhandled CAP %s: %#v", subcmd, msg)
+	}
+}
@@ -1,5 +1,11 @@
 package ircfw
 
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
 func newChannel(name string, client *Client) *Channel {
 	c := &Channel{
 		name:    name,
@@ -7,14 +13,57 @@ func newChannel(name string, client *Client) *Channel {
 		client:  client,
 		send:    make(chan Msg, 8),
 		receive: make(chan Msg, 8),
+		flushes: make(chan chan struct{}),
 		started: make(chan struct{}),
 		quit:    make(chan struct{}),
 	}
 	return c
 }
 
+func newQuery(nick string, client *Client) *Channel {
+	c := newChannel(nick, client)
+	c.peer = nick
+	return c
+}
+
+func (c *Channel) rename(nick string) {
+	c.Lock()
+	c.name = nick
+	c.peer = nick
+	c.Unlock()
+}
+
+func (c *Channel) isQuery() bool {
+	return c.Peer() != "" && c.dcc == nil
+}
+
+// Marks query as active so that it is not evicted as idle
+func (c *Channel) touch() {
+	if !c.isQuery() {
+		return
+	}
+	c.client.Lock()
+	c.lastActive = time.Now()
+	c.client.Unlock()
+}
+
+func (c *Channel) remember(msg Msg) {
+	c.Lock()
+	c.recent = append(c.recent, msg)
+	if len(c.recent) > HISTORY_LIMIT {
+		c.recent = c.recent[len(c.recent)-HISTORY_LIMIT:]
+	}
+	c.Unlock()
+}
+
 func (c *Channel) start() {
-	go c.rxLoop()
+	c.startAfter(nil)
+}
+
+// Starts channel holding received messages until history arrives and is
+// dispatched, so that backfill reaches handler before live messages
+func (c *Channel) startAfter(history <-chan []Msg) {
+	go c.rxLoop(history)
 	go c.txLoop()
 	close(c.started)
 }
@@ -28,47 +77,115 @@ func (c *Channel) isStarted() bool {
 	}
 }
 
-func (c *Channel) setTopic(topic string) {
-	c.topic = topic
+// Reports whether channel was parted or killed
+func (c *Channel) isClosed() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
 }
 
-func (c *Channel) sendTopic(topic string) {
-	c.client.sendMessage("TOPIC", []string{c.name, topic})
+// Hands msg to txLoop
+func (c *Channel) queue(ctx context.Context, msg Msg) error {
+	// select picks randomly, buffer may still have room after quit
+	if c.client.isClosing() {
+		return ErrClientClosed
+	}
+	if c.isClosed() {
+		return fmt.Errorf("%s: %w", c.Name(), ErrNotJoined)
+	}
+	c.touch()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.quit:
+		return fmt.Errorf("%s: %w", c.Name(), ErrNotJoined)
+	case <-c.client.closing:
+		return ErrClientClosed
+	case <-c.client.tomb.Dying():
+		return ErrClientClosed
+	case c.send <- msg:
+		return nil
+	}
+}
+
+// Context of handlers, cancelled once channel is killed or client dies
+func (c *Channel) context() context.Context {
+	c.Lock()
+	defer c.Unlock()
+	if c.ctx == nil {
+		ctx, cancel := context.WithCancel(c.client.tomb.Context(nil))
+		c.ctx = ctx
+		go func() {
+			select {
+			case <-c.quit:
+			case <-ctx.Done():
+			}
+			cancel()
+		}()
+	}
+	return c.ctx
+}
+
+func (c *Channel) setTopic(topic string) {
+	c.topic = topic
 }
 
 func (c *Channel) queryTopic() {
-	c.client.sendMessage("TOPIC", []string{c.name})
+	c.client.sendMessage("TOPIC", []string{c.Name()})
 }
 
 func (c *Channel) kill() {
 	safeClose(c.quit)
+	if c.dcc != nil {
+		c.dcc.Close()
+	}
 }
 
 func (c *Channel) String() string {
-	return c.name
+	return c.Name()
 }
 
 // meant to run in separate goroutine
-func (c *Channel) rxLoop() {
+func (c *Channel) rxLoop(history <-chan []Msg) {
+	// received while history is awaited
+	var held []Msg
 	for {
 		select {
 		case <-c.quit:
 			return
+		case msgs := <-history:
+			history = nil
+			for _, msg := range append(msgs, held...) {
+				c.dispatch(msg)
+			}
+			held = nil
 		case msg, open := <-c.receive:
 			if !open {
 				safeClose(c.quit)
 				return
 			}
-			select {
-			case <-c.quit:
-				return
-			default:
-				c.client.handler(msg)
+			if history != nil {
+				held = append(held, msg)
+				continue
 			}
+			c.dispatch(msg)
 		}
 	}
 }
 
+// Hands received msg to dispatcher unless it was already seen
+func (c *Channel) dispatch(msg Msg) {
+	if !c.client.history.record(c.Name(), msg) {
+		c.Debug("Skipping duplicate %q in %q", msg.MsgID(), c.Name())
+		return
+	}
+	c.remember(msg)
+	c.client.dispatcher.push(job{channel: c, msg: msg})
+}
+
 // meant to run in separate goroutine
 func (c *Channel) txLoop() {
 	for {
@@ -77,20 +194,77 @@ func (c *Channel) txLoop() {
 			return
 		case msg, open := <-c.send:
 			if !open {
-				c.Client().Debug("%q send closed, killing loop", c.name)
+				c.Client().Debug("%q send closed, killing loop", c.Name())
 				safeClose(c.quit)
 				return
 			}
-			for _, message := range msg.Messages() {
+			if !c.transmit(msg) {
+				return
+			}
+		case flushed := <-c.flushes:
+			for pending := true; pending; {
 				select {
-				case <-c.quit:
-					return
-				case c.Client().writes <- message:
-					continue
-
+				case msg := <-c.send:
+					if !c.transmit(msg) {
+						return
+					}
+				default:
+					pending = false
 				}
 			}
+			close(flushed)
 		}
 	}
 
 }
+
+// Hands msg to client writes, returns false if channel was killed meanwhile
+func (c *Channel) transmit(msg Msg) bool {
+	if !c.typingFilter(msg) {
+		return true
+	}
+	if c.dcc != nil {
+		c.remember(msg)
+		c.writeDCC(msg)
+		return true
+	}
+	if m, ok := msg.(ircMsg); !ok || m.cmd != "TAGMSG" {
+		c.remember(msg)
+	}
+	messages := msg.Messages()
+	if m, ok := msg.(ircMsg); ok && m.delivery != nil {
+		messages = c.client.labelMessages(messages, m.delivery)
+	}
+	for _, message := range messages {
+		select {
+		case <-c.quit:
+			return false
+		case c.Client().writes <- message:
+		}
+	}
+	return true
+}
+
+// Waits until messages queued so far are handed to client writes,
+// messages of channels not joined yet stay queued
+func (c *Channel) flush(ctx context.Context) error {
+	if !c.isStarted() {
+		return nil
+	}
+	flushed := make(chan struct{})
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.quit:
+		return nil
+	case c.flushes <- flushed:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.quit:
+		return nil
+	case <-flushed:
+		return nil
+	}
+}
@@ -1,11 +1,27 @@
 package ircfw
 
-func (c *Channel) SetTopic(topic string) {
-	if c.name == "" {
-		c.Debug("Attempt to set topic on private")
-		return
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Sets topic and waits for the server to apply it, refusals
+// like ERR_CHANOPRIVSNEEDED match ErrRejected
+func (c *Channel) SetTopic(ctx context.Context, topic string) error {
+	if c.Peer() != "" {
+		return invalid("target", errors.New("private conversation has no topic"))
+	}
+	if err := validateParams([]string{topic}); err != nil {
+		return invalid("topic", err)
+	}
+	if c.isClosed() {
+		return fmt.Errorf("%s: %w", c.Name(), ErrNotJoined)
 	}
-	c.sendTopic(topic)
+	_, err := c.client.do(ctx, "TOPIC", []string{c.Name(), topic})
+	return err
 }
 
 func (c *Channel) Topic() string {
@@ -16,41 +32,104 @@ func (c *Channel) Topic() string {
 
 // Calculate allowed message len for PRIVMSG
 func (c *Channel) MsgLimit() int {
-	var limit int
-	// IRC message structure:
-	// :prefix PRIVMSG ChannelName :text with spaces\r\n
-	if c.name == "" {
-		limit = MAXMSGSIZE - 1 - len(c.client.Prefix()) - 9 - 9 - 4
-	} else {
-		limit = MAXMSGSIZE - 1 - len(c.client.Prefix()) - 9 - len(c.name) - 4
+	if c.dcc != nil {
+		return DCCLineLimit
+	}
+	return msgLimit(c.client.Prefix(), "PRIVMSG", c.Name())
+}
+
+// Fetches messages with draft/chathistory. Subcommand is one of History*
+// constants, refs are "*", MsgIDRef or TimeRef values, two for BETWEEN
+func (c *Channel) History(ctx context.Context, subcommand string, limit int, refs ...string) ([]Msg, error) {
+	if limit <= 0 {
+		return nil, invalid("limit", fmt.Errorf("%d is not positive", limit))
+	}
+	switch strings.ToUpper(subcommand) {
+	case HistoryBetween:
+		if len(refs) != 2 {
+			return nil, invalid("references", fmt.Errorf("%s needs 2", HistoryBetween))
+		}
+	case HistoryLatest, HistoryBefore, HistoryAfter, HistoryAround:
+		if len(refs) != 1 {
+			return nil, invalid("references", fmt.Errorf("%s needs 1", subcommand))
+		}
+	default:
+		return nil, invalid("subcommand", fmt.Errorf("%q is unknown", subcommand))
 	}
-	if limit < 0 {
-		return 0
+	if err := validateParams(refs); err != nil {
+		return nil, invalid("references", err)
 	}
-	return limit
+	return c.history(ctx, subcommand, limit, refs)
 }
 
 func (c *Channel) Name() string {
+	c.Lock()
+	defer c.Unlock()
 	return c.name
 }
 
+// Nick of the other side for private conversations, empty for channels
+func (c *Channel) Peer() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.peer
+}
+
+// Up to HISTORY_LIMIT last messages received and sent, oldest first
+func (c *Channel) Recent() []Msg {
+	c.Lock()
+	defer c.Unlock()
+	result := make([]Msg, len(c.recent))
+	copy(result, c.recent)
+	return result
+}
+
 func (c *Channel) Client() *Client {
 	return c.client
 }
 
-func (c *Channel) Part() {
-	if c.name == "" {
-		return
+// Leaves channel and waits for the server to confirm it, private
+// conversations and DCC chats are closed locally. The channel is
+// stopped even if the server refused or did not answer.
+func (c *Channel) Part(ctx context.Context) error {
+	if c.dcc != nil {
+		c.kill()
+		return nil
+	}
+	if c.isQuery() {
+		peer := c.Peer()
+		c.client.Lock()
+		if c.client.fetchQuery(peer) == c {
+			delete(c.client.queries, lowcase(peer))
+		}
+		c.client.Unlock()
+		c.kill()
+		return nil
+	}
+	if c.isClosed() {
+		return fmt.Errorf("%s: %w", c.Name(), ErrNotJoined)
 	}
-	c.client.sendMessage("PART", []string{c.name})
-	close(c.quit)
+	_, err := c.client.do(ctx, "PART", []string{c.Name()})
+	c.kill()
+	return err
 }
 
-func (c *Channel) Say(content string) {
-	if content == "" {
-		return
+// Sends text, fails instead of blocking once the channel was parted or
+// the client closed. With labeled-response waits for the server to accept
+// text and returns FAIL as error, otherwise returns once text is queued
+func (c *Channel) Say(ctx context.Context, content string) error {
+	if err := validateText([]string{content}); err != nil {
+		return invalid("text", err)
 	}
-	c.send <- NewIRCMsg([]string{content}, c, c.client)
+	deadline, _ := ctx.Deadline()
+	return c.post(ctx, ircMsg{
+		time:     time.Now(),
+		deadline: deadline,
+		prefix:   c.client.Prefix(),
+		text:     []string{content},
+		channel:  c,
+		client:   c.client,
+	})
 }
 
 func (c *Channel) Logf(format string, params ...interface{}) {
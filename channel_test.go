@@ -1 +1,103 @@
 package ircfw
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQueryRename(t *testing.T) {
+	client := newTestClient(t, nil)
+	query := client.createQuery("demsh")
+	defer query.kill()
+	if client.createQuery("DEMSH") != query {
+		t.Fatalf("query lookup should be case insensitive")
+	}
+	limit := query.MsgLimit()
+	client.renameQuery("demsh", "demsh_away")
+	if client.fetchQuery("demsh") != nil || client.fetchQuery("demsh_away") != query {
+		t.Fatalf("query was not migrated: %v", client.queries)
+	}
+	if query.Name() != "demsh_away" || query.Peer() != "demsh_away" {
+		t.Fatalf("query was not renamed: %q", query.Name())
+	}
+	if query.MsgLimit() != limit-len("_away") {
+		t.Fatalf("MsgLimit %d should shrink by %d", query.MsgLimit(), len("_away"))
+	}
+}
+
+func TestQueryLimit(t *testing.T) {
+	client := newTestClient(t, nil, MaxQueries(2))
+	first := client.createQuery("first")
+	second := client.createQuery("second")
+	time.Sleep(time.Millisecond)
+	client.createQuery("first")
+	third := client.createQuery("third")
+	defer client.killChannels()
+	if !second.isClosed() || client.fetchQuery("second") != nil {
+		t.Errorf("least recently active query was not closed")
+	}
+	if first.isClosed() || third.isClosed() || len(client.queries) != 2 {
+		t.Errorf("unexpected queries %v", client.queries)
+	}
+}
+
+func TestQuerySendActivity(t *testing.T) {
+	client := newTestClient(t, nil, MaxQueries(2))
+	first := client.createQuery("first")
+	client.createQuery("second")
+	defer client.killChannels()
+	time.Sleep(time.Millisecond)
+	if err := first.Say(context.Background(), "still here"); err != nil {
+		t.Fatal(err)
+	}
+	client.createQuery("third")
+	if first.isClosed() || client.fetchQuery("second") != nil {
+		t.Errorf("query written to was evicted instead of idle one")
+	}
+}
+
+func TestQueryRenameRace(t *testing.T) {
+	client := newTestClient(t, nil)
+	query := client.createQuery("demsh")
+	defer client.killChannels()
+	msg := ircMsg{channel: query, client: client}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			client.renameQuery(query.Peer(), fmt.Sprintf("demsh%d", i))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if !query.isQuery() || !msg.IsPrivate() {
+			t.Fatal("query is not private")
+		}
+	}
+	<-done
+}
+
+func TestQueryQuit(t *testing.T) {
+	client := newTestClient(t, nil)
+	query := client.createQuery("demsh")
+	msg, err := parseUTF8Message([]byte(":demsh!~demsh@12a8e790 QUIT :bye"), time.Now(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleQuit(msg)
+	if !query.isClosed() || client.fetchQuery("demsh") != nil {
+		t.Errorf("query with quitting nick was not closed")
+	}
+}
+
+func TestRecent(t *testing.T) {
+	client := newTestClient(t, nil)
+	channel := newChannel("#ircfw-test", client)
+	for i := 0; i < HISTORY_LIMIT+10; i++ {
+		channel.remember(NewIRCMsg([]string{"hello"}, channel, client))
+	}
+	if n := len(channel.Recent()); n != HISTORY_LIMIT {
+		t.Fatalf("%d messages remembered instead of %d", n, HISTORY_LIMIT)
+	}
+}
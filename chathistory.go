@@ -0,0 +1,210 @@
+package ircfw
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ChathistoryCap = "draft/chathistory"
+	// subcommands of CHATHISTORY
+	HistoryLatest  = "LATEST"
+	HistoryBefore  = "BEFORE"
+	HistoryAfter   = "AFTER"
+	HistoryAround  = "AROUND"
+	HistoryBetween = "BETWEEN"
+	// how many msgids are remembered per client for de-duplication
+	SEEN_LIMIT      = 1000
+	backfillTimeout = 30 * time.Second
+)
+
+// Reference to the last message seen in a channel
+type HistoryMark struct {
+	Time  time.Time
+	MsgID string
+}
+
+// History position kept across reconnects, see Client.HistorySnapshot and ResumeHistory
+type HistorySnapshot struct {
+	// last seen messages by lowercased channel name
+	Marks map[string]HistoryMark
+	// recently seen msgids, oldest first
+	Seen []string
+}
+
+type historyState struct {
+	sync.Mutex
+	marks map[string]HistoryMark
+	seen  map[string]struct{}
+	order []string
+}
+
+func newHistoryState(snapshot HistorySnapshot) *historyState {
+	h := &historyState{
+		marks: make(map[string]HistoryMark),
+		seen:  make(map[string]struct{}),
+	}
+	for chanName, mark := range snapshot.Marks {
+		h.marks[lowcase(chanName)] = mark
+	}
+	seen := snapshot.Seen
+	if len(seen) > SEEN_LIMIT {
+		seen = seen[len(seen)-SEEN_LIMIT:]
+	}
+	for _, msgid := range seen {
+		if _, ok := h.seen[msgid]; !ok {
+			h.seen[msgid] = struct{}{}
+			h.order = append(h.order, msgid)
+		}
+	}
+	return h
+}
+
+func (h *historyState) snapshot() HistorySnapshot {
+	h.Lock()
+	defer h.Unlock()
+	snapshot := HistorySnapshot{
+		Marks: make(map[string]HistoryMark, len(h.marks)),
+		Seen:  append([]string{}, h.order...),
+	}
+	for chanName, mark := range h.marks {
+		snapshot.Marks[chanName] = mark
+	}
+	return snapshot
+}
+
+// Reference to message by its msgid for CHATHISTORY
+func MsgIDRef(msgid string) string {
+	return "msgid=" + msgid
+}
+
+// Reference to point in time for CHATHISTORY
+func TimeRef(t time.Time) string {
+	return "timestamp=" + t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// Records message, returns false if message with the same msgid was already seen
+func (h *historyState) record(chanName string, msg Msg) bool {
+	if h == nil {
+		return true
+	}
+	msgid := msg.MsgID()
+	h.Lock()
+	defer h.Unlock()
+	if msgid != "" {
+		if _, ok := h.seen[msgid]; ok {
+			return false
+		}
+		h.seen[msgid] = struct{}{}
+		h.order = append(h.order, msgid)
+		if len(h.order) > SEEN_LIMIT {
+			delete(h.seen, h.order[0])
+			h.order = h.order[1:]
+		}
+	}
+	key := lowcase(chanName)
+	if mark, ok := h.marks[key]; !ok || !msg.Time().Before(mark.Time) {
+		h.marks[key] = HistoryMark{Time: msg.Time(), MsgID: msgid}
+	}
+	return true
+}
+
+func (h *historyState) mark(chanName string) (HistoryMark, bool) {
+	h.Lock()
+	defer h.Unlock()
+	mark, ok := h.marks[lowcase(chanName)]
+	return mark, ok
+}
+
+// Position of history to pass to ResumeHistory of the next client
+func (c *Client) HistorySnapshot() HistorySnapshot {
+	return c.history.snapshot()
+}
+
+// Server limit of messages per CHATHISTORY request, 0 if unlimited
+func (c *Client) historyLimit() int {
+	c.Lock()
+	defer c.Unlock()
+	limit, _ := strconv.Atoi(c.params["CHATHISTORY"])
+	return limit
+}
+
+// Converts PRIVMSG or NOTICE line into Msg, other commands are skipped
+func (c *Channel) lineMsg(line Line) (ircMsg, bool) {
+	if (line.Command != "PRIVMSG" && line.Command != "NOTICE") || len(line.Params) < 2 {
+		return ircMsg{}, false
+	}
+	return ircMsg{
+		time:    line.Time,
+		prefix:  line.Prefix,
+		cmd:     line.Command,
+		text:    strings.Split(line.Params[1], "\n"),
+		msgid:   line.Tags["msgid"],
+		channel: c,
+		client:  c.client,
+	}, true
+}
+
+// Converts playback line into historical Msg, non-message events are skipped
+func (c *Channel) historyMsg(line Line) (Msg, bool) {
+	msg, ok := c.lineMsg(line)
+	msg.historical = true
+	return msg, ok
+}
+
+func (c *Channel) history(ctx context.Context, subcommand string, limit int, refs []string) ([]Msg, error) {
+	client := c.client
+	if !client.HasCap(ChathistoryCap) {
+		return nil, fmt.Errorf("%s not negotiated", ChathistoryCap)
+	}
+	if max := client.historyLimit(); max > 0 && limit > max {
+		limit = max
+	}
+	params := append([]string{strings.ToUpper(subcommand), c.Name()}, refs...)
+	params = append(params, strconv.Itoa(limit))
+	lines, err := client.do(ctx, "CHATHISTORY", params)
+	if err != nil {
+		return nil, err
+	}
+	var result []Msg
+	for _, line := range lines {
+		if msg, ok := c.historyMsg(line); ok {
+			result = append(result, msg)
+		}
+	}
+	return result, nil
+}
+
+// Requests messages missed since the last seen one or latest ones
+// and hands them to rxLoop flagged as historical, nil if request failed
+func (c *Channel) backfill(limit int, history chan<- []Msg) {
+	var result []Msg
+	defer func() {
+		history <- result
+	}()
+	ctx, cancel := context.WithTimeout(c.client.tomb.Context(nil), backfillTimeout)
+	defer cancel()
+	subcommand, ref := HistoryLatest, "*"
+	if mark, ok := c.client.history.mark(c.Name()); ok {
+		subcommand, ref = HistoryAfter, TimeRef(mark.Time)
+		if mark.MsgID != "" {
+			ref = MsgIDRef(mark.MsgID)
+		}
+	}
+	msgs, err := c.history(ctx, subcommand, limit, []string{ref})
+	if err != nil {
+		c.Debug("Backfill of %q failed: %s", c.Name(), err)
+		return
+	}
+	for _, msg := range msgs {
+		// live notices are not delivered to handler either
+		if m, ok := msg.(ircMsg); ok && m.cmd == "NOTICE" {
+			continue
+		}
+		result = append(result, msg)
+	}
+}
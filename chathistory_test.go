@@ -0,0 +1,166 @@
+package ircfw
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gitea.demsh.org/demsh/ircfw/ircfwtest"
+)
+
+func TestHistoryRecord(t *testing.T) {
+	h := newHistoryState(HistorySnapshot{})
+	client := newTestClient(t, nil)
+	channel := newChannel("#ircfw-test", client)
+	now := time.Now()
+	first := ircMsg{time: now, msgid: "a", channel: channel, client: client}
+	second := ircMsg{time: now.Add(time.Second), msgid: "b", channel: channel, client: client}
+	if !h.record("#ircfw-test", first) || !h.record("#IRCFW-test", second) {
+		t.Fatalf("new messages should be recorded")
+	}
+	if h.record("#ircfw-test", first) {
+		t.Fatalf("duplicate msgid should be skipped")
+	}
+	if mark, ok := h.mark("#ircfw-test"); !ok || mark.MsgID != "b" {
+		t.Fatalf("bad mark: %#v", mark)
+	}
+	for i := 0; i < SEEN_LIMIT; i++ {
+		h.record("#ircfw-test", ircMsg{time: now, msgid: string(rune(i + 0x100))})
+	}
+	if len(h.seen) != SEEN_LIMIT || !h.record("#ircfw-test", first) {
+		t.Fatalf("old msgids should be forgotten")
+	}
+}
+
+func TestHistoryBatch(t *testing.T) {
+	client := newTestClient(t, nil)
+	channel := newChannel("#ircfw-test", client)
+	req := &request{cmd: "CHATHISTORY", target: "#ircfw-test", batchType: ChathistoryBatch, done: make(chan []Line, 1)}
+	client.requests.add(req)
+	batch := &Batch{Type: ChathistoryBatch, Params: []string{"#IRCFW-test"}}
+	for _, msg := range parseLines(t, []string{
+		"@batch=1;time=2021-10-15T14:01:02.000Z;msgid=a :demsh!~demsh@12a8e790 PRIVMSG #ircfw-test :hello",
+		"@batch=1;time=2021-10-15T14:01:03.000Z;msgid=b :demsh!~demsh@12a8e790 JOIN #ircfw-test",
+		"@batch=1;time=2021-10-15T14:01:04.000Z;msgid=c :demsh!~demsh@12a8e790 NOTICE #ircfw-test :first\nsecond",
+	}) {
+		batch.add(msg)
+	}
+	if !client.requests.resolveBatch(batch) {
+		t.Fatalf("batch was not routed")
+	}
+	var msgs []Msg
+	for _, line := range <-req.done {
+		if msg, ok := channel.historyMsg(line); ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(msgs) != 2 || !msgs[0].IsHistorical() || msgs[0].MsgID() != "a" || len(msgs[1].Text()) != 2 {
+		t.Fatalf("bad history: %#v", msgs)
+	}
+}
+
+func TestHistorySnapshot(t *testing.T) {
+	client := newTestClient(t, nil)
+	channel := newChannel("#ircfw-test", client)
+	now := time.Now()
+	client.history.record("#IRCFW-test", ircMsg{time: now, msgid: "a", channel: channel, client: client})
+	snapshot := client.HistorySnapshot()
+	h := newHistoryState(snapshot)
+	if mark, ok := h.mark("#ircfw-test"); !ok || mark.MsgID != "a" || !mark.Time.Equal(now) {
+		t.Fatalf("mark was not resumed: %#v", mark)
+	}
+	if h.record("#ircfw-test", ircMsg{time: now, msgid: "a"}) {
+		t.Fatalf("resumed msgid should be skipped")
+	}
+	client.history.record("#ircfw-test", ircMsg{time: now, msgid: "b"})
+	if len(snapshot.Seen) != 1 {
+		t.Fatalf("snapshot shares state with client: %#v", snapshot)
+	}
+}
+
+func TestBackfillResume(t *testing.T) {
+	server := ircfwtest.New(ircfwtest.Caps(map[string]string{
+		"message-tags": "", "server-time": "", "batch": "", ChathistoryCap: "",
+	}))
+	defer server.Close()
+	server.Handle("CHATHISTORY", func(session *ircfwtest.Session, line ircfwtest.Line) {
+		session.Send("BATCH +h chathistory " + jchannel)
+		session.Send("@batch=h;msgid=b :demsh!~demsh@host PRIVMSG " + jchannel + " :seen")
+		session.Send("@batch=h;msgid=c :demsh!~demsh@host NOTICE " + jchannel + " :notice")
+		session.Send("@batch=h;msgid=d :demsh!~demsh@host PRIVMSG " + jchannel + " :missed")
+		session.Send("BATCH -h")
+	})
+	handled := make(chan string, 4)
+	client := newServerClient(t, server, "ircfw",
+		Caps(ChathistoryCap), Backfill(10),
+		ResumeHistory(HistorySnapshot{
+			Marks: map[string]HistoryMark{strings.ToUpper(jchannel): {MsgID: "a"}},
+			Seen:  []string{"a", "b"},
+		}),
+		Handler(func(msg Msg) {
+			if msg.IsHistorical() {
+				handled <- strings.Join(msg.Text(), " ")
+			}
+		}))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancel()
+	if _, err := client.Join(ctx, jchannel); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.ExpectCommand(timeout*time.Second, "CHATHISTORY", HistoryAfter, jchannel, MsgIDRef("a"), "10"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case text := <-handled:
+		if text != "missed" {
+			t.Fatalf("unexpected backfill %q", text)
+		}
+	case <-time.After(timeout * time.Second):
+		t.Fatal("missed message was not backfilled")
+	}
+	select {
+	case text := <-handled:
+		t.Fatalf("unexpected backfill %q", text)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBackfillBeforeLive(t *testing.T) {
+	server := ircfwtest.New(ircfwtest.Caps(map[string]string{
+		"message-tags": "", "server-time": "", "batch": "", ChathistoryCap: "",
+	}))
+	defer server.Close()
+	server.Handle("CHATHISTORY", func(session *ircfwtest.Session, line ircfwtest.Line) {
+		session.Send("@msgid=live :demsh!~demsh@host PRIVMSG " + jchannel + " :live")
+		session.Send("BATCH +h chathistory " + jchannel)
+		session.Send("@batch=h;msgid=old :demsh!~demsh@host PRIVMSG " + jchannel + " :old")
+		session.Send("@batch=h;msgid=live :demsh!~demsh@host PRIVMSG " + jchannel + " :live")
+		session.Send("BATCH -h")
+	})
+	handled := make(chan string, 4)
+	client := newServerClient(t, server, "ircfw", Caps(ChathistoryCap), Backfill(10),
+		Handler(func(msg Msg) {
+			handled <- strings.Join(msg.Text(), " ")
+		}))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancel()
+	if _, err := client.Join(ctx, jchannel); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"old", "live"} {
+		select {
+		case text := <-handled:
+			if text != expected {
+				t.Fatalf("%q handled instead of %q", text, expected)
+			}
+		case <-time.After(timeout * time.Second):
+			t.Fatalf("%q was not handled", expected)
+		}
+	}
+	select {
+	case text := <-handled:
+		t.Fatalf("%q handled twice", text)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
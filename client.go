@@ -4,8 +4,13 @@ import (
 	"bufio"
 	"context"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"golang.org/x/text/encoding"
 	"gopkg.in/tomb.v2"
 )
 
@@ -13,8 +18,16 @@ var (
 	ErrReadsClosed  = errors.New("c.reads closed")
 	ErrWritesClosed = errors.New("c.writes closed")
 	ErrTimeout      = errors.New("server timed out")
+	ErrClientClosed = errors.New("client closed")
+	ErrTooLong      = errors.New("message too long")
+	// input was rejected before anything was sent
+	ErrInvalid = errors.New("invalid argument")
+	// channel was parted or killed
+	ErrNotJoined = errors.New("not joined")
 )
 
+const sendTimeout = 10 * time.Second
+
 // Meant to run in separate goroutine
 func (c *Client) writeLoop() error {
 	var zero time.Time
@@ -30,7 +43,7 @@ func (c *Client) writeLoop() error {
 				return ErrWritesClosed
 			}
 			deadline := msg.Deadline()
-			raw := msg.Export()
+			raw := c.encode(msg.Export())
 			c.Debug("writing raw: %q", string(raw))
 			c.socket.SetWriteDeadline(deadline)
 			_, err := c.socket.Write(raw)
@@ -39,17 +52,25 @@ func (c *Client) writeLoop() error {
 				return err
 			}
 			c.socket.SetWriteDeadline(zero)
+			if msg.Cmd() == "QUIT" {
+				safeClose(c.quitSent)
+			}
 		}
 	}
 }
 
 // Meant to run in separate goroutine
 func (c *Client) readLoop() error {
+	defer c.closeServer()
 	in := bufio.NewScanner(c.socket)
-	in.Buffer(make([]byte, MAXMSGSIZE), MAXMSGSIZE)
+	in.Buffer(make([]byte, MAXLINESIZE), MAXLINESIZE)
 	in.Split(scanMsg)
 	for in.Scan() {
-		line := in.Bytes()
+		line := c.decode(in.Bytes())
+		if len(line) == 0 {
+			// empty lines are silently ignored
+			continue
+		}
 		c.Debug("read raw: %q", string(line))
 		t := time.Now()
 		msg, err := parseMessage(line, t, c)
@@ -134,22 +155,30 @@ func (c *Client) createChannel(chanName string) *Channel {
 
 }
 
-func (c *Client) joinChannel(ctx context.Context, chanName string) (channel *Channel, err error) {
-	channel = c.createChannel(chanName)
-	c.sendMessage("JOIN", []string{chanName})
-
-	select {
-	case <-ctx.Done():
-		c.Lock()
-		delete(c.channels, chanName)
-		channel.kill()
-		c.Unlock()
-		return nil, ctx.Err()
-	case <-channel.quit:
-		return nil, channel.err
-	case <-channel.started:
-		return channel, nil
+func (c *Client) joinChannel(ctx context.Context, chanName string) (*Channel, error) {
+	channel := c.createChannel(chanName)
+	deadline, _ := ctx.Deadline()
+	err := c.enqueue(ctx, []message{newMessage([]byte("JOIN"), [][]byte{[]byte(chanName)}, deadline, c)})
+	if err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-c.tomb.Dying():
+			err = ErrClientClosed
+		case <-channel.quit:
+			if channel.err != nil {
+				return nil, channel.err
+			}
+			return nil, fmt.Errorf("%s: %w", chanName, ErrNotJoined)
+		case <-channel.started:
+			return channel, nil
+		}
 	}
+	c.Lock()
+	delete(c.channels, chanName)
+	channel.kill()
+	c.Unlock()
+	return nil, err
 }
 
 func (c *Client) setNick(nick string) {
@@ -167,9 +196,72 @@ func (c *Client) setHostname(hostname string) {
 	c.Unlock()
 }
 
-func (c *Client) initPrivate() {
-	c.private = newChannel("", c)
-	c.private.start()
+func (c *Client) fetchQuery(nick string) *Channel {
+	query, ok := c.queries[lowcase(nick)]
+	if !ok {
+		return nil
+	}
+	return query
+}
+
+func (c *Client) createQuery(nick string) *Channel {
+	c.Lock()
+	defer c.Unlock()
+	if query := c.fetchQuery(nick); query != nil {
+		query.lastActive = time.Now()
+		return query
+	}
+	if c.maxQueries > 0 && len(c.queries) >= c.maxQueries {
+		c.evictQuery()
+	}
+	query := newQuery(nick, c)
+	query.lastActive = time.Now()
+	c.queries[lowcase(nick)] = query
+	query.start()
+	return query
+}
+
+// Kills least recently active query to make room for a new one,
+// must be called with the mutex held
+func (c *Client) evictQuery() {
+	var oldest *Channel
+	for _, query := range c.queries {
+		if oldest == nil || query.lastActive.Before(oldest.lastActive) {
+			oldest = query
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	peer := oldest.Peer()
+	c.Debug("Closing idle query with %q", peer)
+	delete(c.queries, lowcase(peer))
+	oldest.kill()
+}
+
+// Kills private conversation with nick if there is one
+func (c *Client) removeQuery(nick string) {
+	c.Lock()
+	defer c.Unlock()
+	if query := c.fetchQuery(nick); query != nil {
+		delete(c.queries, lowcase(nick))
+		query.kill()
+	}
+}
+
+func (c *Client) renameQuery(oldnick string, newnick string) {
+	c.Lock()
+	defer c.Unlock()
+	query := c.fetchQuery(oldnick)
+	if query == nil {
+		return
+	}
+	delete(c.queries, lowcase(oldnick))
+	if existing := c.fetchQuery(newnick); existing != nil {
+		existing.kill()
+	}
+	query.rename(newnick)
+	c.queries[lowcase(newnick)] = query
 }
 
 func (c *Client) ping(params []string) {
@@ -185,4 +277,141 @@ func (c *Client) killChannels() {
 		channel.kill()
 		delete(c.channels, name)
 	}
+	for nick, query := range c.queries {
+		query.kill()
+		delete(c.queries, nick)
+	}
+}
+
+// Maximum number of targets per cmd according to TARGMAX or MAXTARGETS,
+// 0 means unlimited
+func (c *Client) targMax(cmd string) int {
+	c.Lock()
+	defer c.Unlock()
+	if targmax, ok := c.params["TARGMAX"]; ok {
+		for _, pair := range strings.Split(targmax, ",") {
+			name, value := pop(pair, ":")
+			if !strings.EqualFold(name, cmd) {
+				continue
+			}
+			if value == "" {
+				return 0
+			}
+			if n, err := strconv.Atoi(value); err == nil && n > 0 {
+				return n
+			}
+		}
+		return 1
+	}
+	if value, ok := c.params["MAXTARGETS"]; ok {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 1
+}
+
+// Maximum nick length according to NICKLEN, permissive until it is known
+func (c *Client) nickLen() int {
+	c.Lock()
+	defer c.Unlock()
+	if n, err := strconv.Atoi(c.params["NICKLEN"]); err == nil && n > 0 {
+		return n
+	}
+	return NICK_LENGTH_LIMIT
+}
+
+func groupTargets(targets []string, max int) (groups [][]string) {
+	if max <= 0 {
+		return [][]string{targets}
+	}
+	for len(targets) > max {
+		groups = append(groups, targets[:max])
+		targets = targets[max:]
+	}
+	return append(groups, targets)
+}
+
+func (c *Client) enqueue(ctx context.Context, messages []message) error {
+	// select picks randomly, writes may still have room after Kill
+	if c.isClosing() {
+		return ErrClientClosed
+	}
+	for _, message := range messages {
+		select {
+		case <-c.closing:
+			return ErrClientClosed
+		case <-c.tomb.Dying():
+			return ErrClientClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		case c.writes <- message:
+		}
+	}
+	return nil
+}
+
+// Sends PRIVMSG or NOTICE to comma-separated targets respecting TARGMAX,
+// text is split to fit message size limit
+func (c *Client) sendText(ctx context.Context, cmd string, target string, text string) error {
+	targets := strings.Split(target, ",")
+	if err := validateTargets(targets, c.nickLen()); err != nil {
+		return fmt.Errorf("%s: %w", cmd, invalid("targets", err))
+	}
+	if err := validateText([]string{text}); err != nil {
+		return fmt.Errorf("%s: %w", cmd, invalid("text", err))
+	}
+	deadline, _ := ctx.Deadline()
+	for _, group := range groupTargets(targets, c.targMax(cmd)) {
+		msg := ircMsg{
+			time:     time.Now(),
+			deadline: deadline,
+			cmd:      cmd,
+			target:   join(group, ","),
+			text:     []string{text},
+			client:   c,
+		}
+		send := c.enqueue
+		if c.HasCap(LabeledResponseCap) {
+			send = c.sendLabeled
+		}
+		if err := send(ctx, msg.Messages()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Length of s in bytes after encoding with client charmap
+func (c *Client) encodedLen(s string) int {
+	if c == nil || c.charmap == nil {
+		return len(s)
+	}
+	// single-byte charmaps encode every rune, unsupported ones as '?'
+	return utf8.RuneCountInString(s)
+}
+
+func (c *Client) encode(raw []byte) []byte {
+	if c.charmap == nil {
+		return raw
+	}
+	encoded, err := encoding.ReplaceUnsupported(c.charmap.NewEncoder()).Bytes(raw)
+	if err != nil {
+		c.Debug("failed to encode %q: %s", raw, err)
+		return raw
+	}
+	return encoded
+}
+
+// Decodes line received in client charmap, valid UTF-8 is passed through
+func (c *Client) decode(line []byte) []byte {
+	if c.charmap == nil || isUTF8(line) {
+		return line
+	}
+	decoded, err := c.charmap.NewDecoder().Bytes(line)
+	if err != nil {
+		c.Debug("failed to decode %q: %s", line, err)
+		return line
+	}
+	return decoded
 }
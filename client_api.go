@@ -3,6 +3,7 @@ package ircfw
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"gopkg.in/tomb.v2"
@@ -20,29 +21,61 @@ func (c *Client) Wait() error {
 	return c.tomb.Wait()
 }
 
-func (c *Client) Quit(reason string) {
-	c.sendMessage("QUIT", []string{reason})
-	c.Lock()
-	c.killChannels()
-	c.Unlock()
-	c.private.kill()
-	c.tomb.Kill(fmt.Errorf("user request: %q", reason))
+// Disconnects gracefully with reason like Shutdown does,
+// lines dropped on the way are logged
+func (c *Client) Quit(ctx context.Context, reason string) error {
+	if err := validateParams([]string{reason}); err != nil {
+		return invalid("quit reason", err)
+	}
+	report, err := c.shutdown(ctx, reason)
+	if len(report.Dropped) > 0 {
+		c.Logf("Dropped %d queued lines on quit", len(report.Dropped))
+	}
+	return err
+}
+
+// Blocks until registration is complete and ISUPPORT is known
+func (c *Client) awaitStarted(ctx context.Context) error {
+	if !c.tomb.Alive() {
+		return ErrClientClosed
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.tomb.Dying():
+		return ErrClientClosed
+	case <-c.started:
+		return nil
+	}
 }
 
 func (c *Client) Join(ctx context.Context, chanName string) (*Channel, error) {
 	err := validateChannel(chanName)
 	if err != nil {
-		return nil, fmt.Errorf("invalid channel name: %w", err)
+		return nil, invalid("channel name", err)
 	}
 	if channel := c.fetchChannel(chanName); channel != nil && channel.isStarted() {
 		return channel, nil
 	}
 	// Stall until initial message exchange with server finishes
 	// without this client tries to join too early and server rejects it
-	<-c.started
+	if err := c.awaitStarted(ctx); err != nil {
+		return nil, err
+	}
 	return c.joinChannel(ctx, chanName)
 }
 
+// Returns private conversation with nick, creating it if needed. Once there
+// are MaxQueries open, the one least recently written to or heard from is
+// closed to make room and its Channel fails with ErrNotJoined, Query
+// returns a fresh one for the nick
+func (c *Client) Query(nick string) (*Channel, error) {
+	if err := validateNick(nick, c.nickLen()); err != nil {
+		return nil, invalid("nick", err)
+	}
+	return c.createQuery(nick), nil
+}
+
 func (c *Client) extractNick() string {
 	nick, _ := pop(c.prefix, "!")
 	return nick
@@ -54,13 +87,17 @@ func (c *Client) Nick() string {
 	return c.extractNick()
 }
 
-func (c *Client) SetNick(nick string) {
-	err := validateNick(nick)
-	if err != nil {
-		c.Debug("Attempt to set invalid nick: %q", nick)
-		return
+// Changes nick and waits for the server to confirm it, refusals
+// like ERR_NICKNAMEINUSE match ErrRejected
+func (c *Client) SetNick(ctx context.Context, nick string) error {
+	if err := validateNick(nick, c.nickLen()); err != nil {
+		return invalid("nick", err)
+	}
+	if err := c.awaitStarted(ctx); err != nil {
+		return err
 	}
-	c.sendNick(nick)
+	_, err := c.do(ctx, "NICK", []string{nick})
+	return err
 }
 
 func (c *Client) sendMessage(cmd string, params []string) {
@@ -71,10 +108,7 @@ func (c *Client) sendMessage(cmd string, params []string) {
 }
 
 func (c *Client) sendMessageContext(ctx context.Context, cmd string, params []string) {
-	var bparams [][]byte
-	for _, param := range params {
-		bparams = append(bparams, []byte(param))
-	}
+	bparams := stringsToBytes(params)
 	deadline, ok := ctx.Deadline()
 	if !ok {
 		deadline = time.Time{}
@@ -87,12 +121,69 @@ func (c *Client) sendMessageContext(ctx context.Context, cmd string, params []st
 	}
 }
 
-func (c *Client) Whois(nick string) {
-	if err := validateNick(nick); err != nil {
-		c.Debug("Whoising %q: %w", nick, err)
-		return
+// Sends PRIVMSG to comma-separated list of nicks and channels. With
+// labeled-response waits for the server to accept it and returns FAIL
+// as error, otherwise returns once it is queued
+func (c *Client) Privmsg(ctx context.Context, target string, text string) error {
+	return c.sendText(ctx, "PRIVMSG", target, text)
+}
+
+// Sends NOTICE to comma-separated list of nicks and channels, see Privmsg
+func (c *Client) Notice(ctx context.Context, target string, text string) error {
+	return c.sendText(ctx, "NOTICE", target, text)
+}
+
+// Sends arbitrary command, PRIVMSG and NOTICE are split like Privmsg and Notice do.
+// With labeled-response waits for the response like Do and returns FAIL as error
+func (c *Client) Send(ctx context.Context, cmd string, params ...string) error {
+	if err := validateCommand(cmd); err != nil {
+		return invalid(fmt.Sprintf("command %q", cmd), err)
+	}
+	if err := validateParams(params); err != nil {
+		return fmt.Errorf("%s: %w", cmd, invalid("parameters", err))
 	}
-	c.sendMessage("WHOIS", []string{nick})
+	cmd = strings.ToUpper(cmd)
+	if (cmd == "PRIVMSG" || cmd == "NOTICE") && len(params) == 2 {
+		return c.sendText(ctx, cmd, params[0], params[1])
+	}
+	deadline, _ := ctx.Deadline()
+	msg := newMessage([]byte(cmd), stringsToBytes(params), deadline, c)
+	if len(msg.Export()) > MAXMSGSIZE-len(c.Prefix())-2 {
+		return fmt.Errorf("%s: %w", cmd, ErrTooLong)
+	}
+	// server closes the link instead of answering QUIT
+	if c.HasCap(LabeledResponseCap) && cmd != "QUIT" {
+		_, err := c.do(ctx, cmd, params)
+		return err
+	}
+	return c.enqueue(ctx, []message{msg})
+}
+
+// Sends command and waits for all server replies to it. Replies are
+// correlated by label when labeled-response is negotiated, otherwise by
+// numerics for a few well-known commands like WHOIS, TOPIC and MODE queries.
+// FAIL naming the command is returned as StandardReply error
+func (c *Client) Do(ctx context.Context, cmd string, params ...string) ([]Line, error) {
+	if err := validateCommand(cmd); err != nil {
+		return nil, invalid(fmt.Sprintf("command %q", cmd), err)
+	}
+	if err := validateParams(params); err != nil {
+		return nil, fmt.Errorf("%s: %w", cmd, invalid("parameters", err))
+	}
+	return c.do(ctx, strings.ToUpper(cmd), params)
+}
+
+// Returns WHOIS replies up to RPL_ENDOFWHOIS, unknown nick matches ErrRejected
+func (c *Client) Whois(ctx context.Context, nick string) ([]Line, error) {
+	if err := validateNick(nick, c.nickLen()); err != nil {
+		return nil, invalid("nick", err)
+	}
+	return c.do(ctx, "WHOIS", []string{nick})
+}
+
+// Reports whether IRCv3 capability was negotiated with server
+func (c *Client) HasCap(name string) bool {
+	return c.enabledCaps.Has(name)
 }
 
 func (c *Client) Prefix() string {
@@ -122,34 +213,71 @@ func NewClient(opts ...Option) (*Client, context.CancelFunc) {
 	for _, opt := range opts {
 		opt(&conf)
 	}
-	t, _ := tomb.WithContext(conf.context)
-	c := Client{
-		tomb:         t,
-		name:         conf.nick + "@" + conf.socket.RemoteAddr().String(),
-		nickservPass: conf.nickservPass,
-		socket:       conf.socket,
-		logger:       conf.logger,
-		channels:     make(map[string]*Channel),
-		reads:        make(chan message, 32),
-		writes:       make(chan message, 32),
-		params:       make(map[string]string),
-		charmap:      conf.charmap,
-		handler:      conf.handler,
-		started:      make(chan struct{}),
-		aliveTimeout: 2 * time.Minute,
+	c := newClient(conf)
+	cancel := func() {
+		c.tomb.Kill(fmt.Errorf("cancelled"))
+		c.socket.Close()
+	}
+	if err := c.checkSTS(); err != nil {
+		// nothing, password included, may be sent in plaintext
+		c.socket.Close()
+		c.tomb.Go(func() error { return err })
+		return c, cancel
 	}
-	c.tomb.Go(c.serveLoop)
 	c.tomb.Go(c.serveLoop)
 	c.tomb.Go(c.writeLoop)
 	c.tomb.Go(c.readLoop)
 	c.tomb.Go(c.pingLoop)
+	c.sendCapLS()
 	c.sendPass(conf.password)
 	c.sendNick(conf.nick)
 	c.sendUser(conf.ident, conf.realName)
-	c.initPrivate()
-	cancel := func() {
-		t.Kill(fmt.Errorf("cancelled"))
-		c.socket.Close()
+	return c, cancel
+}
+
+// Client with state set up from conf and no goroutines running yet
+func newClient(conf config) *Client {
+	t, _ := tomb.WithContext(conf.context)
+	c := &Client{
+		tomb:             t,
+		name:             conf.nick + "@" + conf.socket.RemoteAddr().String(),
+		nickservPass:     conf.nickservPass,
+		socket:           conf.socket,
+		logger:           conf.logger,
+		channels:         make(map[string]*Channel),
+		queries:          make(map[string]*Channel),
+		reads:            make(chan message, 32),
+		writes:           make(chan message, 32),
+		params:           make(map[string]string),
+		handler:          conf.handler,
+		dcc:              newDCCState(conf.dccHandler, conf.dccMaxSize, conf.dccIP),
+		started:          make(chan struct{}),
+		closing:          make(chan struct{}),
+		quitSent:         make(chan struct{}),
+		serverClosed:     make(chan struct{}),
+		aliveTimeout:     2 * time.Minute,
+		wantCaps:         conf.caps,
+		capsDone:         make(chan struct{}),
+		enabledCaps:      NewSet(),
+		availCaps:        make(map[string]string),
+		batches:          make(map[string]*Batch),
+		batchHandlers:    conf.batchHandlers,
+		tagHandlers:      conf.tagHandlers,
+		keepEchoes:       conf.keepEchoes,
+		users:            newUserTracker(),
+		presence:         newPresenceState(),
+		presenceHandlers: conf.presenceHandlers,
+		stsHost:          conf.stsHost,
+		stsStore:         conf.stsStore,
+		replyHandlers:    conf.replyHandlers,
+		requests:         newRequests(),
+		history:          newHistoryState(conf.history),
+		backfill:         conf.backfill,
+		maxQueries:       conf.maxQueries,
+	}
+	if conf.transcode {
+		c.charmap = conf.charmap
 	}
-	return &c, cancel
+	c.dispatcher = newDispatcher(c, conf)
+	return c
 }
@@ -0,0 +1,214 @@
+package ircfw
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"gitea.demsh.org/demsh/ircfw/ircfwtest"
+	"golang.org/x/text/encoding/charmap"
+)
+
+func newServerClient(t *testing.T, server *ircfwtest.Server, nick string, opts ...Option) *Client {
+	opts = append([]Option{Socket(server.Conn()), Nick(nick), SetLogger(nopLogger{}), Handler(func(Msg) {})}, opts...)
+	client, cancel := NewClient(opts...)
+	t.Cleanup(cancel)
+	return client
+}
+
+// Client built like NewClient does, registered as ircfw!~ircfw@5838b91c with
+// caps enabled. Its loops are not running, so tests feed handlers directly
+// and read client.writes themselves
+func newTestClient(t *testing.T, caps map[string]string, opts ...Option) *Client {
+	local, remote := net.Pipe()
+	conf := defaultConfig()
+	opts = append([]Option{Socket(local), SetLogger(nopLogger{}), Handler(func(Msg) {})}, opts...)
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	client := newClient(conf)
+	client.prefix = "ircfw!~ircfw@5838b91c"
+	for name, value := range caps {
+		client.availCaps[name] = value
+		client.enabledCaps.Add(name)
+	}
+	close(client.started)
+	t.Cleanup(func() {
+		client.tomb.Kill(nil)
+		local.Close()
+		remote.Close()
+	})
+	return client
+}
+
+func TestAPIErrors(t *testing.T) {
+	server := ircfwtest.New()
+	defer server.Close()
+	client := newServerClient(t, server, "ircfw")
+	newServerClient(t, server, "other")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancel()
+	channel, err := client.Join(ctx, jchannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.SetNick(ctx, "#bad"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("invalid nick: %v", err)
+	}
+	if err := channel.Say(ctx, ""); !errors.Is(err, ErrInvalid) {
+		t.Errorf("empty text: %v", err)
+	}
+	if err := client.Privmsg(ctx, "#bad,", "text"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("invalid target: %v", err)
+	}
+	if _, err := client.Whois(ctx, "nobody"); !errors.Is(err, ErrRejected) {
+		t.Errorf("whois of unknown nick: %v", err)
+	}
+	if err := client.SetNick(ctx, "other"); !errors.Is(err, ErrRejected) {
+		t.Errorf("taken nick: %v", err)
+	}
+	if err := client.SetNick(ctx, "renamed"); err != nil || client.Nick() != "renamed" {
+		t.Errorf("nick %q: %v", client.Nick(), err)
+	}
+	if err := channel.SetTopic(ctx, "new topic"); err != nil {
+		t.Error(err)
+	}
+
+	server.Handle("TOPIC", func(*ircfwtest.Session, ircfwtest.Line) {})
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if err := channel.SetTopic(short, "ignored"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unanswered topic: %v", err)
+	}
+
+	if err := channel.Part(ctx); err != nil {
+		t.Error(err)
+	}
+	// used to block forever as txLoop of parted channel is gone
+	for i := 0; i < 16; i++ {
+		if err := channel.Say(ctx, "after part"); !errors.Is(err, ErrNotJoined) {
+			t.Fatalf("say after part: %v", err)
+		}
+	}
+	if err := channel.Part(ctx); !errors.Is(err, ErrNotJoined) {
+		t.Errorf("second part: %v", err)
+	}
+
+	if err := client.Quit(ctx, "bye"); err != nil {
+		t.Error(err)
+	}
+	if err := client.Privmsg(ctx, "other", "after quit"); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("privmsg after quit: %v", err)
+	}
+	if _, err := client.Join(ctx, "#other"); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("join after quit: %v", err)
+	}
+}
+
+func TestCompat(t *testing.T) {
+	server := ircfwtest.New()
+	defer server.Close()
+	client := newServerClient(t, server, "ircfw")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancel()
+	channel, err := client.Join(ctx, jchannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	CompatChannel{channel}.Say("compat")
+	if _, err := server.ExpectCommand(timeout*time.Second, "PRIVMSG", jchannel, "compat"); err != nil {
+		t.Error(err)
+	}
+	CompatChannel{channel}.Part()
+	CompatChannel{channel}.Say("dropped")
+	CompatClient{client}.Quit("bye")
+	if _, err := server.ExpectCommand(timeout*time.Second, "QUIT", "bye"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	server := ircfwtest.New()
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancel()
+	plain := newServerClient(t, server, "plain", Charmap(charmap.Windows1251))
+	if err := plain.Privmsg(ctx, "other", "привет"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.ExpectCommand(timeout*time.Second, "PRIVMSG", "other", "привет"); err != nil {
+		t.Errorf("charmap without Transcode changed the line: %v", err)
+	}
+	transcoded := newServerClient(t, server, "cp1251", Charmap(charmap.Windows1251), Transcode())
+	if err := transcoded.Privmsg(ctx, "other", "пока"); err != nil {
+		t.Fatal(err)
+	}
+	encoded, _ := charmap.Windows1251.NewEncoder().String("пока")
+	if _, err := server.ExpectCommand(timeout*time.Second, "PRIVMSG", "other", encoded); err != nil {
+		t.Errorf("line was not transcoded: %v", err)
+	}
+}
+
+func TestTextInjection(t *testing.T) {
+	server := ircfwtest.New()
+	defer server.Close()
+	client := newServerClient(t, server, "ircfw")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancel()
+	channel, err := client.Join(ctx, jchannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := ircMsg{msgid: "m1", channel: channel, client: client}
+	for name, send := range map[string]func() error{
+		"Say":   func() error { return channel.Say(ctx, "hi\r\nQUIT :pwned") },
+		"Reply": func() error { return msg.Reply(ctx, []string{"hi", "\nQUIT :pwned"}) },
+		"SayConfirmed": func() error {
+			_, err := channel.SayConfirmed(ctx, []string{"hi\x00"})
+			return err
+		},
+	} {
+		if err := send(); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s with line break: %v", name, err)
+		}
+	}
+	if line, err := server.ExpectCommand(100*time.Millisecond, "PRIVMSG"); err == nil {
+		t.Errorf("text was sent: %q", line)
+	}
+	if line, err := server.ExpectCommand(10*time.Millisecond, "QUIT"); err == nil {
+		t.Errorf("command was injected: %q", line)
+	}
+}
+
+func TestNickLen(t *testing.T) {
+	for _, test := range []struct {
+		isupport []string
+		valid    string
+		invalid  string
+	}{
+		{nil, strings.Repeat("n", 30), strings.Repeat("n", NICK_LENGTH_LIMIT+1)},
+		{[]string{"NICKLEN=16"}, strings.Repeat("n", 16), strings.Repeat("n", 17)},
+	} {
+		server := ircfwtest.New(ircfwtest.ISupport(test.isupport...))
+		defer server.Close()
+		client := newServerClient(t, server, "ircfw")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+		defer cancel()
+		if _, err := client.Join(ctx, jchannel); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Privmsg(ctx, test.valid, "text"); err != nil {
+			t.Errorf("%v: %d bytes nick: %v", test.isupport, len(test.valid), err)
+		}
+		if _, err := client.Query(test.valid); err != nil {
+			t.Errorf("%v: %d bytes query: %v", test.isupport, len(test.valid), err)
+		}
+		if err := client.Privmsg(ctx, test.invalid, "text"); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%v: %d bytes nick: %v", test.isupport, len(test.invalid), err)
+		}
+	}
+}
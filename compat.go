@@ -0,0 +1,80 @@
+package ircfw
+
+import (
+	"context"
+)
+
+// Client with methods of the API before they took context and returned
+// errors. Operations time out after 10 seconds and failures are logged
+// with Debug. Meant for existing handlers:
+//
+//	ircfw.CompatClient{msg.Client()}.Whois(nick)
+//
+// Deprecated: use Client methods directly.
+type CompatClient struct {
+	*Client
+}
+
+func (c CompatClient) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.tomb.Context(nil), sendTimeout)
+}
+
+func (c CompatClient) Quit(reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if err := c.Client.Quit(ctx, reason); err != nil {
+		c.Debug("Quit: %s", err)
+	}
+}
+
+func (c CompatClient) SetNick(nick string) {
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.Client.SetNick(ctx, nick); err != nil {
+		c.Debug("SetNick %q: %s", nick, err)
+	}
+}
+
+func (c CompatClient) Whois(nick string) {
+	ctx, cancel := c.context()
+	defer cancel()
+	if _, err := c.Client.Whois(ctx, nick); err != nil {
+		c.Debug("Whois %q: %s", nick, err)
+	}
+}
+
+// Channel with methods of the API before they took context and returned
+// errors, see CompatClient
+//
+// Deprecated: use Channel methods directly.
+type CompatChannel struct {
+	*Channel
+}
+
+func (c CompatChannel) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.client.tomb.Context(nil), sendTimeout)
+}
+
+func (c CompatChannel) Say(content string) {
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.Channel.Say(ctx, content); err != nil {
+		c.Debug("Say in %q: %s", c.Name(), err)
+	}
+}
+
+func (c CompatChannel) SetTopic(topic string) {
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.Channel.SetTopic(ctx, topic); err != nil {
+		c.Debug("SetTopic in %q: %s", c.Name(), err)
+	}
+}
+
+func (c CompatChannel) Part() {
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.Channel.Part(ctx); err != nil {
+		c.Debug("Part %q: %s", c.Name(), err)
+	}
+}
@@ -3,6 +3,7 @@ package ircfw
 import (
 	"context"
 	"net"
+	"time"
 
 	"golang.org/x/text/encoding/charmap"
 )
@@ -12,11 +13,31 @@ type Option func(*config)
 type config struct {
 	nick, ident, realName  string
 	password, nickservPass string
-	handler                MsgHandler
+	handler                ContextHandler
 	socket                 net.Conn
 	logger                 Logger
 	charmap                *charmap.Charmap
+	transcode              bool
 	context                context.Context
+	dccHandler             DCCHandler
+	dccMaxSize             int64
+	dccIP                  net.IP
+	caps                   []string
+	batchHandlers          []BatchHandler
+	tagHandlers            []TagMsgHandler
+	keepEchoes             bool
+	presenceHandlers       []PresenceHandler
+	stsHost                string
+	stsStore               STSStore
+	replyHandlers          []StandardReplyHandler
+	backfill               int
+	history                HistorySnapshot
+	maxQueries             int
+	dispatchMode           DispatchMode
+	workers                int
+	backpressure           BackpressurePolicy
+	queueSize              int
+	handlerTimeout         time.Duration
 }
 
 func defaultConfig() config {
@@ -25,6 +46,9 @@ func defaultConfig() config {
 		ident:    "ircfw",
 		realName: "ircfw",
 		context:  context.Background(),
+		caps:     defaultCaps,
+		// every query keeps two goroutines
+		maxQueries: 100,
 	}
 }
 
@@ -40,6 +64,14 @@ func Charmap(charmap *charmap.Charmap) Option {
 	}
 }
 
+// Encodes sent and decodes received lines with Charmap,
+// lines are passed as is by default
+func Transcode() Option {
+	return func(c *config) {
+		c.transcode = true
+	}
+}
+
 func SetLogger(logger Logger) Option {
 	return func(c *config) {
 		c.logger = logger
@@ -53,11 +85,138 @@ func Socket(socket net.Conn) Option {
 }
 
 func Handler(handler MsgHandler) Option {
+	return func(c *config) {
+		c.handler = AdaptHandler(handler)
+	}
+}
+
+// Like Handler but handler observes cancellation and deadline of the message
+func HandleContext(handler ContextHandler) Option {
 	return func(c *config) {
 		c.handler = handler
 	}
 }
 
+func DCC(handler DCCHandler) Option {
+	return func(c *config) {
+		c.dccHandler = handler
+	}
+}
+
+// Limits size of files accepted over DCC SEND, 0 means no limit
+func DCCMaxSize(size int64) Option {
+	return func(c *config) {
+		c.dccMaxSize = size
+	}
+}
+
+// Address advertised in DCC offers, defaults to local address of the socket
+func DCCAddress(ip net.IP) Option {
+	return func(c *config) {
+		c.dccIP = ip
+	}
+}
+
+// Requests additional IRCv3 capabilities
+func Caps(names ...string) Option {
+	return func(c *config) {
+		c.caps = append(append([]string{}, c.caps...), names...)
+	}
+}
+
+// Subscribes handler to completed batches, may be used several times
+func OnBatch(handler BatchHandler) Option {
+	return func(c *config) {
+		c.batchHandlers = append(c.batchHandlers, handler)
+	}
+}
+
+// Subscribes handler to TAGMSG such as reactions, may be used several times
+func OnTagMsg(handler TagMsgHandler) Option {
+	return func(c *config) {
+		c.tagHandlers = append(c.tagHandlers, handler)
+	}
+}
+
+// Delivers echoes of own messages to MsgHandler, they are dropped by default
+func KeepEchoes() Option {
+	return func(c *config) {
+		c.keepEchoes = true
+	}
+}
+
+// Subscribes handler to presence changes of nicks passed to Client.Monitor
+func OnPresence(handler PresenceHandler) Option {
+	return func(c *config) {
+		c.presenceHandlers = append(c.presenceHandlers, handler)
+	}
+}
+
+// Enforces STS policies of host kept in store, see Dial
+func STS(host string, store STSStore) Option {
+	return func(c *config) {
+		c.stsHost = host
+		c.stsStore = store
+	}
+}
+
+// Subscribes handler to FAIL, WARN and NOTE standard replies, the only way to
+// learn about FAIL of Privmsg and Send without labeled-response
+func OnStandardReply(handler StandardReplyHandler) Option {
+	return func(c *config) {
+		c.replyHandlers = append(c.replyHandlers, handler)
+	}
+}
+
+// Limits open private conversations, the least recently active one is
+// closed to make room for a new one, 0 means no limit
+func MaxQueries(limit int) Option {
+	return func(c *config) {
+		c.maxQueries = limit
+	}
+}
+
+// Replays up to limit missed messages with draft/chathistory after every join
+func Backfill(limit int) Option {
+	return func(c *config) {
+		c.backfill = limit
+	}
+}
+
+// Continues backfill and de-duplication from snapshot taken by
+// Client.HistorySnapshot of a previous connection
+func ResumeHistory(snapshot HistorySnapshot) Option {
+	return func(c *config) {
+		c.history = snapshot
+	}
+}
+
+// Selects how messages are handed to MsgHandler, workers is the size
+// of WorkerPool and is ignored by other modes
+func Dispatch(mode DispatchMode, workers int) Option {
+	return func(c *config) {
+		c.dispatchMode = mode
+		c.workers = workers
+	}
+}
+
+// Limits messages awaiting MsgHandler in every queue to size
+// and picks what happens when the limit is reached
+func Backpressure(policy BackpressurePolicy, size int) Option {
+	return func(c *config) {
+		c.backpressure = policy
+		c.queueSize = size
+	}
+}
+
+// Cancels context of MsgHandler after timeout, the next message of the
+// same queue is still handled only after the handler returns
+func HandlerTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.handlerTimeout = timeout
+	}
+}
+
 func Nick(nick string) Option {
 	return func(c *config) {
 		c.nick = nick
@@ -0,0 +1,34 @@
+package ircfw
+
+import (
+	"strings"
+)
+
+const CTCPDelim = "\x01"
+
+func isCTCP(text string) bool {
+	return len(text) > 1 && strings.HasPrefix(text, CTCPDelim)
+}
+
+// Returns CTCP command and its arguments, closing delimiter is optional
+func parseCTCP(text string) (cmd string, args string) {
+	text = strings.TrimPrefix(text, CTCPDelim)
+	text = strings.TrimSuffix(text, CTCPDelim)
+	cmd, args = pop(text, " ")
+	return strings.ToUpper(cmd), args
+}
+
+func ctcpQuote(cmd string, args string) string {
+	if args == "" {
+		return CTCPDelim + cmd + CTCPDelim
+	}
+	return CTCPDelim + cmd + " " + args + CTCPDelim
+}
+
+func (c *Client) sendCTCP(nick string, cmd string, args string) {
+	c.sendMessage("PRIVMSG", []string{nick, ctcpQuote(cmd, args)})
+}
+
+func (c *Client) sendCTCPReply(nick string, cmd string, args string) {
+	c.sendMessage("NOTICE", []string{nick, ctcpQuote(cmd, args)})
+}
@@ -0,0 +1,550 @@
+package ircfw
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type DCCType string
+
+const (
+	DCCChat   DCCType = "CHAT"
+	DCCSend   DCCType = "SEND"
+	DCCResume DCCType = "RESUME"
+	DCCAccept DCCType = "ACCEPT"
+	DCCReject DCCType = "REJECT"
+)
+
+const (
+	DCCBufSize    = 8192
+	DCCLineLimit  = 4096
+	dccAckTimeout = 30 * time.Second
+	// resolving host of the peer allowed to connect
+	dccLookupTimeout = 5 * time.Second
+)
+
+var (
+	ErrDCCInvalid  = errors.New("invalid DCC request")
+	ErrDCCRejected = errors.New("DCC offer rejected")
+	ErrDCCTooLarge = errors.New("DCC transfer exceeds size limit")
+)
+
+// Called in separate goroutine for every incoming CHAT or SEND offer.
+// Handler must either accept the offer with Receive/Resume/Chat or Reject it.
+type DCCHandler func(offer *DCCOffer)
+
+// Reports amount of transferred bytes, total is 0 when size is unknown
+type DCCProgress func(transferred, total int64)
+
+type DCCOffer struct {
+	Type     DCCType
+	Nick     string
+	Filename string
+	IP       net.IP
+	Port     int
+	Size     int64
+	Position int64
+	Token    string
+	client   *Client
+}
+
+type dccState struct {
+	sync.Mutex
+	handler DCCHandler
+	maxSize int64
+	ip      net.IP
+	// outgoing offers awaiting RESUME, ACCEPT or passive reply
+	pending map[string]chan *DCCOffer
+	chats   map[*Channel]struct{}
+}
+
+func newDCCState(handler DCCHandler, maxSize int64, ip net.IP) *dccState {
+	return &dccState{
+		handler: handler,
+		maxSize: maxSize,
+		ip:      ip,
+		pending: make(map[string]chan *DCCOffer),
+		chats:   make(map[*Channel]struct{}),
+	}
+}
+
+func dccKey(port int, token string) string {
+	if token != "" {
+		return "token:" + token
+	}
+	return "port:" + strconv.Itoa(port)
+}
+
+func (d *dccState) await(key string) chan *DCCOffer {
+	ch := make(chan *DCCOffer, 1)
+	d.Lock()
+	d.pending[key] = ch
+	d.Unlock()
+	return ch
+}
+
+func (d *dccState) forget(key string) {
+	d.Lock()
+	delete(d.pending, key)
+	d.Unlock()
+}
+
+func (d *dccState) deliver(offer *DCCOffer) bool {
+	d.Lock()
+	ch, ok := d.pending[dccKey(offer.Port, offer.Token)]
+	d.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- offer:
+	default:
+	}
+	return true
+}
+
+// Splits DCC arguments honoring double-quoted filenames with spaces
+func splitDCCArgs(args string) (result []string) {
+	args = strings.TrimSpace(args)
+	for args != "" {
+		if args[0] == '"' {
+			if i := strings.Index(args[1:], "\""); i != -1 {
+				result = append(result, args[1:i+1])
+				args = strings.TrimSpace(args[i+2:])
+				continue
+			}
+		}
+		var field string
+		field, args = pop(args, " ")
+		result = append(result, field)
+		args = strings.TrimSpace(args)
+	}
+	return
+}
+
+func quoteFilename(filename string) string {
+	if strings.Contains(filename, " ") {
+		return "\"" + filename + "\""
+	}
+	return filename
+}
+
+func parseDCCIP(s string) (net.IP, error) {
+	if strings.Contains(s, ":") {
+		if ip := net.ParseIP(s); ip != nil {
+			return ip, nil
+		}
+		return nil, fmt.Errorf("%w: bad address %q", ErrDCCInvalid, s)
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad address %q", ErrDCCInvalid, s)
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, uint32(n))
+	return ip, nil
+}
+
+func formatDCCIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(ip4)), 10)
+	}
+	return ip.String()
+}
+
+func parseDCCPort(s string) (int, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad port %q", ErrDCCInvalid, s)
+	}
+	return int(port), nil
+}
+
+func parseDCCSize(s string) (int64, error) {
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("%w: bad size %q", ErrDCCInvalid, s)
+	}
+	return size, nil
+}
+
+// Parses arguments of DCC CTCP request, args must not include "DCC" itself
+func parseDCC(nick string, args string) (offer *DCCOffer, err error) {
+	fields := splitDCCArgs(args)
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("%w: too few arguments %q", ErrDCCInvalid, args)
+	}
+	offer = &DCCOffer{
+		Type:     DCCType(strings.ToUpper(fields[0])),
+		Nick:     nick,
+		Filename: fields[1],
+	}
+	switch offer.Type {
+	case DCCChat, DCCSend:
+		if offer.IP, err = parseDCCIP(fields[2]); err != nil {
+			return nil, err
+		}
+		if offer.Port, err = parseDCCPort(fields[3]); err != nil {
+			return nil, err
+		}
+		rest := fields[4:]
+		if offer.Type == DCCSend && len(rest) > 0 {
+			if offer.Size, err = parseDCCSize(rest[0]); err != nil {
+				return nil, err
+			}
+			rest = rest[1:]
+		}
+		if len(rest) > 0 {
+			offer.Token = rest[0]
+		}
+	case DCCResume, DCCAccept:
+		if offer.Port, err = parseDCCPort(fields[2]); err != nil {
+			return nil, err
+		}
+		if offer.Position, err = parseDCCSize(fields[3]); err != nil {
+			return nil, err
+		}
+		if len(fields) > 4 {
+			offer.Token = fields[4]
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported type %q", ErrDCCInvalid, fields[0])
+	}
+	// "." and ".." would escape the directory the file is saved to
+	if strings.Trim(offer.Filename, ".") == "" || strings.ContainsAny(offer.Filename, "/\\") {
+		return nil, fmt.Errorf("%w: bad filename %q", ErrDCCInvalid, offer.Filename)
+	}
+	return offer, nil
+}
+
+func (o *DCCOffer) String() string {
+	switch o.Type {
+	case DCCResume, DCCAccept:
+		args := []string{string(o.Type), quoteFilename(o.Filename), strconv.Itoa(o.Port), strconv.FormatInt(o.Position, 10)}
+		if o.Token != "" {
+			args = append(args, o.Token)
+		}
+		return join(args, " ")
+	default:
+		args := []string{string(o.Type), quoteFilename(o.Filename), formatDCCIP(o.IP), strconv.Itoa(o.Port)}
+		if o.Type == DCCSend {
+			args = append(args, strconv.FormatInt(o.Size, 10))
+		}
+		if o.Token != "" {
+			args = append(args, o.Token)
+		}
+		return join(args, " ")
+	}
+}
+
+func handleDCC(msg message, args string) {
+	client := msg.Client()
+	offer, err := parseDCC(msg.Nick(), args)
+	if err != nil {
+		client.Debug("Got invalid DCC from %q: %s", msg.Nick(), err)
+		return
+	}
+	offer.client = client
+	dcc := client.dcc
+	switch offer.Type {
+	case DCCResume, DCCAccept:
+		if !dcc.deliver(offer) {
+			client.Debug("Got unsolicited DCC %s from %q", offer.Type, offer.Nick)
+		}
+		return
+	}
+	if offer.Token != "" && offer.Port != 0 && dcc.deliver(offer) {
+		// reply to our passive offer
+		return
+	}
+	if dcc.handler == nil {
+		client.Debug("No DCC handler, rejecting %s from %q", offer.Type, offer.Nick)
+		offer.Reject()
+		return
+	}
+	if offer.Type == DCCSend && dcc.maxSize > 0 && offer.Size > dcc.maxSize {
+		client.Debug("DCC SEND %q from %q is too large: %d", offer.Filename, offer.Nick, offer.Size)
+		offer.Reject()
+		return
+	}
+	go dcc.handler(offer)
+}
+
+func (c *Client) dccIP() net.IP {
+	if c.dcc.ip != nil {
+		return c.dcc.ip
+	}
+	if addr, ok := c.socket.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// Closes conn when ctx is done, returned function stops the watcher
+func closeOnDone(ctx context.Context, conn io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func dccDial(ctx context.Context, ip net.IP, port int) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+}
+
+// Listens on the address of the IRC connection rather than on every interface
+func (c *Client) dccListen() (net.Listener, int, error) {
+	ip := net.IPv4(127, 0, 0, 1)
+	if addr, ok := c.socket.LocalAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return nil, 0, err
+	}
+	return listener, listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Address nick is expected to connect from, nil if unknown, e.g. for
+// cloaked hosts or users not sharing a channel with the client
+func (c *Client) dccPeer(ctx context.Context, nick string) net.IP {
+	user, ok := c.User(nick)
+	if !ok || user.Host == "" {
+		return nil
+	}
+	if ip := net.ParseIP(user.Host); ip != nil {
+		return ip
+	}
+	ctx, cancel := context.WithTimeout(ctx, dccLookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, user.Host)
+	if err != nil || len(addrs) == 0 {
+		c.Debug("Can't resolve host %q of %q: %v", user.Host, nick, err)
+		return nil
+	}
+	return addrs[0].IP
+}
+
+// Accepts single connection from peer and closes listener, connections
+// from other addresses are dropped, nil peer accepts anyone
+func dccAccept(ctx context.Context, listener net.Listener, peer net.IP) (net.Conn, error) {
+	stop := closeOnDone(ctx, listener)
+	defer stop()
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if peer == nil || ok && addr.IP.Equal(peer) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+func dccToken() (string, error) {
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(uint64(binary.BigEndian.Uint32(buf[:])), 10), nil
+}
+
+// Streams file from conn into w starting at offset, acknowledging every chunk
+func receiveFile(ctx context.Context, conn net.Conn, w io.Writer, offset, size, limit int64, progress DCCProgress) (int64, error) {
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+	buf := make([]byte, DCCBufSize)
+	ack := make([]byte, 4)
+	total := offset
+	for size == 0 || total < size {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			total += int64(n)
+			if limit > 0 && total > limit {
+				return total - offset, ErrDCCTooLarge
+			}
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return total - offset, werr
+			}
+			binary.BigEndian.PutUint32(ack, uint32(total))
+			if _, werr := conn.Write(ack); werr != nil {
+				return total - offset, werr
+			}
+			if progress != nil {
+				progress(total, size)
+			}
+		}
+		if err == io.EOF {
+			if size > 0 && total < size {
+				return total - offset, io.ErrUnexpectedEOF
+			}
+			return total - offset, nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return total - offset, ctx.Err()
+			}
+			return total - offset, err
+		}
+	}
+	return total - offset, nil
+}
+
+// Streams r into conn and waits for receiver to acknowledge the last byte
+func sendFile(ctx context.Context, conn net.Conn, r io.Reader, offset, size int64, progress DCCProgress) (int64, error) {
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+	var acked uint32
+	acks := make(chan struct{}, 1)
+	acksDone := make(chan struct{})
+	go func() {
+		defer close(acksDone)
+		ack := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(conn, ack); err != nil {
+				return
+			}
+			atomic.StoreUint32(&acked, binary.BigEndian.Uint32(ack))
+			select {
+			case acks <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	buf := make([]byte, DCCBufSize)
+	total := offset
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				if ctx.Err() != nil {
+					return total - offset, ctx.Err()
+				}
+				return total - offset, werr
+			}
+			total += int64(n)
+			if progress != nil {
+				progress(total, size)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return total - offset, err
+		}
+	}
+	timeout := time.NewTimer(dccAckTimeout)
+	defer timeout.Stop()
+	// nothing is acknowledged if nothing was sent, acks carry low 32 bits
+	for total > offset && atomic.LoadUint32(&acked) != uint32(total) {
+		select {
+		case <-acks:
+		case <-acksDone:
+			return total - offset, nil
+		case <-ctx.Done():
+			return total - offset, ctx.Err()
+		case <-timeout.C:
+			return total - offset, nil
+		}
+	}
+	return total - offset, nil
+}
+
+func skipTo(r io.Reader, offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(offset, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, offset)
+	return err
+}
+
+func newDCCChannel(nick string, conn net.Conn, client *Client) *Channel {
+	c := newChannel("="+nick, client)
+	c.dcc = conn
+	c.peer = nick
+	client.dcc.Lock()
+	client.dcc.chats[c] = struct{}{}
+	client.dcc.Unlock()
+	c.start()
+	go c.dccReadLoop()
+	return c
+}
+
+// meant to run in separate goroutine
+func (c *Channel) dccReadLoop() {
+	defer func() {
+		c.kill()
+		c.client.dcc.Lock()
+		delete(c.client.dcc.chats, c)
+		c.client.dcc.Unlock()
+	}()
+	in := bufio.NewScanner(c.dcc)
+	in.Buffer(make([]byte, DCCLineLimit), DCCLineLimit)
+	for in.Scan() {
+		line := strings.TrimRight(in.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		msg := ircMsg{
+			time:    time.Now(),
+			prefix:  c.Peer(),
+			text:    []string{line},
+			channel: c,
+			client:  c.client,
+		}
+		select {
+		case <-c.quit:
+			return
+		case c.receive <- msg:
+		}
+	}
+	if err := in.Err(); err != nil {
+		c.Debug("DCC CHAT with %q failed: %s", c.Peer(), err)
+	}
+}
+
+func (c *Channel) writeDCC(msg Msg) {
+	for _, line := range msg.WrappedText() {
+		if _, err := io.WriteString(c.dcc, line+"\n"); err != nil {
+			c.Debug("DCC CHAT with %q write failed: %s", c.Peer(), err)
+			c.kill()
+			return
+		}
+	}
+}
+
+func (c *Client) killDCC() {
+	c.dcc.Lock()
+	defer c.dcc.Unlock()
+	for channel := range c.dcc.chats {
+		channel.kill()
+	}
+}
@@ -0,0 +1,210 @@
+package ircfw
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+)
+
+func (o *DCCOffer) IsPassive() bool {
+	return o.Port == 0 && o.Token != ""
+}
+
+func (o *DCCOffer) Client() *Client {
+	return o.client
+}
+
+func (o *DCCOffer) Reject() {
+	o.client.sendCTCPReply(o.Nick, "DCC", join([]string{string(DCCReject), string(o.Type), quoteFilename(o.Filename)}, " "))
+}
+
+// Establishes connection for accepted offer, for passive offers
+// listens and sends reply with our address instead of connecting
+func (o *DCCOffer) connect(ctx context.Context) (net.Conn, error) {
+	if !o.IsPassive() {
+		return dccDial(ctx, o.IP, o.Port)
+	}
+	peer := o.client.dccPeer(ctx, o.Nick)
+	listener, port, err := o.client.dccListen()
+	if err != nil {
+		return nil, err
+	}
+	reply := *o
+	reply.IP = o.client.dccIP()
+	reply.Port = port
+	o.client.sendCTCP(o.Nick, "DCC", reply.String())
+	return dccAccept(ctx, listener, peer)
+}
+
+// Accepts DCC SEND and streams the file into w
+func (o *DCCOffer) Receive(ctx context.Context, w io.Writer, progress DCCProgress) (int64, error) {
+	return o.Resume(ctx, w, 0, progress)
+}
+
+// Accepts DCC SEND asking sender to start from position,
+// w is expected to already contain first position bytes
+func (o *DCCOffer) Resume(ctx context.Context, w io.Writer, position int64, progress DCCProgress) (int64, error) {
+	if o.Type != DCCSend {
+		return 0, fmt.Errorf("%w: can't receive file from DCC %s", ErrDCCInvalid, o.Type)
+	}
+	if position > 0 {
+		if o.Size > 0 && position >= o.Size {
+			return 0, fmt.Errorf("%w: resume position %d beyond size %d", ErrDCCInvalid, position, o.Size)
+		}
+		key := dccKey(o.Port, o.Token)
+		accepted := o.client.dcc.await(key)
+		resume := DCCOffer{Type: DCCResume, Filename: o.Filename, Port: o.Port, Position: position, Token: o.Token}
+		o.client.sendCTCP(o.Nick, "DCC", resume.String())
+		select {
+		case <-ctx.Done():
+			o.client.dcc.forget(key)
+			return 0, ctx.Err()
+		case reply := <-accepted:
+			o.client.dcc.forget(key)
+			if reply.Type != DCCAccept {
+				return 0, fmt.Errorf("%w: expected ACCEPT, got %s", ErrDCCInvalid, reply.Type)
+			}
+			position = reply.Position
+		}
+	}
+	conn, err := o.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return receiveFile(ctx, conn, w, position, o.Size, o.client.dcc.maxSize, progress)
+}
+
+// Accepts DCC CHAT, lines are delivered to client handler as private messages
+func (o *DCCOffer) Chat(ctx context.Context) (*Channel, error) {
+	if o.Type != DCCChat {
+		return nil, fmt.Errorf("%w: can't chat over DCC %s", ErrDCCInvalid, o.Type)
+	}
+	conn, err := o.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newDCCChannel(o.Nick, conn, o.client), nil
+}
+
+// Offers DCC CHAT to nick and waits for connection
+func (c *Client) OfferChat(ctx context.Context, nick string) (*Channel, error) {
+	if err := validateNick(nick, c.nickLen()); err != nil {
+		return nil, invalid("nick", err)
+	}
+	peer := c.dccPeer(ctx, nick)
+	listener, port, err := c.dccListen()
+	if err != nil {
+		return nil, err
+	}
+	offer := DCCOffer{Type: DCCChat, Filename: "chat", IP: c.dccIP(), Port: port}
+	c.sendCTCP(nick, "DCC", offer.String())
+	conn, err := dccAccept(ctx, listener, peer)
+	if err != nil {
+		return nil, err
+	}
+	return newDCCChannel(nick, conn, c), nil
+}
+
+// Offers file to nick and streams r once the offer is accepted,
+// r should implement io.Seeker to serve RESUME requests efficiently
+func (c *Client) OfferFile(ctx context.Context, nick, filename string, r io.Reader, size int64, progress DCCProgress) (int64, error) {
+	if err := validateNick(nick, c.nickLen()); err != nil {
+		return 0, invalid("nick", err)
+	}
+	if err := validateFilename(filename); err != nil {
+		return 0, invalid("filename", err)
+	}
+	peer := c.dccPeer(ctx, nick)
+	listener, port, err := c.dccListen()
+	if err != nil {
+		return 0, err
+	}
+	key := dccKey(port, "")
+	resumes := c.dcc.await(key)
+	defer c.dcc.forget(key)
+	offer := DCCOffer{Type: DCCSend, Filename: filename, IP: c.dccIP(), Port: port, Size: size}
+	c.sendCTCP(nick, "DCC", offer.String())
+
+	type accepted struct {
+		conn net.Conn
+		err  error
+	}
+	conns := make(chan accepted, 1)
+	go func() {
+		conn, err := dccAccept(ctx, listener, peer)
+		conns <- accepted{conn, err}
+	}()
+	var offset int64
+	for {
+		select {
+		case resume := <-resumes:
+			offset = c.acceptResume(nick, resume, offset, size)
+		case a := <-conns:
+			if a.err != nil {
+				return 0, a.err
+			}
+			defer a.conn.Close()
+			if err := skipTo(r, offset); err != nil {
+				return 0, err
+			}
+			return sendFile(ctx, a.conn, r, offset, size, progress)
+		}
+	}
+}
+
+// Offers file to nick using passive DCC, receiver is expected to
+// listen and reply with its address
+func (c *Client) OfferFilePassive(ctx context.Context, nick, filename string, r io.Reader, size int64, progress DCCProgress) (int64, error) {
+	if err := validateNick(nick, c.nickLen()); err != nil {
+		return 0, invalid("nick", err)
+	}
+	if err := validateFilename(filename); err != nil {
+		return 0, invalid("filename", err)
+	}
+	token, err := dccToken()
+	if err != nil {
+		return 0, err
+	}
+	key := dccKey(0, token)
+	replies := c.dcc.await(key)
+	defer c.dcc.forget(key)
+	offer := DCCOffer{Type: DCCSend, Filename: filename, IP: c.dccIP(), Port: 0, Size: size, Token: token}
+	c.sendCTCP(nick, "DCC", offer.String())
+	var offset int64
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case reply := <-replies:
+			if reply.Type == DCCResume {
+				offset = c.acceptResume(nick, reply, offset, size)
+				continue
+			}
+			if reply.Type != DCCSend {
+				return 0, fmt.Errorf("%w: unexpected reply %s", ErrDCCInvalid, reply.Type)
+			}
+			conn, err := dccDial(ctx, reply.IP, reply.Port)
+			if err != nil {
+				return 0, err
+			}
+			defer conn.Close()
+			if err := skipTo(r, offset); err != nil {
+				return 0, err
+			}
+			return sendFile(ctx, conn, r, offset, size, progress)
+		}
+	}
+}
+
+func (c *Client) acceptResume(nick string, resume *DCCOffer, offset, size int64) int64 {
+	if resume.Type != DCCResume || resume.Position > size {
+		c.Debug("Ignoring DCC %s from %q at %d", resume.Type, nick, resume.Position)
+		return offset
+	}
+	accept := *resume
+	accept.Type = DCCAccept
+	c.sendCTCP(nick, "DCC", accept.String())
+	return resume.Position
+}
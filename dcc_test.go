@@ -0,0 +1,203 @@
+package ircfw
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDCC(t *testing.T) {
+	samples := []string{
+		"SEND file.txt 2130706433 5000 1024",
+		"SEND \"my file.txt\" 2130706433 0 1024 42",
+		"CHAT chat 2130706433 5001",
+		"RESUME file.txt 5000 512",
+		"ACCEPT file.txt 0 512 42",
+		"SEND file.txt ::1 5000 1024",
+	}
+	valids := []DCCOffer{
+		{Type: DCCSend, Filename: "file.txt", IP: net.IPv4(127, 0, 0, 1), Port: 5000, Size: 1024},
+		{Type: DCCSend, Filename: "my file.txt", IP: net.IPv4(127, 0, 0, 1), Port: 0, Size: 1024, Token: "42"},
+		{Type: DCCChat, Filename: "chat", IP: net.IPv4(127, 0, 0, 1), Port: 5001},
+		{Type: DCCResume, Filename: "file.txt", Port: 5000, Position: 512},
+		{Type: DCCAccept, Filename: "file.txt", Port: 0, Position: 512, Token: "42"},
+		{Type: DCCSend, Filename: "file.txt", IP: net.ParseIP("::1"), Port: 5000, Size: 1024},
+	}
+	for i, sample := range samples {
+		offer, err := parseDCC("demsh", sample)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %s", sample, err)
+		}
+		valid := valids[i]
+		if offer.Type != valid.Type || offer.Filename != valid.Filename || !offer.IP.Equal(valid.IP) ||
+			offer.Port != valid.Port || offer.Size != valid.Size || offer.Position != valid.Position || offer.Token != valid.Token {
+			t.Fatalf("%#v != %#v", offer, valid)
+		}
+		if offer.String() != sample {
+			t.Fatalf("%q != %q", offer.String(), sample)
+		}
+	}
+
+	invalids := []string{
+		"",
+		"SEND file.txt",
+		"SEND ../etc/passwd 2130706433 5000 1024",
+		"SEND .. 2130706433 5000 1024",
+		"SEND ... 2130706433 5000 1024",
+		"SEND . 2130706433 5000 1024",
+		"SEND file.txt localhost 5000",
+		"SEND file.txt 2130706433 99999",
+		"SEND file.txt 2130706433 5000 -1",
+		"FOO bar 2130706433 5000",
+	}
+	for _, invalid := range invalids {
+		if _, err := parseDCC("demsh", invalid); !errors.Is(err, ErrDCCInvalid) {
+			t.Fatalf("%q should be invalid, err: %v", invalid, err)
+		}
+	}
+}
+
+func dccPair(t *testing.T) (sender net.Conn, receiver net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancel()
+	dialed := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := dccDial(ctx, net.IPv4(127, 0, 0, 1), port)
+		dialed <- conn
+	}()
+	sender, err = dccAccept(ctx, listener, net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receiver = <-dialed; receiver == nil {
+		t.Fatal("failed to dial")
+	}
+	return
+}
+
+func TestDCCTransfer(t *testing.T) {
+	data := []byte(strings.Repeat("ircfw DCC transfer ", 5000))
+	size := int64(len(data))
+	sender, receiver := dccPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancel()
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := sendFile(ctx, sender, bytes.NewReader(data), 0, size, nil)
+		sender.Close()
+		sent <- err
+	}()
+	var out bytes.Buffer
+	var reported int64
+	n, err := receiveFile(ctx, receiver, &out, 0, size, 0, func(done, total int64) {
+		reported = done
+	})
+	receiver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if n != size || reported != size || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("received %d bytes, reported %d, expected %d", n, reported, size)
+	}
+}
+
+func TestDCCTransferLimit(t *testing.T) {
+	data := []byte(strings.Repeat("x", 3*DCCBufSize))
+	sender, receiver := dccPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancel()
+	go func() {
+		sendFile(ctx, sender, bytes.NewReader(data), 0, 0, nil)
+		sender.Close()
+	}()
+	var out bytes.Buffer
+	_, err := receiveFile(ctx, receiver, &out, 0, 0, DCCBufSize, nil)
+	receiver.Close()
+	if !errors.Is(err, ErrDCCTooLarge) {
+		t.Fatalf("expected ErrDCCTooLarge, got %v", err)
+	}
+	if out.Len() > DCCBufSize {
+		t.Fatalf("wrote %d bytes over the limit", out.Len())
+	}
+}
+
+func TestDCCAcceptPeer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancel()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := dccAccept(ctx, listener, net.IPv4(127, 0, 0, 1))
+		accepted <- conn
+	}()
+
+	stranger := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+	conn, err := stranger.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		t.Skipf("can't dial from 127.0.0.2: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(timeout * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection from stranger should be closed, err: %v", err)
+	}
+
+	var dialer net.Dialer
+	peer, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	conn = <-accepted
+	if conn == nil {
+		t.Fatal("connection from peer was not accepted")
+	}
+	conn.Close()
+}
+
+func TestDCCTransferEmpty(t *testing.T) {
+	sender, receiver := dccPair(t)
+	defer receiver.Close()
+	defer sender.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := sendFile(ctx, sender, bytes.NewReader(nil), 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("empty transfer took %s", elapsed)
+	}
+}
+
+func TestDCCToken(t *testing.T) {
+	first, err := dccToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := dccToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == "" || first == second {
+		t.Fatalf("tokens %q and %q should be distinct", first, second)
+	}
+}
@@ -0,0 +1,261 @@
+package ircfw
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How received messages are handed to MsgHandler
+type DispatchMode int
+
+const (
+	// Messages of every channel are handled one at a time in order, default
+	PerChannel DispatchMode = iota
+	// Messages of every nick are handled one at a time in order across channels
+	PerUser
+	// Messages are handled concurrently by fixed number of workers, order is not kept
+	WorkerPool
+)
+
+// What happens to received message when its dispatch queue is full
+type BackpressurePolicy int
+
+const (
+	// Received message is dropped, default
+	DropNewest BackpressurePolicy = iota
+	// Oldest queued message is dropped to make room
+	DropOldest
+	// Reading from server stalls until there is room, handlers waiting
+	// for server replies may then wait for their own timeouts
+	Block
+)
+
+const (
+	defaultQueueSize = 64
+	defaultWorkers   = 8
+)
+
+type DispatchStats struct {
+	// handler returned in time
+	Handled uint64
+	// queue was full or channel was closed before handler got the message
+	Dropped uint64
+	// handler did not return within HandlerTimeout
+	TimedOut uint64
+}
+
+type job struct {
+	channel *Channel
+	msg     Msg
+}
+
+// Messages awaiting handler in order of arrival
+type lane struct {
+	jobs []job
+}
+
+type dispatcher struct {
+	// accessed atomically, kept first for alignment
+	stats DispatchStats
+	// counter of trace IDs, separate from labels so they don't
+	// depend on dispatch timing
+	lastTrace uint64
+	client    *Client
+	mode      DispatchMode
+	workers   int
+	policy    BackpressurePolicy
+	size      int
+	timeout   time.Duration
+	sync.Mutex
+	// fields below are protected by the mutex
+	// keyed by channel, nick or nil for the shared pool lane
+	lanes map[interface{}]*lane
+	// closed and replaced whenever jobs are added or taken
+	changed chan struct{}
+}
+
+func newDispatcher(client *Client, conf config) *dispatcher {
+	d := &dispatcher{
+		client:  client,
+		mode:    conf.dispatchMode,
+		workers: conf.workers,
+		policy:  conf.backpressure,
+		size:    conf.queueSize,
+		timeout: conf.handlerTimeout,
+		lanes:   make(map[interface{}]*lane),
+		changed: make(chan struct{}),
+	}
+	if d.size <= 0 {
+		d.size = defaultQueueSize
+	}
+	if d.workers <= 0 {
+		d.workers = defaultWorkers
+	}
+	if d.mode == WorkerPool {
+		pool := &lane{}
+		d.lanes[nil] = pool
+		for i := 0; i < d.workers; i++ {
+			go d.work(nil, pool)
+		}
+	}
+	return d
+}
+
+func (d *dispatcher) key(j job) interface{} {
+	switch d.mode {
+	case PerUser:
+		return lowcase(j.msg.Nick())
+	case WorkerPool:
+		return nil
+	default:
+		return j.channel
+	}
+}
+
+// Wakes up workers and blocked producers, must be called with the mutex held
+func (d *dispatcher) notify() {
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// Queues msg for the handler applying backpressure policy
+func (d *dispatcher) push(j job) {
+	key := d.key(j)
+	d.Lock()
+	for {
+		l, ok := d.lanes[key]
+		if !ok {
+			l = &lane{}
+			d.lanes[key] = l
+			go d.work(key, l)
+		}
+		if len(l.jobs) < d.size {
+			l.jobs = append(l.jobs, j)
+			d.notify()
+			d.Unlock()
+			return
+		}
+		switch d.policy {
+		case DropNewest:
+			d.Unlock()
+			d.drop(j, "queue is full")
+			return
+		case DropOldest:
+			oldest := l.jobs[0]
+			l.jobs = append(l.jobs[1:], j)
+			d.Unlock()
+			d.drop(oldest, "queue is full")
+			return
+		}
+		changed := d.changed
+		d.Unlock()
+		select {
+		case <-changed:
+		case <-j.channel.quit:
+			d.drop(j, "channel is closed")
+			return
+		case <-d.client.tomb.Dying():
+			d.drop(j, "client is closed")
+			return
+		}
+		d.Lock()
+	}
+}
+
+// Handles jobs of the lane, serial lanes are removed once empty
+// and pool workers stay until the client dies
+// meant to run in separate goroutine
+func (d *dispatcher) work(key interface{}, l *lane) {
+	for {
+		d.Lock()
+		for len(l.jobs) == 0 {
+			if d.mode != WorkerPool {
+				delete(d.lanes, key)
+				d.Unlock()
+				return
+			}
+			changed := d.changed
+			d.Unlock()
+			select {
+			case <-changed:
+			case <-d.client.tomb.Dying():
+				return
+			}
+			d.Lock()
+		}
+		j := l.jobs[0]
+		l.jobs = l.jobs[1:]
+		d.notify()
+		d.Unlock()
+		d.run(j)
+	}
+}
+
+func (d *dispatcher) run(j job) {
+	if j.channel.isClosed() {
+		d.drop(j, "channel is closed")
+		return
+	}
+	if !d.client.tomb.Alive() {
+		d.drop(j, "client is closed")
+		return
+	}
+	defer j.channel.endHandlerTyping(j.channel.typingStop())
+	ctx := context.WithValue(j.channel.context(), traceKey{}, d.traceID(j.msg))
+	if d.timeout == 0 {
+		d.client.handler(ctx, j.msg)
+		atomic.AddUint64(&d.stats.Handled, 1)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		d.client.handler(ctx, j.msg)
+		close(done)
+	}()
+	select {
+	case <-done:
+		atomic.AddUint64(&d.stats.Handled, 1)
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			atomic.AddUint64(&d.stats.TimedOut, 1)
+			d.client.Debug("Handler for %s in %q timed out after %s", TraceID(ctx), j.channel.Name(), d.timeout)
+		}
+		// lane or worker stays busy to keep order and the pool size
+		<-done
+	}
+}
+
+type traceKey struct{}
+
+// Identifies message being handled in logs, msgid is used when
+// server provides one
+func TraceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceKey{}).(string)
+	return id
+}
+
+func (d *dispatcher) traceID(msg Msg) string {
+	if id := msg.MsgID(); id != "" {
+		return id
+	}
+	return "trace" + strconv.FormatUint(atomic.AddUint64(&d.lastTrace, 1), 36)
+}
+
+func (d *dispatcher) drop(j job, reason string) {
+	atomic.AddUint64(&d.stats.Dropped, 1)
+	d.client.Debug("Dropping message in %q from %q: %s", j.channel.Name(), j.msg.Nick(), reason)
+}
+
+// Counters of messages passed to MsgHandler since the client was created
+func (c *Client) DispatchStats() DispatchStats {
+	return DispatchStats{
+		Handled:  atomic.LoadUint64(&c.dispatcher.stats.Handled),
+		Dropped:  atomic.LoadUint64(&c.dispatcher.stats.Dropped),
+		TimedOut: atomic.LoadUint64(&c.dispatcher.stats.TimedOut),
+	}
+}
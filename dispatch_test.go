@@ -0,0 +1,256 @@
+package ircfw
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Handler blocking on messages with "block" text until released
+type gatedHandler struct {
+	started, release chan struct{}
+	handled          chan string
+}
+
+func newGatedHandler() *gatedHandler {
+	return &gatedHandler{
+		started: make(chan struct{}, 16),
+		release: make(chan struct{}),
+		handled: make(chan string, 16),
+	}
+}
+
+func (h *gatedHandler) handle(msg Msg) {
+	text := strings.Join(msg.Text(), " ")
+	if strings.HasPrefix(text, "block") {
+		h.started <- struct{}{}
+		<-h.release
+	}
+	h.handled <- text
+}
+
+func (h *gatedHandler) expect(t *testing.T, texts ...string) {
+	t.Helper()
+	for _, want := range texts {
+		select {
+		case got := <-h.handled:
+			if got != want {
+				t.Fatalf("handled %q, expected %q", got, want)
+			}
+		case <-time.After(timeout * time.Second):
+			t.Fatalf("%q was not handled", want)
+		}
+	}
+}
+
+func (h *gatedHandler) expectNone(t *testing.T) {
+	t.Helper()
+	select {
+	case got := <-h.handled:
+		t.Fatalf("unexpectedly handled %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func dispatchJob(channel *Channel, nick string, text string) job {
+	return job{channel: channel, msg: ircMsg{
+		prefix:  nick + "!~" + nick + "@host",
+		text:    []string{text},
+		channel: channel,
+		client:  channel.client,
+	}}
+}
+
+func TestDispatchPerChannel(t *testing.T) {
+	h := newGatedHandler()
+	client := newTestClient(t, nil, Handler(h.handle))
+	slow, fast := newChannel("#slow", client), newChannel("#fast", client)
+	d := client.dispatcher
+	d.push(dispatchJob(slow, "demsh", "block"))
+	<-h.started
+	d.push(dispatchJob(slow, "demsh", "slow 1"))
+	d.push(dispatchJob(fast, "demsh", "fast 1"))
+	d.push(dispatchJob(fast, "demsh", "fast 2"))
+	h.expect(t, "fast 1", "fast 2")
+	close(h.release)
+	h.expect(t, "block", "slow 1")
+}
+
+func TestDispatchPerUser(t *testing.T) {
+	h := newGatedHandler()
+	client := newTestClient(t, nil, Handler(h.handle), Dispatch(PerUser, 0))
+	first, second := newChannel("#first", client), newChannel("#second", client)
+	d := client.dispatcher
+	d.push(dispatchJob(first, "demsh", "block"))
+	<-h.started
+	d.push(dispatchJob(second, "DEMSH", "demsh 1"))
+	d.push(dispatchJob(first, "other", "other 1"))
+	h.expect(t, "other 1")
+	h.expectNone(t)
+	close(h.release)
+	h.expect(t, "block", "demsh 1")
+}
+
+func TestDispatchWorkerPool(t *testing.T) {
+	const workers = 3
+	h := newGatedHandler()
+	client := newTestClient(t, nil, Handler(h.handle), Dispatch(WorkerPool, workers))
+	channel := newChannel("#ircfw-test", client)
+	for i := 0; i < workers; i++ {
+		client.dispatcher.push(dispatchJob(channel, "demsh", "block"))
+	}
+	// serial dispatch would never start the second handler
+	for i := 0; i < workers; i++ {
+		select {
+		case <-h.started:
+		case <-time.After(timeout * time.Second):
+			t.Fatalf("%d of %d handlers run concurrently", i, workers)
+		}
+	}
+	close(h.release)
+	h.expect(t, "block", "block", "block")
+}
+
+func TestBackpressure(t *testing.T) {
+	for _, test := range []struct {
+		policy  BackpressurePolicy
+		handled []string
+	}{
+		{DropNewest, []string{"block", "1", "2"}},
+		{DropOldest, []string{"block", "3", "4"}},
+	} {
+		h := newGatedHandler()
+		client := newTestClient(t, nil, Handler(h.handle), Backpressure(test.policy, 2))
+		channel := newChannel("#ircfw-test", client)
+		d := client.dispatcher
+		d.push(dispatchJob(channel, "demsh", "block"))
+		<-h.started
+		for _, text := range []string{"1", "2", "3", "4"} {
+			d.push(dispatchJob(channel, "demsh", text))
+		}
+		close(h.release)
+		h.expect(t, test.handled...)
+		h.expectNone(t)
+		if stats := client.DispatchStats(); stats.Dropped != 2 || stats.Handled != 3 {
+			t.Errorf("policy %d: unexpected stats %+v", test.policy, stats)
+		}
+	}
+}
+
+func TestBackpressureBlock(t *testing.T) {
+	h := newGatedHandler()
+	client := newTestClient(t, nil, Handler(h.handle), Backpressure(Block, 1))
+	channel := newChannel("#ircfw-test", client)
+	d := client.dispatcher
+	d.push(dispatchJob(channel, "demsh", "block"))
+	<-h.started
+	d.push(dispatchJob(channel, "demsh", "1"))
+	pushed := make(chan struct{})
+	go func() {
+		d.push(dispatchJob(channel, "demsh", "2"))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push to full queue did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(h.release)
+	<-pushed
+	h.expect(t, "block", "1", "2")
+	if stats := client.DispatchStats(); stats.Dropped != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	h := newGatedHandler()
+	client := newTestClient(t, nil, Handler(h.handle), HandlerTimeout(50*time.Millisecond))
+	channel := newChannel("#ircfw-test", client)
+	d := client.dispatcher
+	d.push(dispatchJob(channel, "demsh", "block"))
+	d.push(dispatchJob(channel, "demsh", "1"))
+	<-h.started
+	// the next message waits for the handler ignoring its context
+	time.Sleep(100 * time.Millisecond)
+	h.expectNone(t)
+	if stats := client.DispatchStats(); stats.TimedOut != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	close(h.release)
+	h.expect(t, "block", "1")
+	h.expectNone(t)
+	if stats := client.DispatchStats(); stats.TimedOut != 1 || stats.Handled != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestHandlerTimeoutPool(t *testing.T) {
+	const workers = 2
+	h := newGatedHandler()
+	client := newTestClient(t, nil, Handler(h.handle), Dispatch(WorkerPool, workers), HandlerTimeout(20*time.Millisecond))
+	channel := newChannel("#ircfw-test", client)
+	for i := 0; i < 4; i++ {
+		client.dispatcher.push(dispatchJob(channel, "demsh", "block"))
+	}
+	for i := 0; i < workers; i++ {
+		<-h.started
+	}
+	select {
+	case <-h.started:
+		t.Fatal("timed out handlers do not count against the pool")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(h.release)
+	h.expect(t, "block", "block", "block", "block")
+}
+
+func TestHandlerContext(t *testing.T) {
+	type result struct {
+		trace    string
+		deadline bool
+		err      error
+	}
+	started, results := make(chan struct{}, 1), make(chan result, 1)
+	client := newTestClient(t, nil, HandlerTimeout(time.Minute), HandleContext(func(ctx context.Context, msg Msg) {
+		_, deadline := ctx.Deadline()
+		started <- struct{}{}
+		<-ctx.Done()
+		results <- result{TraceID(ctx), deadline, ctx.Err()}
+	}))
+	channel := newChannel("#ircfw-test", client)
+	msg := dispatchJob(channel, "demsh", "hello")
+	m := msg.msg.(ircMsg)
+	m.msgid = "m1"
+	msg.msg = m
+	client.dispatcher.push(msg)
+	<-started
+	channel.kill()
+	select {
+	case got := <-results:
+		if got.trace != "m1" || !got.deadline || !errors.Is(got.err, context.Canceled) {
+			t.Errorf("unexpected handler context after kill: %+v", got)
+		}
+	case <-time.After(timeout * time.Second):
+		t.Fatal("context was not cancelled on channel kill")
+	}
+
+	other := newChannel("#other", client)
+	client.dispatcher.push(dispatchJob(other, "demsh", "hello"))
+	<-started
+	client.tomb.Kill(nil)
+	select {
+	case got := <-results:
+		if got.trace != "trace1" || !errors.Is(got.err, context.Canceled) {
+			t.Errorf("unexpected handler context after client death: %+v", got)
+		}
+	case <-time.After(timeout * time.Second):
+		t.Fatal("context was not cancelled on client death")
+	}
+	if atomic.LoadUint64(&client.lastID) != 0 {
+		t.Error("trace IDs advanced label counter")
+	}
+}
@@ -0,0 +1,174 @@
+package ircfw
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const EchoMessageCap = "echo-message"
+
+// Labels of outbound messages whose echoes are awaited
+type delivery struct {
+	requests chan []*request
+}
+
+// Returns true if msg is echo of a message sent by this client
+// https://ircv3.net/specs/extensions/echo-message
+func isEcho(msg message) bool {
+	client := msg.Client()
+	return client.HasCap(EchoMessageCap) && lowcase(msg.Nick()) == lowcase(client.Nick())
+}
+
+// Nick of the other side of private message
+func queryNick(msg message) string {
+	if isEcho(msg) && len(msg.Params()) > 0 {
+		return msg.Params()[0]
+	}
+	return msg.Nick()
+}
+
+// Echoes are dropped before MsgHandler unless KeepEchoes was set
+func (c *Client) dropEcho(msg message) bool {
+	if c.keepEchoes || !isEcho(msg) {
+		return false
+	}
+	c.Debug("Skipping echo of own %s to %q", msg.Cmd(), msg.Params()[0])
+	return true
+}
+
+// Copies msg adding tag
+func withTag(msg message, key, value string) message {
+	m, ok := msg.(utf8message)
+	if !ok {
+		return msg
+	}
+	tags := make(map[string]string, len(m.tags)+1)
+	for k, v := range m.tags {
+		tags[k] = v
+	}
+	tags[key] = value
+	m.tags = tags
+	return m
+}
+
+// Labels messages whose echo is going to be the delivery confirmation:
+// standalone PRIVMSG and NOTICE and openers of multiline batches
+func (c *Client) labelMessages(messages []message, d *delivery) []message {
+	var reqs []*request
+	for i, msg := range messages {
+		if _, inBatch := msg.Tag("batch"); inBatch {
+			continue
+		}
+		params := msg.Params()
+		if msg.Cmd() == "BATCH" && (len(params) == 0 || !strings.HasPrefix(params[0], "+")) {
+			continue
+		}
+		req := &request{label: c.nextID(), cmd: msg.Cmd(), done: make(chan []Line, 1)}
+		c.requests.add(req)
+		reqs = append(reqs, req)
+		messages[i] = withTag(msg, "label", req.label)
+	}
+	d.requests <- reqs
+	return messages
+}
+
+// Waits for labeled responses to reqs and returns their lines,
+// FAIL or error numeric among them is returned as error
+func (c *Client) awaitReplies(ctx context.Context, reqs []*request) ([]Line, error) {
+	defer func() {
+		for _, req := range reqs {
+			c.requests.remove(req)
+		}
+	}()
+	var lines []Line
+	for _, req := range reqs {
+		select {
+		case <-ctx.Done():
+			return lines, ctx.Err()
+		case <-c.tomb.Dying():
+			return lines, ErrClientClosed
+		case replies := <-req.done:
+			if err := replyError(replies); err != nil {
+				return lines, err
+			}
+			lines = append(lines, replies...)
+		}
+	}
+	return lines, nil
+}
+
+// Labels messages, writes them and waits for responses
+func (c *Client) sendLabeled(ctx context.Context, messages []message) error {
+	d := &delivery{requests: make(chan []*request, 1)}
+	messages = c.labelMessages(messages, d)
+	reqs := <-d.requests
+	if err := c.enqueue(ctx, messages); err != nil {
+		for _, req := range reqs {
+			c.requests.remove(req)
+		}
+		return err
+	}
+	_, err := c.awaitReplies(ctx, reqs)
+	return err
+}
+
+// Sends msg to the channel labeled and waits for the response
+func (c *Channel) confirm(ctx context.Context, msg ircMsg) ([]Line, error) {
+	msg.delivery = &delivery{requests: make(chan []*request, 1)}
+	if err := c.queue(ctx, msg); err != nil {
+		return nil, err
+	}
+	var reqs []*request
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.quit:
+		return nil, fmt.Errorf("%s: %w", c.Name(), ErrNotJoined)
+	case reqs = <-msg.delivery.requests:
+	}
+	return c.client.awaitReplies(ctx, reqs)
+}
+
+// Sends msg to the channel, waits for the response when labeled-response
+// is negotiated so that FAIL is returned as error
+func (c *Channel) post(ctx context.Context, msg ircMsg) error {
+	if c.dcc != nil || !c.client.HasCap(LabeledResponseCap) {
+		return c.queue(ctx, msg)
+	}
+	_, err := c.confirm(ctx, msg)
+	return err
+}
+
+// Sends msg to the channel and waits for the server to echo it back
+func (c *Channel) deliver(ctx context.Context, msg ircMsg) ([]Msg, error) {
+	client := c.client
+	if c.dcc != nil || !client.HasCap(EchoMessageCap) || !client.HasCap(LabeledResponseCap) {
+		return nil, fmt.Errorf("%s: %w", EchoMessageCap, ErrUncorrelated)
+	}
+	lines, err := c.confirm(ctx, msg)
+	var echoes []Msg
+	for _, line := range lines {
+		if echo, ok := c.lineMsg(line); ok {
+			echoes = append(echoes, echo)
+		}
+	}
+	return echoes, err
+}
+
+// Sends text and returns its echoes carrying msgid and text as the server saw them
+func (c *Channel) SayConfirmed(ctx context.Context, text []string) ([]Msg, error) {
+	if err := validateText(text); err != nil {
+		return nil, invalid("text", err)
+	}
+	deadline, _ := ctx.Deadline()
+	return c.deliver(ctx, ircMsg{
+		time:     time.Now(),
+		deadline: deadline,
+		prefix:   c.client.Prefix(),
+		text:     text,
+		channel:  c,
+		client:   c.client,
+	})
+}
@@ -0,0 +1,100 @@
+package ircfw
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDropEcho(t *testing.T) {
+	client := newTestClient(t, map[string]string{EchoMessageCap: ""})
+	channel := newChannel("#ircfw-test", client)
+	client.channels["#ircfw-test"] = channel
+	for _, keep := range []bool{false, true} {
+		client.keepEchoes = keep
+		msg, err := parseUTF8Message([]byte(":ircfw!~ircfw@5838b91c PRIVMSG #ircfw-test :hello"), time.Now(), client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handlePrivmsg(msg)
+		if delivered := len(channel.receive) == 1; delivered != keep {
+			t.Errorf("keepEchoes %v: echo delivered %v", keep, delivered)
+		}
+	}
+	<-channel.receive
+
+	msg, _ := parseUTF8Message([]byte(":ircfw!~ircfw@5838b91c PRIVMSG demsh :hello"), time.Now(), client)
+	handlePrivmsg(msg)
+	if client.fetchQuery("demsh") == nil || client.fetchQuery("ircfw") != nil {
+		t.Errorf("private echo routed to wrong query: %v", client.queries)
+	}
+	client.fetchQuery("demsh").kill()
+}
+
+func TestSayConfirmed(t *testing.T) {
+	client := newTestClient(t, map[string]string{
+		EchoMessageCap:     "",
+		LabeledResponseCap: "",
+		"batch":            "",
+		MultilineCap:       "max-bytes=4096",
+	})
+	channel := newChannel("#ircfw-test", client)
+	client.channels["#ircfw-test"] = channel
+	channel.start()
+	defer channel.kill()
+
+	go func() {
+		sent := <-client.writes
+		label, _ := sent.Tag("label")
+		echo, _ := parseUTF8Message([]byte("@label="+label+";msgid=m1 :ircfw!~ircfw@5838b91c PRIVMSG #ircfw-test :hello"), time.Now(), client)
+		client.resolveLabel(echo)
+	}()
+	echoes, err := channel.SayConfirmed(context.Background(), []string{"hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(echoes) != 1 || echoes[0].MsgID() != "m1" || echoes[0].Text()[0] != "hello" {
+		t.Errorf("unexpected echoes %v", echoes)
+	}
+
+	type result struct {
+		echoes []Msg
+		err    error
+	}
+	done := make(chan result)
+	go func() {
+		echoes, err := channel.SayConfirmed(context.Background(), []string{"first", "second"})
+		done <- result{echoes, err}
+	}()
+	var label string
+	for i := 0; i < 4; i++ {
+		sent := <-client.writes
+		if sent.Cmd() == "BATCH" && sent.Params()[0][0] == '+' {
+			label, _ = sent.Tag("label")
+		} else if _, ok := sent.Tag("label"); ok {
+			t.Errorf("%q is labeled", sent.Export())
+		}
+	}
+	feed(t, client, []string{
+		"@label=" + label + ";msgid=m2 :ircfw!~ircfw@5838b91c BATCH +ml draft/multiline #ircfw-test",
+		"@batch=ml :ircfw!~ircfw@5838b91c PRIVMSG #ircfw-test :first",
+		"@batch=ml :ircfw!~ircfw@5838b91c PRIVMSG #ircfw-test :second",
+		":irc.demsh.org BATCH -ml",
+	})
+	res := <-done
+	echoes, err = res.echoes, res.err
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(echoes) != 1 || echoes[0].MsgID() != "m2" || len(echoes[0].Text()) != 2 {
+		t.Errorf("unexpected echoes %v", echoes)
+	}
+}
+
+func TestSayConfirmedUncorrelated(t *testing.T) {
+	client := newTestClient(t, map[string]string{EchoMessageCap: ""})
+	channel := newChannel("#ircfw-test", client)
+	if _, err := channel.SayConfirmed(context.Background(), []string{"hello"}); err == nil {
+		t.Error("confirmation without labeled-response")
+	}
+}
@@ -0,0 +1,63 @@
+package format
+
+// mIRC colour code
+type Color string
+
+const (
+	White      Color = "00"
+	Black      Color = "01"
+	Blue       Color = "02"
+	Green      Color = "03"
+	Red        Color = "04"
+	Brown      Color = "05"
+	Magenta    Color = "06"
+	Orange     Color = "07"
+	Yellow     Color = "08"
+	LightGreen Color = "09"
+	Cyan       Color = "10"
+	LightCyan  Color = "11"
+	LightBlue  Color = "12"
+	Pink       Color = "13"
+	Grey       Color = "14"
+	LightGrey  Color = "15"
+	Default    Color = "99"
+	NoColor    Color = ""
+)
+
+const (
+	ColorTag = "\x03"
+)
+
+var (
+	colors = map[string]Color{
+		"00": White,
+		"01": Black,
+		"02": Blue,
+		"03": Green,
+		"04": Red,
+		"05": Brown,
+		"06": Magenta,
+		"07": Orange,
+		"08": Yellow,
+		"09": LightGreen,
+		"10": Cyan,
+		"11": LightCyan,
+		"12": LightBlue,
+		"13": Pink,
+		"14": Grey,
+		"15": LightGrey,
+		"99": Default,
+	}
+)
+
+func (c Color) String() string {
+	return string(c)
+}
+
+func lookupColor(str string) Color {
+	color, ok := colors[str]
+	if !ok {
+		return NoColor
+	}
+	return color
+}
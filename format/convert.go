@@ -0,0 +1,420 @@
+package format
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	ansiEscape = "\x1b"
+	ansiReset  = ansiEscape + "[0m"
+)
+
+var (
+	// ANSI colours 0-7 and their bright variants 8-15
+	ansiColors = []Color{
+		Black, Brown, Green, Orange, Blue, Magenta, Cyan, LightGrey,
+		Grey, Red, LightGreen, Yellow, LightBlue, Pink, LightCyan, White,
+	}
+	ircToANSI = map[Color]int{
+		White:      15,
+		Black:      0,
+		Blue:       4,
+		Green:      2,
+		Red:        9,
+		Brown:      1,
+		Magenta:    5,
+		Orange:     3,
+		Yellow:     11,
+		LightGreen: 10,
+		Cyan:       6,
+		LightCyan:  14,
+		LightBlue:  12,
+		Pink:       13,
+		Grey:       8,
+		LightGrey:  7,
+	}
+	markdownDelims = []struct {
+		delim, tag string
+	}{
+		{"**", BoldTag},
+		{"__", BoldTag},
+		{"~~", StrikethroughTag},
+		{"*", ItalicTag},
+		{"_", ItalicTag},
+	}
+)
+
+// SGR parameters selecting the colour, empty for unknown colours
+func (c Color) ansi(background bool) string {
+	base := 30
+	if background {
+		base = 40
+	}
+	if c == Default {
+		return strconv.Itoa(base + 9)
+	}
+	n, ok := ircToANSI[c]
+	if !ok {
+		return ""
+	}
+	if n >= 8 {
+		return strconv.Itoa(base + 60 + n - 8)
+	}
+	return strconv.Itoa(base + n)
+}
+
+// Codes switching from one style to another
+func styleTransition(from Style, to Style) string {
+	if from == to {
+		return ""
+	}
+	if to.IsZero() {
+		return ResetTag
+	}
+	var b strings.Builder
+	if from.Fg != to.Fg || from.Bg != to.Bg {
+		if to.Fg == NoColor || (to.Bg == NoColor && from.Bg != NoColor) {
+			b.WriteString(ColorTag)
+		}
+		if to.Fg != NoColor {
+			b.WriteString(colorCode(to.Fg, to.Bg))
+		}
+	}
+	if from.HexFg != to.HexFg || from.HexBg != to.HexBg {
+		if to.HexFg == "" || (to.HexBg == "" && from.HexBg != "") {
+			b.WriteString(HexColorTag)
+		}
+		if to.HexFg != "" {
+			b.WriteString(hexColorCode(to.HexFg, to.HexBg))
+		}
+	}
+	for _, flag := range []struct {
+		from, to bool
+		tag      string
+	}{
+		{from.Bold, to.Bold, BoldTag},
+		{from.Italic, to.Italic, ItalicTag},
+		{from.Underline, to.Underline, UnderlineTag},
+		{from.Strikethrough, to.Strikethrough, StrikethroughTag},
+		{from.Monospace, to.Monospace, MonospaceTag},
+		{from.Reverse, to.Reverse, ReverseTag},
+	} {
+		if flag.from != flag.to {
+			b.WriteString(flag.tag)
+		}
+	}
+	return b.String()
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isDigit(c) || c >= 0x80
+}
+
+// Converts Markdown subset into IRC formatting: **bold**, __bold__, *italic*,
+// _italic_, ~~strikethrough~~, `code` and [text](url) links
+func MarkdownToIRC(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		switch {
+		case text[i] == '\\' && i+1 < len(text) && strings.IndexByte("\\`*_~[]()", text[i+1]) != -1:
+			b.WriteByte(text[i+1])
+			i += 2
+			continue
+		case text[i] == '`':
+			if j := strings.IndexByte(text[i+1:], '`'); j > 0 {
+				b.WriteString(Monospace(text[i+1 : i+1+j]))
+				i += j + 2
+				continue
+			}
+		case text[i] == '[':
+			if label, url, n := parseMarkdownLink(text[i:]); n > 0 {
+				label = MarkdownToIRC(label)
+				if Strip(label) == url {
+					b.WriteString(url)
+				} else {
+					b.WriteString(label + " (" + url + ")")
+				}
+				i += n
+				continue
+			}
+		}
+		if n := markdownEmphasis(&b, text, i); n > 0 {
+			i += n
+			continue
+		}
+		b.WriteByte(text[i])
+		i++
+	}
+	return b.String()
+}
+
+// Writes emphasis starting at text[i] and returns consumed length, 0 if there is none
+func markdownEmphasis(b *strings.Builder, text string, i int) int {
+	for _, md := range markdownDelims {
+		if !strings.HasPrefix(text[i:], md.delim) {
+			continue
+		}
+		// underscores inside words like snake_case are literal
+		if md.delim[0] == '_' && i > 0 && isWordByte(text[i-1]) {
+			return 0
+		}
+		start := i + len(md.delim)
+		if start >= len(text) || text[start] == ' ' {
+			return 0
+		}
+		j := strings.Index(text[start:], md.delim)
+		if j <= 0 || text[start+j-1] == ' ' {
+			continue
+		}
+		end := start + j + len(md.delim)
+		if md.delim[0] == '_' && end < len(text) && isWordByte(text[end]) {
+			continue
+		}
+		b.WriteString(md.tag + MarkdownToIRC(text[start:start+j]) + md.tag)
+		return end - i
+	}
+	return 0
+}
+
+func parseMarkdownLink(text string) (label string, url string, n int) {
+	closing := strings.Index(text, "](")
+	if closing == -1 {
+		return "", "", 0
+	}
+	end := strings.IndexByte(text[closing+2:], ')')
+	if end == -1 {
+		return "", "", 0
+	}
+	label = text[1:closing]
+	url = text[closing+2 : closing+2+end]
+	if url == "" || strings.ContainsAny(url, " ") {
+		return "", "", 0
+	}
+	return label, url, closing + 3 + end
+}
+
+// Colour from 256-colour palette index, false if index is out of range
+func ansi256(n int) (Color, string, bool) {
+	if n < 0 || n > 255 {
+		return NoColor, "", false
+	}
+	if n < 16 {
+		return ansiColors[n], "", true
+	}
+	var r, g, b int
+	if n >= 232 {
+		r = 8 + (n-232)*10
+		g, b = r, r
+	} else {
+		n -= 16
+		levels := []int{0, 95, 135, 175, 215, 255}
+		r, g, b = levels[n/36], levels[n/6%6], levels[n%6]
+	}
+	return NoColor, fmt.Sprintf("%02X%02X%02X", r, g, b), true
+}
+
+// RRGGBB colour from 24-bit components, false if any is out of range
+func ansiRGB(r, g, b int) (string, bool) {
+	for _, c := range []int{r, g, b} {
+		if c < 0 || c > 255 {
+			return "", false
+		}
+	}
+	return fmt.Sprintf("%02X%02X%02X", r, g, b), true
+}
+
+// Applies SGR parameters to style
+func (s *Style) applySGR(params []int) {
+	if len(params) == 0 {
+		params = []int{0}
+	}
+	for i := 0; i < len(params); i++ {
+		p := params[i]
+		switch {
+		case p == 0:
+			*s = Style{}
+		case p == 1:
+			s.Bold = true
+		case p == 3:
+			s.Italic = true
+		case p == 4:
+			s.Underline = true
+		case p == 7:
+			s.Reverse = true
+		case p == 9:
+			s.Strikethrough = true
+		case p == 22:
+			s.Bold = false
+		case p == 23:
+			s.Italic = false
+		case p == 24:
+			s.Underline = false
+		case p == 27:
+			s.Reverse = false
+		case p == 29:
+			s.Strikethrough = false
+		case p >= 30 && p <= 37:
+			s.Fg, s.HexFg = ansiColors[p-30], ""
+		case p >= 90 && p <= 97:
+			s.Fg, s.HexFg = ansiColors[p-90+8], ""
+		case p >= 40 && p <= 47:
+			s.Bg, s.HexBg = ansiColors[p-40], ""
+		case p >= 100 && p <= 107:
+			s.Bg, s.HexBg = ansiColors[p-100+8], ""
+		case p == 39:
+			s.Fg, s.HexFg = NoColor, ""
+		case p == 49:
+			s.Bg, s.HexBg = NoColor, ""
+		case p == 38 || p == 48:
+			var color Color
+			var hex string
+			var ok bool
+			if i+2 < len(params) && params[i+1] == 5 {
+				color, hex, ok = ansi256(params[i+2])
+				i += 2
+			} else if i+4 < len(params) && params[i+1] == 2 {
+				hex, ok = ansiRGB(params[i+2], params[i+3], params[i+4])
+				i += 4
+			} else {
+				return
+			}
+			if !ok {
+				// out of range colours are ignored
+				continue
+			}
+			if p == 38 {
+				s.Fg, s.HexFg = color, hex
+			} else {
+				s.Bg, s.HexBg = color, hex
+			}
+		}
+	}
+	// IRC background colour requires foreground
+	if s.Fg == NoColor && s.Bg != NoColor {
+		s.Fg = Default
+	}
+	if s.HexFg == "" && s.HexBg != "" {
+		s.HexFg = "FFFFFF"
+	}
+}
+
+// Parses CSI sequence at the start of text, returns final byte, parameters and length
+func parseCSI(text string) (final byte, params []int, n int) {
+	if !strings.HasPrefix(text, ansiEscape+"[") {
+		return 0, nil, 0
+	}
+	for i := 2; i < len(text); i++ {
+		c := text[i]
+		if c >= 0x40 && c <= 0x7e {
+			for _, field := range strings.Split(text[2:i], ";") {
+				v, _ := strconv.Atoi(field)
+				params = append(params, v)
+			}
+			if text[2:i] == "" {
+				params = nil
+			}
+			return c, params, i + 1
+		}
+	}
+	return 0, nil, len(text)
+}
+
+// Converts ANSI SGR escape sequences into IRC formatting, other escape sequences are dropped
+func ANSIToIRC(text string) string {
+	var b strings.Builder
+	var style Style
+	// codes of transitions not followed by text yet
+	var pending string
+	for len(text) > 0 {
+		i := strings.Index(text, ansiEscape)
+		if i == -1 {
+			break
+		}
+		if i > 0 {
+			b.WriteString(guardCode(pending, text[:i]))
+			pending = ""
+		}
+		text = text[i:]
+		final, params, n := parseCSI(text)
+		if n == 0 {
+			// lone escape or non-CSI sequence, drop escape with the next byte
+			n = 1
+			if len(text) > 1 {
+				n = 2
+			}
+		}
+		if final == 'm' {
+			next := style
+			next.applySGR(params)
+			pending += styleTransition(style, next)
+			style = next
+		}
+		text = text[n:]
+	}
+	b.WriteString(guardCode(pending, text))
+	return b.String()
+}
+
+func hexToRGB(hex string) string {
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d;%d;%d", v>>16&0xff, v>>8&0xff, v&0xff)
+}
+
+// SGR sequence switching terminal from default state to style
+func (s Style) ansi() string {
+	var params []string
+	for _, flag := range []struct {
+		on    bool
+		param string
+	}{
+		{s.Bold, "1"},
+		{s.Italic, "3"},
+		{s.Underline, "4"},
+		{s.Reverse, "7"},
+		{s.Strikethrough, "9"},
+	} {
+		if flag.on {
+			params = append(params, flag.param)
+		}
+	}
+	if rgb := hexToRGB(s.HexFg); s.HexFg != "" && rgb != "" {
+		params = append(params, "38;2;"+rgb)
+	} else if fg := s.Fg.ansi(false); fg != "" {
+		params = append(params, fg)
+	}
+	if rgb := hexToRGB(s.HexBg); s.HexBg != "" && rgb != "" {
+		params = append(params, "48;2;"+rgb)
+	} else if bg := s.Bg.ansi(true); bg != "" {
+		params = append(params, bg)
+	}
+	if len(params) == 0 {
+		return ""
+	}
+	return ansiEscape + "[" + strings.Join(params, ";") + "m"
+}
+
+// Renders IRC formatting as ANSI escape sequences for terminals,
+// monospace has no ANSI counterpart and is dropped
+func IRCToANSI(text string) string {
+	var b strings.Builder
+	var current Style
+	for _, span := range ParseFormatting(text) {
+		if span.Style != current {
+			if !current.IsZero() {
+				b.WriteString(ansiReset)
+			}
+			b.WriteString(span.Style.ansi())
+			current = span.Style
+		}
+		b.WriteString(span.Text)
+	}
+	if !current.IsZero() {
+		b.WriteString(ansiReset)
+	}
+	return b.String()
+}
@@ -0,0 +1,102 @@
+package format
+
+import (
+	"testing"
+)
+
+func TestMarkdownToIRC(t *testing.T) {
+	samples := []string{
+		"plain text",
+		"**bold** and *italic*",
+		"__bold__ and _italic_ but not snake_case_name",
+		"~~gone~~ `x := *p*`",
+		"see [docs](https://demsh.org/) or [https://demsh.org/](https://demsh.org/)",
+		"unbalanced **bold and 2 * 3",
+		"escaped \\*stars\\*",
+		"**nested _italic_**",
+	}
+	valids := []string{
+		"plain text",
+		"\x02bold\x02 and \x1ditalic\x1d",
+		"\x02bold\x02 and \x1ditalic\x1d but not snake_case_name",
+		"\x1egone\x1e \x11x := *p*\x11",
+		"see docs (https://demsh.org/) or https://demsh.org/",
+		"unbalanced **bold and 2 * 3",
+		"escaped *stars*",
+		"\x02nested \x1ditalic\x1d\x02",
+	}
+	for i, sample := range samples {
+		if result := MarkdownToIRC(sample); result != valids[i] {
+			t.Fatalf("%q: %q != %q", sample, result, valids[i])
+		}
+	}
+}
+
+func TestANSIToIRC(t *testing.T) {
+	samples := []string{
+		"no escapes",
+		"\x1b[1mbold\x1b[0m plain",
+		"\x1b[31;1merror\x1b[22m: \x1b[39mdone",
+		"\x1b[92;44mok\x1b[m",
+		"\x1b[38;2;255;136;0morange\x1b[0m",
+		"\x1b[2Kcleared",
+		"\x1b[38;5;-1mx",
+		"\x1b[38;5;300mx",
+		"\x1b[48;5;256;1mx",
+		"\x1b[38;2;300;0;0mx",
+		"\x1b[38;2;0;-5;0;3mx",
+		"\x1b[38;5;196mx",
+		"\x1b[31m,12",
+		"\x1b[1;31mred\x1b[39m12",
+		"\x1b[31;44mx\x1b[49m,5",
+		"\x1b[1;38;2;255;136;0mx\x1b[39mFF",
+	}
+	valids := []string{
+		"no escapes",
+		"\x02bold\x0f plain",
+		"\x0305\x02error\x02: \x0fdone",
+		"\x0309,02ok\x0f",
+		"\x04FF8800orange\x0f",
+		"cleared",
+		"x",
+		"x",
+		"\x02x",
+		"x",
+		"\x1dx",
+		"\x04FF0000x",
+		"\x0305\x02\x02,12",
+		"\x0305\x02red\x03\x02\x0212",
+		"\x0305,02x\x03\x0305\x02\x02,5",
+		"\x04FF8800\x02x\x04\x02\x02FF",
+	}
+	for i, sample := range samples {
+		if result := ANSIToIRC(sample); result != valids[i] {
+			t.Fatalf("%q: %q != %q", sample, result, valids[i])
+		}
+	}
+}
+
+func TestIRCToANSI(t *testing.T) {
+	samples := []string{
+		"no codes",
+		Bold("bold") + " plain",
+		Colored("red", Red, Blue),
+		HexColored("hex", "ff8800", ""),
+	}
+	valids := []string{
+		"no codes",
+		"\x1b[1mbold\x1b[0m plain",
+		"\x1b[91;44mred\x1b[0m",
+		"\x1b[38;2;255;136;0mhex\x1b[0m",
+	}
+	for i, sample := range samples {
+		if result := IRCToANSI(sample); result != valids[i] {
+			t.Fatalf("%q: %q != %q", sample, result, valids[i])
+		}
+	}
+	// round trip keeps text and style
+	text := "\x1b[1;33mwarn\x1b[0m text"
+	if result := ANSIToIRC(IRCToANSI(ANSIToIRC(text))); result != ANSIToIRC(text) {
+		t.Fatalf("%q != %q", result, ANSIToIRC(text))
+	}
+}
@@ -0,0 +1,276 @@
+package format
+
+import (
+	"strings"
+)
+
+const (
+	BoldTag          = "\x02"
+	HexColorTag      = "\x04"
+	ResetTag         = "\x0f"
+	MonospaceTag     = "\x11"
+	ReverseTag       = "\x16"
+	ItalicTag        = "\x1d"
+	StrikethroughTag = "\x1e"
+	UnderlineTag     = "\x1f"
+)
+
+const formatTags = BoldTag + ColorTag + HexColorTag + ResetTag + MonospaceTag + ReverseTag + ItalicTag + StrikethroughTag + UnderlineTag
+
+// Formatting state produced by mIRC control codes
+type Style struct {
+	Bold, Italic, Underline, Strikethrough, Monospace, Reverse bool
+	Fg, Bg                                                     Color
+	// RRGGBB colours set by HexColorTag
+	HexFg, HexBg string
+}
+
+// Run of text sharing the same style
+type Span struct {
+	Style Style
+	Text  string
+}
+
+func Bold(text string) string {
+	return BoldTag + text + BoldTag
+}
+
+func Italic(text string) string {
+	return ItalicTag + text + ItalicTag
+}
+
+func Underline(text string) string {
+	return UnderlineTag + text + UnderlineTag
+}
+
+func Strikethrough(text string) string {
+	return StrikethroughTag + text + StrikethroughTag
+}
+
+func Monospace(text string) string {
+	return MonospaceTag + text + MonospaceTag
+}
+
+func Reverse(text string) string {
+	return ReverseTag + text + ReverseTag
+}
+
+// Colours text, bg may be NoColor
+func Colored(text string, fg Color, bg Color) string {
+	return guardCode(colorCode(fg, bg), text) + ColorTag
+}
+
+// Colours text with RRGGBB colours, bg may be empty
+func HexColored(text string, fg string, bg string) string {
+	return guardCode(hexColorCode(fg, bg), text) + HexColorTag
+}
+
+func colorCode(fg Color, bg Color) string {
+	if bg == NoColor {
+		return ColorTag + fg.String()
+	}
+	return ColorTag + fg.String() + "," + bg.String()
+}
+
+func hexColorCode(fg string, bg string) string {
+	if bg == "" {
+		return HexColorTag + strings.ToUpper(fg)
+	}
+	return HexColorTag + strings.ToUpper(fg) + "," + strings.ToUpper(bg)
+}
+
+// Joins colour code and text so that text is not parsed as part of the code,
+// neither as background after colour nor as colour after bare reset
+func guardCode(code string, text string) string {
+	if len(code) == 0 || len(text) == 0 {
+		return code + text
+	}
+	switch {
+	case isHexDigit(code[len(code)-1]) && text[0] == ',':
+	case strings.HasSuffix(code, ColorTag) && isDigit(text[0]):
+	case strings.HasSuffix(code, HexColorTag) && isHexDigit(text[0]):
+	default:
+		return code + text
+	}
+	return code + BoldTag + BoldTag + text
+}
+
+func (s Style) IsZero() bool {
+	return s == Style{}
+}
+
+// Control codes switching plain text to the style
+func (s Style) Codes() string {
+	var b strings.Builder
+	if s.Fg != NoColor {
+		b.WriteString(colorCode(s.Fg, s.Bg))
+	}
+	if s.HexFg != "" {
+		b.WriteString(hexColorCode(s.HexFg, s.HexBg))
+	}
+	for _, flag := range []struct {
+		on  bool
+		tag string
+	}{
+		{s.Bold, BoldTag},
+		{s.Italic, ItalicTag},
+		{s.Underline, UnderlineTag},
+		{s.Strikethrough, StrikethroughTag},
+		{s.Monospace, MonospaceTag},
+		{s.Reverse, ReverseTag},
+	} {
+		if flag.on {
+			b.WriteString(flag.tag)
+		}
+	}
+	return b.String()
+}
+
+// Prepends style codes to text
+func (s Style) Apply(text string) string {
+	return guardCode(s.Codes(), text)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func takeDigits(text string, max int) string {
+	i := 0
+	for i < len(text) && i < max && isDigit(text[i]) {
+		i++
+	}
+	return text[:i]
+}
+
+func takeHex(text string) string {
+	if len(text) < 6 {
+		return ""
+	}
+	for i := 0; i < 6; i++ {
+		if !isHexDigit(text[i]) {
+			return ""
+		}
+	}
+	return strings.ToUpper(text[:6])
+}
+
+func normalizeColor(code string) Color {
+	if len(code) == 1 {
+		code = "0" + code
+	}
+	if color := lookupColor(code); color != NoColor {
+		return color
+	}
+	// extended 16-98 palette
+	return Color(code)
+}
+
+// Applies control code at the start of text and returns its length, 0 if there is none
+func (s *Style) consume(text string) int {
+	if len(text) == 0 {
+		return 0
+	}
+	switch text[:1] {
+	case BoldTag:
+		s.Bold = !s.Bold
+	case ItalicTag:
+		s.Italic = !s.Italic
+	case UnderlineTag:
+		s.Underline = !s.Underline
+	case StrikethroughTag:
+		s.Strikethrough = !s.Strikethrough
+	case MonospaceTag:
+		s.Monospace = !s.Monospace
+	case ReverseTag:
+		s.Reverse = !s.Reverse
+	case ResetTag:
+		*s = Style{}
+	case ColorTag:
+		fg := takeDigits(text[1:], 2)
+		if fg == "" {
+			s.Fg, s.Bg = NoColor, NoColor
+			return 1
+		}
+		s.Fg = normalizeColor(fg)
+		n := 1 + len(fg)
+		if len(text) > n+1 && text[n] == ',' {
+			if bg := takeDigits(text[n+1:], 2); bg != "" {
+				s.Bg = normalizeColor(bg)
+				n += 1 + len(bg)
+			}
+		}
+		return n
+	case HexColorTag:
+		fg := takeHex(text[1:])
+		if fg == "" {
+			s.HexFg, s.HexBg = "", ""
+			return 1
+		}
+		s.HexFg = fg
+		n := 7
+		if len(text) > n+1 && text[n] == ',' {
+			if bg := takeHex(text[n+1:]); bg != "" {
+				s.HexBg = bg
+				n += 7
+			}
+		}
+		return n
+	default:
+		return 0
+	}
+	return 1
+}
+
+// Length of control code at the start of text, 0 if there is none
+func CodeLen(text string) int {
+	var style Style
+	return style.consume(text)
+}
+
+// Splits formatted text into styled spans, empty spans are omitted
+func ParseFormatting(text string) (spans []Span) {
+	var style Style
+	for len(text) > 0 {
+		if n := style.consume(text); n > 0 {
+			text = text[n:]
+			continue
+		}
+		i := strings.IndexAny(text, formatTags)
+		if i == -1 {
+			i = len(text)
+		}
+		spans = append(spans, Span{Style: style, Text: text[:i]})
+		text = text[i:]
+	}
+	return
+}
+
+// Style active at the end of formatted text
+func StyleAt(text string) (style Style) {
+	for len(text) > 0 {
+		if n := style.consume(text); n > 0 {
+			text = text[n:]
+			continue
+		}
+		i := strings.IndexAny(text, formatTags)
+		if i == -1 {
+			break
+		}
+		text = text[i:]
+	}
+	return
+}
+
+// Removes all formatting codes
+func Strip(text string) string {
+	var b strings.Builder
+	for _, span := range ParseFormatting(text) {
+		b.WriteString(span.Text)
+	}
+	return b.String()
+}
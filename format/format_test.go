@@ -0,0 +1,31 @@
+package format
+
+import (
+	"testing"
+)
+
+func TestParseFormatting(t *testing.T) {
+	text := "plain " + Bold("bold "+Italic("both")) + " " + Colored("red", Red, Blue) + HexColored(",hex", "ff8800", "") + "\x0312blue\x0f reset"
+	valids := []Span{
+		{Style{}, "plain "},
+		{Style{Bold: true}, "bold "},
+		{Style{Bold: true, Italic: true}, "both"},
+		{Style{Bold: false}, " "},
+		{Style{Fg: Red, Bg: Blue}, "red"},
+		{Style{HexFg: "FF8800"}, ",hex"},
+		{Style{Fg: LightBlue}, "blue"},
+		{Style{}, " reset"},
+	}
+	spans := ParseFormatting(text)
+	if len(spans) != len(valids) {
+		t.Fatalf("%#v != %#v", spans, valids)
+	}
+	for i, span := range spans {
+		if span != valids[i] {
+			t.Fatalf("span %d: %#v != %#v", i, span, valids[i])
+		}
+	}
+	if stripped := Strip(text); stripped != "plain bold both red,hexblue reset" {
+		t.Fatalf("Strip returned %q", stripped)
+	}
+}
@@ -0,0 +1,139 @@
+package ircfw
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"gitea.demsh.org/demsh/ircfw/format"
+	"gitea.demsh.org/demsh/ircfw/ircfwtest"
+)
+
+var fuzzLines = []string{
+	":demsh!~demsh@12a8e790 PRIVMSG #ircfw-test :heyo people!",
+	"@time=2024-01-02T15:04:05.000Z;msgid=abc\\s\\:d :irc.demsh.org 353 ircfw = #ircfw-test :@demsh +other",
+	":irc.demsh.org 004 ircfw irc.demsh.org ngircd-26.1 abBcCFiIoqrRswx abehiIklmMnoOPqQrRstvVz",
+	"PING :irc.demsh.org",
+	":prefix",
+	"@a=b",
+	":nick JOIN",
+	"CAP * LS",
+	"BATCH +",
+	"",
+}
+
+func FuzzScanMsg(f *testing.F) {
+	f.Add([]byte(strings.Join(fuzzLines, "\r\n")))
+	f.Add([]byte("\r\n\r\nPING\r\nPONG"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for len(data) > 0 {
+			advance, token, err := scanMsg(data, true)
+			if err != nil || advance <= 0 || advance > len(data) {
+				t.Fatalf("advance %d, err %v for %q", advance, err, data)
+			}
+			if bytes.Contains(token, []byte("\r\n")) {
+				t.Fatalf("token %q contains line break", token)
+			}
+			data = data[advance:]
+		}
+	})
+}
+
+// Parsing never panics and exported message parses back to the same one
+func FuzzParseUTF8Message(f *testing.F) {
+	for _, line := range fuzzLines {
+		f.Add(line)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		parsed, err := parseUTF8Message([]byte(line), time.Time{}, nil)
+		if err != nil {
+			return
+		}
+		msg := parsed.(utf8message)
+		switch msg.cmd {
+		case "PING", "PONG", "NICK", "QUIT":
+			// parameters are exported as a single trailing one
+			return
+		}
+		if validateCommand(msg.cmd) != nil || validateParams(msg.params) != nil {
+			return
+		}
+		exported := msg.Export()
+		reparsed, err := parseUTF8Message(dropCRLF(exported), time.Time{}, nil)
+		if err != nil {
+			t.Fatalf("%q exported as unparsable %q: %v", line, exported, err)
+		}
+		again := reparsed.(utf8message)
+		if again.cmd != msg.cmd || !reflect.DeepEqual(again.params, msg.params) || !sameTags(again.tags, msg.tags) {
+			t.Fatalf("%q exported as %q parses to %#v, expected %#v", line, exported, again, msg)
+		}
+	})
+}
+
+func sameTags(a, b map[string]string) bool {
+	return len(a) == len(b) && (len(a) == 0 || reflect.DeepEqual(a, b))
+}
+
+func FuzzSplitByLen(f *testing.F) {
+	f.Add("hello world https://demsh.org/some/long/path?query=value", 10)
+	f.Add("\x02bold\x02 \x034,5colored\x03 é \U0001F1FA\U0001F1E6 \U0001F469‍\U0001F4BB", 4)
+	f.Fuzz(func(t *testing.T, line string, limit int) {
+		if !utf8.ValidString(line) || limit > 1024 {
+			return
+		}
+		chunks := splitByLen(line, limit, byteLen)
+		if limit <= 0 {
+			if len(chunks) != 0 {
+				t.Fatalf("%d chunks for limit %d", len(chunks), limit)
+			}
+			return
+		}
+		var text strings.Builder
+		for _, chunk := range chunks {
+			if chunk == "" || !utf8.ValidString(chunk) {
+				t.Fatalf("invalid chunk %q of %q", chunk, line)
+			}
+			if len(chunk) > limit && fitPrefix(chunk, limit, byteLen) > 0 {
+				t.Fatalf("chunk %q is longer than %d", chunk, limit)
+			}
+			// chunks are sent as separate lines, codes can't span them
+			text.WriteString(format.Strip(chunk))
+		}
+		// chunks may only gain formatting codes and lose spaces
+		if want, got := strings.Fields(format.Strip(line)), strings.Join(strings.Fields(text.String()), ""); strings.Join(want, "") != got {
+			t.Fatalf("%q split into %q", line, chunks)
+		}
+	})
+}
+
+// Every handler survives arbitrary lines from server
+func FuzzDispatch(f *testing.F) {
+	for _, line := range fuzzLines {
+		f.Add(line)
+	}
+	for cmd := range handlers {
+		f.Add(":nick!~user@host " + cmd)
+		f.Add(":nick!~user@host " + cmd + " #ircfw-test")
+	}
+	server := ircfwtest.New(ircfwtest.Caps(map[string]string{"message-tags": "", "server-time": "", "echo-message": ""}))
+	defer server.Close()
+	client, cancel := NewClient(Socket(server.Conn()), SetLogger(nopLogger{}), Handler(func(Msg) {}))
+	defer cancel()
+	ctx, cancelJoin := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancelJoin()
+	if _, err := client.Join(ctx, jchannel); err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		server.Inject(line)
+		// PONG proves that the line was handled by the same serveLoop
+		server.Inject("PING :sync")
+		if _, err := server.ExpectCommand(timeout*time.Second, "PONG", "sync"); err != nil {
+			t.Fatalf("client did not survive %q: %v", line, err)
+		}
+	})
+}
@@ -1,10 +1,8 @@
 package ircfw
 
 import (
-	"context"
 	"fmt"
 	"strings"
-	"time"
 
 	"gopkg.in/tomb.v2"
 )
@@ -17,11 +15,22 @@ var (
 		"PONG":    handlePong,
 		"PRIVMSG": handlePrivmsg,
 		"NOTICE":  handleNotice,
+		"TAGMSG":  handleTagmsg,
 		"ERROR":   handleError,
 		"JOIN":    handleJoin,
 		"NICK":    handleNick,
 		"PART":    handlePart,
+		"QUIT":    handleQuit,
 		"MODE":    handleMode,
+		"CAP":     handleCap,
+		"FAIL":    handleStandardReply,
+		"WARN":    handleStandardReply,
+		"NOTE":    handleStandardReply,
+		"ACCOUNT": handleAccount,
+		"AWAY":    handleAway,
+		"CHGHOST": handleChghost,
+		"SETNAME": handleSetname,
+		"ACK":     handleAck,
 		"001":     handleWelcome,
 		"004":     handleMyInfo,
 		"005":     handleISupport,
@@ -29,12 +38,20 @@ var (
 		"311":     handleWhois,
 		"312":     handleWhois,
 		"319":     handleWhois,
+		"303":     handleISON,
 		"332":     handleTopic,
 		"333":     handleTopic,
 		"353":     handleNames,
 		"372":     handleMOTD,
 		"396":     handleHostname,
 		"473":     handleJoinError,
+		"600":     handleWatch,
+		"601":     handleWatch,
+		"604":     handleWatch,
+		"605":     handleWatch,
+		"730":     handleMonitor,
+		"731":     handleMonitor,
+		"734":     handleMonitorFull,
 	}
 )
 
@@ -50,16 +67,27 @@ func (c *Client) serveLoop() error {
 				c.Debug("c.reads closed, quitting")
 				return ErrReadsClosed
 			}
-			handler, exists := handlers[msg.Cmd()]
-			if exists {
-				handler(msg)
-			} else {
-				logHandler(msg)
+			c.resolveLabel(msg)
+			if c.collectBatch(msg) {
+				continue
 			}
+			c.requests.observe(msg)
+			c.dispatch(msg)
 		}
 	}
 }
 
+func (c *Client) dispatch(msg message) {
+	// prefix is the state before the line, handlers such as CHGHOST update it
+	c.observeUser(msg)
+	handler, exists := handlers[msg.Cmd()]
+	if exists {
+		handler(msg)
+	} else {
+		logHandler(msg)
+	}
+}
+
 func handleJoinError(msg message) {
 	client := msg.Client()
 	if msg.Cmd() != "473" {
@@ -67,15 +95,12 @@ func handleJoinError(msg message) {
 		return
 	}
 	params := msg.Params()
-	chanName := params[1]
-	err := fmt.Errorf("%q: %q", chanName, params[len(params)-1])
-	if channel := client.fetchChannel(chanName); channel != nil {
-		client.Lock()
-		delete(client.channels, chanName)
-		client.Unlock()
-		channel.err = err
-		channel.kill()
+	if len(params) < 2 {
+		client.Debug("Got join error with less than 2 parameters: %#v", msg)
+		return
 	}
+	chanName := params[1]
+	client.failJoin(chanName, fmt.Errorf("%q: %q", chanName, params[len(params)-1]))
 }
 
 func handleMyInfo(msg message) {
@@ -97,13 +122,19 @@ func handleWhois(msg message) {
 func handlePong(msg message) {
 }
 
+func handleAck(msg message) {
+}
+
 func logHandler(msg message) {
 	msg.Client().Debug("Unhandled: %#v", msg)
 }
 
 func handleMOTD(msg message) {
-	motd := strings.TrimSpace(strings.Join(msg.Params()[1:], " "))
 	client := msg.Client()
+	if len(msg.Params()) < 2 {
+		return
+	}
+	motd := strings.TrimSpace(strings.Join(msg.Params()[1:], " "))
 	client.Lock()
 	client.motd = append(msg.Client().motd, motd)
 	client.Unlock()
@@ -112,6 +143,10 @@ func handleMOTD(msg message) {
 func handleWelcome(msg message) {
 	client := msg.Client()
 	params := msg.Params()
+	if len(params) == 0 {
+		client.Debug("Got RPL_WELCOME without parameters")
+		return
+	}
 	paramSlice := strings.Split(params[len(params)-1], " ")
 	client.Lock()
 	client.prefix = paramSlice[len(paramSlice)-1]
@@ -131,7 +166,12 @@ func handleModeNick(msg message) {
 
 func handleModeChannel(msg message) {
 	channel := msg.Channel()
+	if channel == nil {
+		return
+	}
+	channel.Lock()
 	channel.modes = msg.Params()[1]
+	channel.Unlock()
 }
 
 func handleMode(msg message) {
@@ -150,11 +190,18 @@ func handleMode(msg message) {
 }
 
 func handleHostname(msg message) {
+	if len(msg.Params()) < 2 {
+		return
+	}
 	hostname := msg.Params()[1]
 	msg.Client().setHostname(hostname)
 }
 
 func handleNotice(msg message) {
+	if len(msg.Params()) < 2 {
+		msg.Client().Debug("Got NOTICE with less than 2 parameters: %#v", msg)
+		return
+	}
 	msg.Client().Debug("Notice from %q: %q", msg.Nick(), msg.Text())
 }
 
@@ -162,25 +209,45 @@ func handlePing(msg message) {
 	msg.Client().pong(msg.Params())
 }
 
-func send(ctx context.Context, msg Msg, channel chan<- Msg) {
+// Hands msg to rxLoop of channel, backpressure is up to the dispatcher
+func receive(msg Msg, channel *Channel) {
 	select {
-	case channel <- msg:
-	case <-ctx.Done():
-		msg.Debug("error sending message: %q", ctx.Err())
+	case channel.receive <- msg:
+	case <-channel.quit:
+	case <-msg.Client().tomb.Dying():
 	}
 }
 
 func handlePrivmsgPrivate(msg message) {
-	client := msg.Client()
-	ctx := client.tomb.Context(nil)
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	send(ctx, msg.Msg(), client.private.receive)
-	cancel()
+	query := msg.Client().createQuery(queryNick(msg))
+	receive(msg.Msg(), query)
+}
+
+// Handles CTCP requests addressed to the client itself, returns false
+// for ones like ACTION which are delivered to MsgHandler
+func handleCTCP(msg message) bool {
+	cmd, args := parseCTCP(msg.Text())
+	switch cmd {
+	case "DCC":
+		handleDCC(msg, args)
+		return true
+	}
+	return false
 }
 
 func handlePrivmsg(msg message) {
-	chanName := msg.Params()[0]
 	client := msg.Client()
+	if len(msg.Params()) < 2 {
+		client.Debug("Got PRIVMSG with less than 2 parameters: %#v", msg)
+		return
+	}
+	chanName := msg.Params()[0]
+	if client.dropEcho(msg) {
+		return
+	}
+	if isCTCP(msg.Text()) && !isEcho(msg) && handleCTCP(msg) {
+		return
+	}
 	if isNick(chanName) {
 		handlePrivmsgPrivate(msg)
 		return
@@ -194,19 +261,24 @@ func handlePrivmsg(msg message) {
 		client.Debug("Got unexpected PRIVMSG for %q: %#v", chanName, msg)
 		return
 	}
-	ctx := client.tomb.Context(nil)
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	send(ctx, msg.Msg(), channel.receive)
-	cancel()
+	receive(msg.Msg(), channel)
 }
 
 func handleNick(msg message) {
+	if len(msg.Params()) == 0 {
+		msg.Client().Debug("Got NICK without new nick: %#v", msg)
+		return
+	}
 	oldnick := msg.Nick()
 	newnick := msg.Params()[0]
+	msg.Client().users.Lock()
+	msg.Client().users.rename(oldnick, newnick)
+	msg.Client().users.Unlock()
 	if msg.Client().Nick() == oldnick {
 		msg.Client().setNick(newnick)
 		return
 	}
+	msg.Client().renameQuery(oldnick, newnick)
 	msg.Client().Lock()
 	defer msg.Client().Unlock()
 	for _, channel := range msg.Client().channels {
@@ -216,6 +288,8 @@ func handleNick(msg message) {
 
 func handleError(msg message) {
 	msg.Client().Logf("Error from server: %#v", msg)
+	// server closes the link after ERROR, acknowledging QUIT if any
+	msg.Client().closeServer()
 }
 
 func handleISupport(msg message) {
@@ -237,14 +311,24 @@ func handleISupport(msg message) {
 }
 
 func handleJoin(msg message) {
+	if len(msg.Params()) == 0 {
+		msg.Client().Debug("Got JOIN without channel: %#v", msg)
+		return
+	}
 	msgnick := msg.Nick()
 	mynick := msg.MyNick()
 	chanName := msg.Params()[0]
+	msg.Client().trackJoin(msg)
 	if mynick == msgnick {
 		// Can't use message.Channel() here
 		msg.Client().Lock()
 		if channel := msg.Client().fetchChannel(chanName); channel != nil {
-			channel.start()
+			var history chan []Msg
+			if client := msg.Client(); client.backfill > 0 && client.HasCap(ChathistoryCap) {
+				history = make(chan []Msg, 1)
+				go channel.backfill(client.backfill, history)
+			}
+			channel.startAfter(history)
 		} else {
 			msg.Client().Debug("Unsolicited JOIN for %q", chanName)
 		}
@@ -259,6 +343,9 @@ func handleJoin(msg message) {
 }
 
 func handleTopic(msg message) {
+	if len(msg.Params()) < 3 {
+		return
+	}
 	topic := msg.Params()[2]
 	channel := msg.Channel()
 	if channel == nil {
@@ -270,16 +357,40 @@ func handleTopic(msg message) {
 }
 
 func handleNames(msg message) {
+	if len(msg.Params()) < 4 {
+		msg.Client().Debug("Got RPL_NAMREPLY with less than 4 parameters: %#v", msg)
+		return
+	}
 	channel := msg.Channel()
-	for _, nick := range strings.Split(msg.Params()[3], " ") {
+	if channel == nil {
+		msg.Client().Debug("Got names of unknown channel: %#v", msg)
+		return
+	}
+	nicks := strings.Split(msg.Params()[3], " ")
+	for _, nick := range nicks {
 		channel.names.Add(nick)
 	}
+	msg.Client().trackNames(msg.Params()[2], nicks)
 }
 
 func handlePart(msg message) {
+	client := msg.Client()
+	if len(msg.Params()) == 0 {
+		client.Debug("Got PART without channel: %#v", msg)
+		return
+	}
 	channel := msg.Channel()
+	client.users.Lock()
+	if msg.Nick() == msg.MyNick() {
+		client.users.partAll(msg.Params()[0])
+	} else {
+		client.users.part(msg.Nick(), msg.Params()[0])
+	}
+	client.users.Unlock()
+	if channel == nil {
+		return
+	}
 	if msg.Nick() == msg.MyNick() {
-		client := msg.Client()
 		client.Lock()
 		delete(client.channels, channel.name)
 		channel.kill()
@@ -288,3 +399,19 @@ func handlePart(msg message) {
 	}
 	channel.names.Remove(msg.Nick())
 }
+
+func handleQuit(msg message) {
+	client := msg.Client()
+	if msg.Nick() == msg.MyNick() {
+		return
+	}
+	client.users.Lock()
+	client.users.quit(msg.Nick())
+	client.users.Unlock()
+	client.removeQuery(msg.Nick())
+	client.Lock()
+	defer client.Unlock()
+	for _, channel := range client.channels {
+		channel.names.Remove(msg.Nick())
+	}
+}
@@ -10,31 +10,92 @@ import (
 	"gopkg.in/tomb.v2"
 )
 
-const MAXMSGSIZE = 512
+const (
+	MAXMSGSIZE  = 512
+	MAXTAGSSIZE = 8191
+	// tags are not counted in MAXMSGSIZE
+	MAXLINESIZE   = MAXTAGSSIZE + 1 + MAXMSGSIZE
+	HISTORY_LIMIT = 100
+)
 
 type MsgHandler func(Msg)
 
+// Handler whose context is cancelled once the channel is parted or killed,
+// the client dies or HandlerTimeout passes, see TraceID
+type ContextHandler func(context.Context, Msg)
+
+// Turns MsgHandler into ContextHandler ignoring the context
+func AdaptHandler(handler MsgHandler) ContextHandler {
+	return func(_ context.Context, msg Msg) {
+		handler(msg)
+	}
+}
+
 type Channel struct {
-	// the mutex protects topic
+	// the mutex protects name, topic, recent and ctx
 	sync.Mutex
 	name, topic, modes string
 	names              set
 	send, receive      chan Msg
-	client             *Client
-	started, quit      chan struct{}
-	err                error
+	// txLoop hands queued messages to client and closes received channel
+	flushes       chan chan struct{}
+	client        *Client
+	started, quit chan struct{}
+	err           error
+	recent        []Msg
+	// handler context, created on first message
+	ctx context.Context
+	// nick of the other side for private conversations
+	peer string
+	// last message received or sent in private conversation,
+	// protected by client mutex
+	lastActive time.Time
+	// set for DCC CHAT sessions only
+	dcc    net.Conn
+	typing typingState
 }
 
 type Client struct {
+	// accessed atomically, kept first for alignment
+	lastID        uint64
 	tomb          *tomb.Tomb
 	socket        net.Conn
 	reads, writes chan message
-	private       *Channel
+	dcc           *dccState
 	started       chan struct{}
-	handler       MsgHandler
-	charmap       *charmap.Charmap
-	logger        Logger
-	aliveTimeout  time.Duration
+	handler       ContextHandler
+	dispatcher    *dispatcher
+	// set with Transcode only
+	charmap          *charmap.Charmap
+	logger           Logger
+	aliveTimeout     time.Duration
+	batchHandlers    []BatchHandler
+	tagHandlers      []TagMsgHandler
+	keepEchoes       bool
+	users            *userTracker
+	presence         *presenceState
+	stsHost          string
+	stsStore         STSStore
+	replyHandlers    []StandardReplyHandler
+	presenceHandlers []PresenceHandler
+	requests         *requests
+	history          *historyState
+	backfill         int
+	maxQueries       int
+	wantCaps         []string
+	capsDone         chan struct{}
+	// closed when Shutdown starts, no new messages are accepted after
+	closing chan struct{}
+	// closed by writeLoop once QUIT is written
+	quitSent chan struct{}
+	// closed on server ERROR or when readLoop stops
+	serverClosed chan struct{}
+	enabledCaps  set
+	// fields below are touched by serveLoop only
+	pendingCaps []string
+	batches     map[string]*Batch
+	// messages buffered in open batches and batches opened so far
+	batched, batchSeq int
 	sync.Mutex
 	// fields below are protected by the mutex
 	lastMessage          time.Time
@@ -43,7 +104,9 @@ type Client struct {
 	nickservPass         string
 	motd                 []string
 	channels             map[string]*Channel
+	queries              map[string]*Channel
 	params               map[string]string
+	availCaps            map[string]string
 }
 
 type Msg interface {
@@ -53,10 +116,24 @@ type Msg interface {
 	WrappedText() []string
 	Nick() string
 	Prefix() string
+	// server-time of the message if available, receive or creation time otherwise
+	Time() time.Time
+	// msgid assigned by server, empty if unknown
+	MsgID() string
+	// set for messages delivered from CHATHISTORY playback
+	IsHistorical() bool
 	Messages() []message
 	Logf(format string, params ...interface{})
 	Debug(format string, params ...interface{})
-	Reply(ctx context.Context, text []string)
+	// Reply threaded to the message with +draft/reply when possible
+	Reply(ctx context.Context, text []string) error
+	// Reply which waits for its echo-message, see Channel.SayConfirmed
+	ReplyConfirmed(ctx context.Context, text []string) ([]Msg, error)
+	// Shows typing indicator to the channel of the message until Reply
+	// is sent or handler returns
+	Typing()
+	// Reacts to the message with +draft/react
+	React(ctx context.Context, emoji string) error
 	IsPrivate() bool
 }
 
@@ -72,6 +149,9 @@ type message interface {
 	Channel() *Channel
 	Client() *Client
 	Deadline() time.Time
+	Time() time.Time
+	Tags() map[string]string
+	Tag(key string) (string, bool)
 }
 
 // Logger should be safe to be used by several goroutines
@@ -0,0 +1,73 @@
+package ircfwtest
+
+import (
+	"strings"
+)
+
+// Parsed IRC line as sent by client
+type Line struct {
+	Raw     string
+	Tags    map[string]string
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+// Parses raw line without trailing CRLF, tag values are left escaped
+func ParseLine(raw string) Line {
+	line := Line{Raw: raw}
+	rest := strings.TrimRight(raw, "\r\n")
+	if strings.HasPrefix(rest, "@") {
+		var tags string
+		tags, rest = cut(rest[1:], " ")
+		line.Tags = make(map[string]string)
+		for _, tag := range strings.Split(tags, ";") {
+			key, value := cut(tag, "=")
+			line.Tags[key] = value
+		}
+	}
+	rest = strings.TrimLeft(rest, " ")
+	if strings.HasPrefix(rest, ":") {
+		line.Prefix, rest = cut(rest[1:], " ")
+	}
+	rest = strings.TrimLeft(rest, " ")
+	line.Command, rest = cut(rest, " ")
+	line.Command = strings.ToUpper(line.Command)
+	for rest != "" {
+		if strings.HasPrefix(rest, ":") {
+			line.Params = append(line.Params, rest[1:])
+			break
+		}
+		var param string
+		param, rest = cut(rest, " ")
+		if param != "" {
+			line.Params = append(line.Params, param)
+		}
+	}
+	return line
+}
+
+// Param at index i, empty if there is none
+func (l Line) Param(i int) string {
+	if i < 0 || i >= len(l.Params) {
+		return ""
+	}
+	return l.Params[i]
+}
+
+// Last parameter, usually text of the message
+func (l Line) Trailing() string {
+	return l.Param(len(l.Params) - 1)
+}
+
+func (l Line) String() string {
+	return l.Raw
+}
+
+func cut(s, sep string) (string, string) {
+	i := strings.Index(s, sep)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+len(sep):]
+}
@@ -0,0 +1,340 @@
+// Package ircfwtest provides scriptable in-memory IRC server for testing
+// clients without network access.
+package ircfwtest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrTimeout = errors.New("expected line was not received")
+
+// Overrides built-in handling of command
+type HandlerFunc func(session *Session, line Line)
+
+type Option func(*Server)
+
+// Server name used as prefix of numerics
+func Name(name string) Option {
+	return func(s *Server) {
+		s.name = name
+	}
+}
+
+// Capabilities advertised in CAP LS, values may be empty
+func Caps(caps map[string]string) Option {
+	return func(s *Server) {
+		for name, value := range caps {
+			s.caps[name] = value
+		}
+	}
+}
+
+// RPL_ISUPPORT tokens like "CHANTYPES=#" or "MONITOR=100"
+func ISupport(tokens ...string) Option {
+	return func(s *Server) {
+		s.isupport = append(s.isupport, tokens...)
+	}
+}
+
+func MOTD(lines ...string) Option {
+	return func(s *Server) {
+		s.motd = lines
+	}
+}
+
+// Delay before every line written to clients
+func Latency(latency time.Duration) Option {
+	return func(s *Server) {
+		s.latency = latency
+	}
+}
+
+type channel struct {
+	name, topic, modes string
+	// keyed by lowercase nick
+	members map[string]*Session
+}
+
+type Server struct {
+	name     string
+	caps     map[string]string
+	isupport []string
+	motd     []string
+
+	sync.Mutex
+	latency  time.Duration
+	sessions []*Session
+	channels map[string]*channel
+	handlers map[string]HandlerFunc
+	listener net.Listener
+	// lines received from all clients in order of arrival
+	received []Line
+	// position after the last line matched by Expect
+	cursor int
+	// closed and replaced whenever a line is received
+	changed chan struct{}
+}
+
+func New(opts ...Option) *Server {
+	s := &Server{
+		name:     "irc.ircfwtest",
+		caps:     make(map[string]string),
+		isupport: []string{"CHANTYPES=#&", "PREFIX=(ov)@+", "NETWORK=ircfwtest"},
+		motd:     []string{"ircfwtest fake server"},
+		channels: make(map[string]*channel),
+		handlers: make(map[string]HandlerFunc),
+		changed:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Returns client end of new in-memory connection
+func (s *Server) Conn() net.Conn {
+	client, server := net.Pipe()
+	s.serve(server)
+	return client
+}
+
+// Accepts connections on loopback, returns address to dial
+func (s *Server) Listen() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	s.Lock()
+	s.listener = listener
+	s.Unlock()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.serve(conn)
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+// Closes listener and all connections
+func (s *Server) Close() error {
+	s.Lock()
+	listener := s.listener
+	s.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+	s.Disconnect()
+	return nil
+}
+
+// Drops all connections without ERROR as if network failed
+func (s *Server) Disconnect() {
+	for _, session := range s.Sessions() {
+		session.Close()
+	}
+}
+
+func (s *Server) SetLatency(latency time.Duration) {
+	s.Lock()
+	s.latency = latency
+	s.Unlock()
+}
+
+func (s *Server) getLatency() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.latency
+}
+
+// Replaces built-in handling of cmd, nil restores it
+func (s *Server) Handle(cmd string, handler HandlerFunc) {
+	s.Lock()
+	defer s.Unlock()
+	if handler == nil {
+		delete(s.handlers, strings.ToUpper(cmd))
+		return
+	}
+	s.handlers[strings.ToUpper(cmd)] = handler
+}
+
+// Connected sessions in order of connection
+func (s *Server) Sessions() []*Session {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*Session{}, s.sessions...)
+}
+
+// Sends raw line to every connected client
+func (s *Server) Inject(line string) {
+	for _, session := range s.Sessions() {
+		session.Send(line)
+	}
+}
+
+// Sends line n times in a row to every connected client
+func (s *Server) Flood(line string, n int) {
+	for i := 0; i < n; i++ {
+		s.Inject(line)
+	}
+}
+
+// All lines received from clients so far
+func (s *Server) Received() []Line {
+	s.Lock()
+	defer s.Unlock()
+	return append([]Line{}, s.received...)
+}
+
+// Waits for line matching match received after the line matched
+// by previous Expect call
+func (s *Server) Expect(timeout time.Duration, match func(Line) bool) (Line, error) {
+	deadline := time.After(timeout)
+	for {
+		s.Lock()
+		for i := s.cursor; i < len(s.received); i++ {
+			if match(s.received[i]) {
+				s.cursor = i + 1
+				line := s.received[i]
+				s.Unlock()
+				return line, nil
+			}
+		}
+		changed := s.changed
+		s.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return Line{}, ErrTimeout
+		}
+	}
+}
+
+// Waits for cmd whose leading parameters equal params
+func (s *Server) ExpectCommand(timeout time.Duration, cmd string, params ...string) (Line, error) {
+	line, err := s.Expect(timeout, func(line Line) bool {
+		if line.Command != strings.ToUpper(cmd) || len(line.Params) < len(params) {
+			return false
+		}
+		for i, param := range params {
+			if line.Params[i] != param {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return line, fmt.Errorf("%s %q: %w", cmd, params, err)
+	}
+	return line, nil
+}
+
+func (s *Server) record(line Line) {
+	s.Lock()
+	defer s.Unlock()
+	s.received = append(s.received, line)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) serve(conn net.Conn) {
+	session := newSession(s, conn)
+	s.Lock()
+	s.sessions = append(s.sessions, session)
+	s.Unlock()
+	go session.writeLoop()
+	go session.readLoop()
+}
+
+// Forgets closed session
+func (s *Server) remove(session *Session) {
+	s.Lock()
+	defer s.Unlock()
+	for i, other := range s.sessions {
+		if other == session {
+			s.sessions = append(s.sessions[:i], s.sessions[i+1:]...)
+			break
+		}
+	}
+	for key, channel := range s.channels {
+		delete(channel.members, lower(session.Nick()))
+		if len(channel.members) == 0 {
+			delete(s.channels, key)
+		}
+	}
+}
+
+func (s *Server) findSession(nick string) *Session {
+	for _, session := range s.Sessions() {
+		if lower(session.Nick()) == lower(nick) {
+			return session
+		}
+	}
+	return nil
+}
+
+// Members of channel, nil if there is no such channel
+func (s *Server) members(name string) []*Session {
+	s.Lock()
+	defer s.Unlock()
+	channel, ok := s.channels[lower(name)]
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0, len(channel.members))
+	for key := range channel.members {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	members := make([]*Session, 0, len(keys))
+	for _, key := range keys {
+		members = append(members, channel.members[key])
+	}
+	return members
+}
+
+// Channels session is on
+func (s *Server) channelsOf(session *Session) (names []string) {
+	s.Lock()
+	defer s.Unlock()
+	for _, channel := range s.channels {
+		if _, ok := channel.members[lower(session.Nick())]; ok {
+			names = append(names, channel.name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// Sends line to everyone sharing a channel with session, session included if self
+func (s *Server) broadcast(session *Session, line string, self bool) {
+	seen := map[*Session]bool{session: true}
+	if self {
+		session.Send(line)
+	}
+	for _, name := range s.channelsOf(session) {
+		for _, member := range s.members(name) {
+			if !seen[member] {
+				seen[member] = true
+				member.Send(line)
+			}
+		}
+	}
+}
+
+func lower(s string) string {
+	return strings.ToLower(s)
+}
+
+func isChannel(target string) bool {
+	return strings.HasPrefix(target, "#") || strings.HasPrefix(target, "&")
+}
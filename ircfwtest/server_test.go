@@ -0,0 +1,151 @@
+package ircfwtest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t *testing.T, server *Server, nick string) *testClient {
+	c := &testClient{t: t, conn: server.Conn()}
+	c.reader = bufio.NewReader(c.conn)
+	c.send("CAP LS 302")
+	c.send("NICK " + nick)
+	c.send("USER " + nick + " 0 * :" + nick)
+	c.send("CAP END")
+	c.expect("376")
+	return c
+}
+
+func (c *testClient) send(line string) {
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(c.conn, "%s\r\n", line)
+}
+
+// Reads lines until one with cmd arrives
+func (c *testClient) expect(cmd string) Line {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		raw, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("waiting for %s: %v", cmd, err)
+		}
+		if line := ParseLine(raw); line.Command == cmd {
+			return line
+		}
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	line := ParseLine("@label=1;+draft/reply=abc :nick!~user@host PRIVMSG #chan :hello world\r\n")
+	if line.Tags["label"] != "1" || line.Tags["+draft/reply"] != "abc" || line.Prefix != "nick!~user@host" ||
+		line.Command != "PRIVMSG" || line.Param(0) != "#chan" || line.Trailing() != "hello world" {
+		t.Errorf("unexpected %#v", line)
+	}
+	if line := ParseLine("ping"); line.Command != "PING" || len(line.Params) != 0 || line.Param(3) != "" {
+		t.Errorf("unexpected %#v", line)
+	}
+}
+
+func TestRegistrationAndChannels(t *testing.T) {
+	server := New(Caps(map[string]string{"echo-message": "", "sts": "port=6697"}), ISupport("MONITOR=10"))
+	defer server.Close()
+	alice := dial(t, server, "alice")
+	if _, err := server.ExpectCommand(time.Second, "CAP", "END"); err != nil {
+		t.Fatal(err)
+	}
+	bob := dial(t, server, "bob")
+
+	alice.send("JOIN #test")
+	alice.expect("366")
+	bob.send("JOIN #test")
+	if names := bob.expect("353"); names.Trailing() != "alice bob" {
+		t.Errorf("unexpected names %q", names)
+	}
+	if join := alice.expect("JOIN"); !strings.HasPrefix(join.Prefix, "bob!") {
+		t.Errorf("unexpected join %q", join)
+	}
+	bob.send("TOPIC #test :new topic")
+	if topic := alice.expect("TOPIC"); topic.Trailing() != "new topic" {
+		t.Errorf("unexpected topic %q", topic)
+	}
+	bob.send("PRIVMSG #test :hi alice")
+	if msg := alice.expect("PRIVMSG"); msg.Trailing() != "hi alice" {
+		t.Errorf("unexpected message %q", msg)
+	}
+	carol := dial(t, server, "carol")
+	carol.send("PART #test")
+	carol.expect("442")
+	bob.send("PRIVMSG #test :after part")
+	// PART of non-member is not broadcast
+	alice.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if raw, err := alice.reader.ReadString('\n'); err != nil || ParseLine(raw).Command != "PRIVMSG" {
+		t.Errorf("unexpected %q after PART of non-member: %v", raw, err)
+	}
+	alice.send("WHOIS bob")
+	if whois := alice.expect("311"); whois.Param(1) != "bob" || whois.Trailing() != "bob" {
+		t.Errorf("unexpected whois %q", whois)
+	}
+	if _, err := server.ExpectCommand(time.Second, "WHOIS", "bob"); err != nil {
+		t.Error(err)
+	}
+	if _, err := server.ExpectCommand(50*time.Millisecond, "PRIVMSG"); err == nil {
+		t.Error("line before the previous expectation matched")
+	}
+}
+
+// Reads the next line, which must have cmd
+func (c *testClient) next(cmd string) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	raw, err := c.reader.ReadString('\n')
+	if err != nil || ParseLine(raw).Command != cmd {
+		c.t.Errorf("expected %s, got %q: %v", cmd, raw, err)
+	}
+}
+
+func TestNoDuplicates(t *testing.T) {
+	server := New()
+	defer server.Close()
+	alice := dial(t, server, "alice")
+	alice.send("JOIN #test")
+	alice.expect("366")
+	alice.send("NICK alicia")
+	alice.next("NICK")
+	alice.send("PRIVMSG alicia :note to self")
+	alice.next("PRIVMSG")
+	alice.send("PING :x")
+	alice.next("PONG")
+}
+
+func TestScripting(t *testing.T) {
+	server := New(Latency(10 * time.Millisecond))
+	defer server.Close()
+	server.Handle("VERSION", func(session *Session, line Line) {
+		session.Numeric("351", "ircfwtest-1.0", "irc.ircfwtest", "scripted")
+	})
+	alice := dial(t, server, "alice")
+	alice.send("VERSION")
+	if version := alice.expect("351"); version.Param(1) != "ircfwtest-1.0" {
+		t.Errorf("unexpected %q", version)
+	}
+	server.Flood(":irc.ircfwtest NOTICE alice :flood", 100)
+	for i := 0; i < 100; i++ {
+		alice.expect("NOTICE")
+	}
+	server.Disconnect()
+	alice.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := alice.reader.ReadString('\n'); err == nil {
+		t.Error("connection is alive after Disconnect")
+	}
+}
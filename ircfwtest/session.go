@@ -0,0 +1,536 @@
+package ircfwtest
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Connection of a single client
+type Session struct {
+	server *Server
+	conn   net.Conn
+	out    chan string
+	done   chan struct{}
+	once   sync.Once
+
+	sync.Mutex
+	nick, user, realname string
+	registered           bool
+	negotiating          bool
+	caps                 map[string]bool
+}
+
+func newSession(server *Server, conn net.Conn) *Session {
+	return &Session{
+		server: server,
+		conn:   conn,
+		out:    make(chan string, 1024),
+		done:   make(chan struct{}),
+		caps:   make(map[string]bool),
+	}
+}
+
+func (s *Session) Nick() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.nick
+}
+
+// nick!user@host of the client
+func (s *Session) Prefix() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.nick + "!~" + s.user + "@ircfwtest"
+}
+
+// Reports whether client enabled capability
+func (s *Session) HasCap(name string) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.caps[name]
+}
+
+// Queues raw line without CRLF for the client
+func (s *Session) Send(line string) {
+	select {
+	case <-s.done:
+	case s.out <- line:
+	}
+}
+
+// Drops connection
+func (s *Session) Close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.conn.Close()
+		s.server.remove(s)
+	})
+}
+
+func (s *Session) writeLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case line := <-s.out:
+			if latency := s.server.getLatency(); latency > 0 {
+				select {
+				case <-s.done:
+					return
+				case <-time.After(latency):
+				}
+			}
+			if _, err := s.conn.Write([]byte(line + "\r\n")); err != nil {
+				s.Close()
+				return
+			}
+		}
+	}
+}
+
+func (s *Session) readLoop() {
+	defer s.Close()
+	scanner := bufio.NewScanner(s.conn)
+	scanner.Buffer(make([]byte, 8192+512), 8192+512)
+	for scanner.Scan() {
+		raw := strings.TrimRight(scanner.Text(), "\r")
+		if raw == "" {
+			continue
+		}
+		line := ParseLine(raw)
+		s.server.record(line)
+		s.handle(line)
+	}
+}
+
+// Sends numeric reply addressed to the client, last param becomes trailing
+func (s *Session) Numeric(code string, params ...string) {
+	target := s.Nick()
+	if target == "" {
+		target = "*"
+	}
+	s.Send(s.server.format(s.server.name, code, append([]string{target}, params...)))
+}
+
+func (srv *Server) format(prefix string, cmd string, params []string) string {
+	var b strings.Builder
+	if prefix != "" {
+		b.WriteString(":" + prefix + " ")
+	}
+	b.WriteString(cmd)
+	for i, param := range params {
+		b.WriteString(" ")
+		if i == len(params)-1 && (param == "" || strings.Contains(param, " ") || strings.HasPrefix(param, ":")) {
+			b.WriteString(":")
+		}
+		b.WriteString(param)
+	}
+	return b.String()
+}
+
+// Line from the client to others
+func (s *Session) userLine(cmd string, params ...string) string {
+	return s.server.format(s.Prefix(), cmd, params)
+}
+
+func (s *Session) handle(line Line) {
+	s.server.Lock()
+	handler, ok := s.server.handlers[line.Command]
+	s.server.Unlock()
+	if ok {
+		handler(s, line)
+		return
+	}
+	s.Lock()
+	registered := s.registered
+	s.Unlock()
+	switch line.Command {
+	case "CAP":
+		s.handleCap(line)
+		return
+	case "NICK":
+		s.handleNick(line)
+		return
+	case "USER":
+		s.Lock()
+		s.user, s.realname = line.Param(0), line.Trailing()
+		s.Unlock()
+		s.tryRegister()
+		return
+	case "PASS":
+		return
+	case "PING":
+		s.Send(s.server.format(s.server.name, "PONG", []string{s.server.name, line.Param(0)}))
+		return
+	case "QUIT":
+		s.server.broadcast(s, s.userLine("QUIT", "Quit: "+line.Param(0)), false)
+		s.Send("ERROR :Closing Link: " + s.Nick() + " (Quit)")
+		time.AfterFunc(10*time.Millisecond, s.Close)
+		return
+	}
+	if !registered {
+		s.Numeric("451", "You have not registered")
+		return
+	}
+	switch line.Command {
+	case "JOIN":
+		for _, name := range strings.Split(line.Param(0), ",") {
+			s.join(name)
+		}
+	case "PART":
+		for _, name := range strings.Split(line.Param(0), ",") {
+			s.part(name, line.Param(1))
+		}
+	case "NAMES":
+		s.names(line.Param(0))
+	case "TOPIC":
+		s.topic(line)
+	case "MODE":
+		s.mode(line)
+	case "WHOIS":
+		s.whois(line.Trailing())
+	case "ISON":
+		var online []string
+		for _, nick := range strings.Fields(strings.Join(line.Params, " ")) {
+			if other := s.server.findSession(nick); other != nil {
+				online = append(online, other.Nick())
+			}
+		}
+		s.Numeric("303", strings.Join(online, " "))
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+		s.message(line)
+	default:
+		s.Numeric("421", line.Command, "Unknown command")
+	}
+}
+
+func (s *Session) handleCap(line Line) {
+	switch strings.ToUpper(line.Param(0)) {
+	case "LS":
+		s.Lock()
+		s.negotiating = true
+		s.Unlock()
+		var list []string
+		for name, value := range s.server.caps {
+			if value != "" && line.Param(1) == "302" {
+				name += "=" + value
+			}
+			list = append(list, name)
+		}
+		sort.Strings(list)
+		s.capReply("LS", strings.Join(list, " "))
+	case "REQ":
+		s.Lock()
+		s.negotiating = true
+		s.Unlock()
+		requested := strings.Fields(line.Trailing())
+		for _, name := range requested {
+			if _, ok := s.server.caps[strings.TrimPrefix(name, "-")]; !ok {
+				s.capReply("NAK", line.Trailing())
+				return
+			}
+		}
+		s.Lock()
+		for _, name := range requested {
+			if strings.HasPrefix(name, "-") {
+				delete(s.caps, name[1:])
+				continue
+			}
+			s.caps[name] = true
+		}
+		s.Unlock()
+		s.capReply("ACK", line.Trailing())
+	case "LIST":
+		s.Lock()
+		var list []string
+		for name := range s.caps {
+			list = append(list, name)
+		}
+		s.Unlock()
+		sort.Strings(list)
+		s.capReply("LIST", strings.Join(list, " "))
+	case "END":
+		s.Lock()
+		s.negotiating = false
+		s.Unlock()
+		s.tryRegister()
+	}
+}
+
+func (s *Session) capReply(subcmd string, list string) {
+	target := s.Nick()
+	if target == "" {
+		target = "*"
+	}
+	s.Send(":" + s.server.name + " CAP " + target + " " + subcmd + " :" + list)
+}
+
+func (s *Session) handleNick(line Line) {
+	nick := line.Param(0)
+	if nick == "" {
+		s.Numeric("431", "No nickname given")
+		return
+	}
+	if other := s.server.findSession(nick); other != nil && other != s {
+		s.Numeric("433", nick, "Nickname is already in use")
+		return
+	}
+	s.Lock()
+	registered := s.registered
+	s.Unlock()
+	if !registered {
+		s.Lock()
+		s.nick = nick
+		s.Unlock()
+		s.tryRegister()
+		return
+	}
+	s.server.broadcast(s, s.userLine("NICK", nick), true)
+	old := lower(s.Nick())
+	s.server.Lock()
+	for _, channel := range s.server.channels {
+		if _, ok := channel.members[old]; ok {
+			delete(channel.members, old)
+			channel.members[lower(nick)] = s
+		}
+	}
+	s.server.Unlock()
+	s.Lock()
+	s.nick = nick
+	s.Unlock()
+}
+
+func (s *Session) tryRegister() {
+	s.Lock()
+	if s.registered || s.negotiating || s.nick == "" || s.user == "" {
+		s.Unlock()
+		return
+	}
+	s.registered = true
+	s.Unlock()
+	srv := s.server
+	s.Numeric("001", "Welcome to the ircfwtest network "+s.Prefix())
+	s.Numeric("002", "Your host is "+srv.name+", running version ircfwtest")
+	s.Numeric("003", "This server was created today")
+	s.Numeric("004", srv.name, "ircfwtest", "iowx", "biklmnopstv")
+	s.Numeric("005", append(append([]string{}, srv.isupport...), "are supported by this server")...)
+	if len(srv.motd) == 0 {
+		s.Numeric("422", "MOTD File is missing")
+		return
+	}
+	s.Numeric("375", "- "+srv.name+" Message of the day - ")
+	for _, line := range srv.motd {
+		s.Numeric("372", "- "+line)
+	}
+	s.Numeric("376", "End of MOTD command")
+}
+
+func (s *Session) join(name string) {
+	if !isChannel(name) {
+		s.Numeric("403", name, "No such channel")
+		return
+	}
+	srv := s.server
+	srv.Lock()
+	ch, ok := srv.channels[lower(name)]
+	if !ok {
+		ch = &channel{name: name, modes: "+nt", members: make(map[string]*Session)}
+		srv.channels[lower(name)] = ch
+	}
+	_, already := ch.members[lower(s.Nick())]
+	ch.members[lower(s.Nick())] = s
+	topic := ch.topic
+	name = ch.name
+	srv.Unlock()
+	if already {
+		return
+	}
+	s.Lock()
+	realname := s.realname
+	s.Unlock()
+	for _, member := range srv.members(name) {
+		if member.HasCap("extended-join") {
+			member.Send(s.userLine("JOIN", name, "*", realname))
+		} else {
+			member.Send(s.userLine("JOIN", name))
+		}
+	}
+	if topic != "" {
+		s.Numeric("332", name, topic)
+	}
+	s.names(name)
+}
+
+func (s *Session) part(name string, reason string) {
+	members := s.server.members(name)
+	if members == nil {
+		s.Numeric("403", name, "No such channel")
+		return
+	}
+	joined := false
+	for _, member := range members {
+		joined = joined || member == s
+	}
+	if !joined {
+		s.Numeric("442", name, "You're not on that channel")
+		return
+	}
+	line := s.userLine("PART", name)
+	if reason != "" {
+		line = s.userLine("PART", name, reason)
+	}
+	for _, member := range members {
+		member.Send(line)
+	}
+	srv := s.server
+	srv.Lock()
+	if ch, ok := srv.channels[lower(name)]; ok {
+		delete(ch.members, lower(s.Nick()))
+		if len(ch.members) == 0 {
+			delete(srv.channels, lower(name))
+		}
+	}
+	srv.Unlock()
+}
+
+func (s *Session) names(name string) {
+	var nicks []string
+	for _, member := range s.server.members(name) {
+		nicks = append(nicks, member.Nick())
+	}
+	if len(nicks) > 0 {
+		s.Numeric("353", "=", name, strings.Join(nicks, " "))
+	}
+	s.Numeric("366", name, "End of NAMES list")
+}
+
+func (s *Session) topic(line Line) {
+	name := line.Param(0)
+	srv := s.server
+	srv.Lock()
+	ch, ok := srv.channels[lower(name)]
+	if !ok {
+		srv.Unlock()
+		s.Numeric("403", name, "No such channel")
+		return
+	}
+	if len(line.Params) < 2 {
+		topic := ch.topic
+		srv.Unlock()
+		if topic == "" {
+			s.Numeric("331", name, "No topic is set")
+			return
+		}
+		s.Numeric("332", name, topic)
+		return
+	}
+	ch.topic = line.Param(1)
+	srv.Unlock()
+	for _, member := range srv.members(name) {
+		member.Send(s.userLine("TOPIC", name, line.Param(1)))
+	}
+}
+
+func (s *Session) mode(line Line) {
+	target := line.Param(0)
+	if !isChannel(target) {
+		if len(line.Params) < 2 {
+			s.Numeric("221", "+i")
+			return
+		}
+		s.Send(s.server.format(s.Nick(), "MODE", []string{s.Nick(), line.Param(1)}))
+		return
+	}
+	srv := s.server
+	srv.Lock()
+	ch, ok := srv.channels[lower(target)]
+	var modes string
+	if ok {
+		modes = ch.modes
+		if len(line.Params) > 1 {
+			ch.modes = line.Param(1)
+		}
+	}
+	srv.Unlock()
+	if !ok {
+		s.Numeric("403", target, "No such channel")
+		return
+	}
+	if len(line.Params) < 2 {
+		s.Numeric("324", target, modes)
+		return
+	}
+	for _, member := range srv.members(target) {
+		member.Send(s.userLine("MODE", line.Params...))
+	}
+}
+
+func (s *Session) whois(nick string) {
+	other := s.server.findSession(nick)
+	if other == nil {
+		s.Numeric("401", nick, "No such nick/channel")
+		s.Numeric("318", nick, "End of WHOIS list")
+		return
+	}
+	other.Lock()
+	user, realname := other.user, other.realname
+	other.Unlock()
+	nick = other.Nick()
+	s.Numeric("311", nick, "~"+user, "ircfwtest", "*", realname)
+	if channels := s.server.channelsOf(other); len(channels) > 0 {
+		s.Numeric("319", nick, strings.Join(channels, " "))
+	}
+	s.Numeric("312", nick, s.server.name, "ircfwtest fake server")
+	s.Numeric("318", nick, "End of WHOIS list")
+}
+
+// Routes PRIVMSG, NOTICE and TAGMSG, client-only tags are relayed
+func (s *Session) message(line Line) {
+	target := line.Param(0)
+	params := append([]string{}, line.Params...)
+	out := s.userLine(line.Command, params...)
+	if tags := clientTags(line); tags != "" {
+		out = "@" + tags + " " + out
+	}
+	var recipients []*Session
+	if isChannel(target) {
+		recipients = s.server.members(target)
+		if recipients == nil {
+			s.Numeric("403", target, "No such channel")
+			return
+		}
+	} else if other := s.server.findSession(target); other == s {
+		// message to self arrives once, echoed or not
+		s.Send(out)
+		return
+	} else if other != nil {
+		recipients = []*Session{other, s}
+	} else {
+		s.Numeric("401", target, "No such nick/channel")
+		return
+	}
+	echo := s.HasCap("echo-message")
+	for _, recipient := range recipients {
+		if recipient != s || echo {
+			recipient.Send(out)
+		}
+	}
+}
+
+func clientTags(line Line) string {
+	var tags []string
+	for key, value := range line.Tags {
+		if strings.HasPrefix(key, "+") {
+			if value != "" {
+				key += "=" + value
+			}
+			tags = append(tags, key)
+		}
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, ";")
+}
@@ -0,0 +1,353 @@
+package ircfwtest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Direction of transcript line
+type Direction string
+
+const (
+	// line sent by server and read by client
+	FromServer Direction = "<"
+	// line written by client
+	FromClient Direction = ">"
+)
+
+// Placeholder of credentials hidden by RedactCredentials, client lines
+// of transcript match on replay up to it
+const Redacted = "<redacted>"
+
+var ErrMismatch = errors.New("client output differs from transcript")
+
+// SASL mechanisms named in AUTHENTICATE, other parameters are payloads
+var saslMechanisms = map[string]bool{
+	"PLAIN": true, "EXTERNAL": true, "SCRAM-SHA-1": true, "SCRAM-SHA-256": true,
+	"SCRAM-SHA-512": true, "ECDSA-NIST256P-CHALLENGE": true, "+": true, "*": true,
+}
+
+// NickServ commands taking passwords
+var nickservCommands = map[string]bool{
+	"IDENTIFY": true, "REGISTER": true, "GHOST": true, "RECOVER": true, "REGAIN": true, "RELEASE": true,
+}
+
+// Single line of transcript:
+// 2024-01-02T15:04:05.000000000Z > PRIVMSG #chan :text
+type Entry struct {
+	Time time.Time
+	Dir  Direction
+	Line string
+}
+
+func (e Entry) String() string {
+	return e.Time.UTC().Format(time.RFC3339Nano) + " " + string(e.Dir) + " " + e.Line
+}
+
+// Parses transcript written by Recorder, empty lines are skipped
+func ReadTranscript(r io.Reader) (entries []Entry, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 16384), 16384)
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		if text == "" {
+			continue
+		}
+		stamp, rest := cut(text, " ")
+		dir, line := cut(rest, " ")
+		t, err := time.Parse(time.RFC3339Nano, stamp)
+		if err != nil || (Direction(dir) != FromServer && Direction(dir) != FromClient) {
+			return nil, fmt.Errorf("transcript line %d: malformed %q", n, text)
+		}
+		entries = append(entries, Entry{Time: t, Dir: Direction(dir), Line: line})
+	}
+	return entries, scanner.Err()
+}
+
+// Splits stream into lines, keeping incomplete tail for the next chunk
+type lineSplitter struct {
+	buf []byte
+}
+
+func (s *lineSplitter) feed(b []byte) (lines []string) {
+	s.buf = append(s.buf, b...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			return
+		}
+		line := strings.TrimRight(string(s.buf[:i]), "\r")
+		s.buf = s.buf[i+1:]
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+}
+
+// Rewrites line before it is recorded, empty result drops the line
+type LineFilter func(dir Direction, line string) string
+
+// Default filter of Recorder hiding passwords sent by client with PASS,
+// OPER, AUTHENTICATE and NickServ commands like IDENTIFY
+func RedactCredentials(dir Direction, line string) string {
+	if dir != FromClient {
+		return line
+	}
+	head, rest := splitSource(line)
+	parsed := ParseLine(rest)
+	keep := -1
+	switch parsed.Command {
+	case "PASS":
+		keep = 0
+	case "OPER":
+		keep = 1
+	case "AUTHENTICATE":
+		if !saslMechanisms[strings.ToUpper(parsed.Param(0))] {
+			keep = 0
+		}
+	case "NICKSERV", "NS":
+		if nickservCommands[strings.ToUpper(parsed.Param(0))] {
+			keep = 1
+		}
+	case "PRIVMSG":
+		target, _ := cut(strings.ToLower(parsed.Param(0)), "@")
+		word, _ := cut(parsed.Param(1), " ")
+		if target == "nickserv" && nickservCommands[strings.ToUpper(word)] {
+			return head + "PRIVMSG " + parsed.Param(0) + " :" + word + " " + Redacted
+		}
+	}
+	if keep < 0 || len(parsed.Params) <= keep {
+		return line
+	}
+	return head + strings.Join(append([]string{parsed.Command}, parsed.Params[:keep]...), " ") + " " + Redacted
+}
+
+// Splits tags and prefix off the raw line
+func splitSource(line string) (head string, rest string) {
+	rest = line
+	for _, mark := range []byte{'@', ':'} {
+		if strings.HasPrefix(rest, string(mark)) {
+			token, tail := cut(rest, " ")
+			head += token + " "
+			rest = strings.TrimLeft(tail, " ")
+		}
+	}
+	return
+}
+
+// net.Conn wrapper writing timestamped direction-tagged transcript of
+// everything client reads and writes, meant to wrap production socket
+// so that incidents can be replayed with Replayer
+type Recorder struct {
+	net.Conn
+	sync.Mutex
+	w             io.Writer
+	filter        LineFilter
+	read, written lineSplitter
+	err           error
+}
+
+// Credentials are redacted from transcript, see SetFilter
+func NewRecorder(conn net.Conn, w io.Writer) *Recorder {
+	return &Recorder{Conn: conn, w: w, filter: RedactCredentials}
+}
+
+// Replaces RedactCredentials with filter, nil records lines as is
+func (r *Recorder) SetFilter(filter LineFilter) {
+	r.Lock()
+	defer r.Unlock()
+	r.filter = filter
+}
+
+func (r *Recorder) record(dir Direction, splitter *lineSplitter, b []byte) {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	for _, line := range splitter.feed(b) {
+		if r.err != nil {
+			return
+		}
+		if r.filter != nil {
+			if line = r.filter(dir, line); line == "" {
+				continue
+			}
+		}
+		_, r.err = io.WriteString(r.w, Entry{Time: now, Dir: dir, Line: line}.String()+"\n")
+	}
+}
+
+func (r *Recorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.record(FromServer, &r.read, b[:n])
+	return n, err
+}
+
+// Lines are recorded before writing as server may answer them before
+// Write returns
+func (r *Recorder) Write(b []byte) (int, error) {
+	r.record(FromClient, &r.written, b)
+	return r.Conn.Write(b)
+}
+
+// State of wrapped TLS connection, zero for plaintext one
+func (r *Recorder) ConnectionState() tls.ConnectionState {
+	if conn, ok := r.Conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return conn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// First error of writing transcript
+func (r *Recorder) Err() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.err
+}
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
+
+// Server line of transcript and number of client lines recorded before it
+type replayLine struct {
+	line  string
+	after int
+}
+
+// net.Conn feeding server lines of transcript to client. Every server line
+// is delivered only after client wrote as many lines as were recorded
+// before it; client lines are compared with the transcript in order
+type Replayer struct {
+	sync.Mutex
+	cond    *sync.Cond
+	server  []replayLine
+	client  []string
+	served  int
+	written int
+	ignore  map[string]bool
+	split   lineSplitter
+	pending []byte
+	errs    []error
+	closed  bool
+}
+
+// Commands like PING depend on timing and may be ignored in both directions
+func NewReplayer(entries []Entry, ignore ...string) *Replayer {
+	r := &Replayer{ignore: make(map[string]bool)}
+	for _, cmd := range ignore {
+		r.ignore[strings.ToUpper(cmd)] = true
+	}
+	for _, entry := range entries {
+		switch {
+		case r.ignored(entry.Line):
+		case entry.Dir == FromClient:
+			r.client = append(r.client, entry.Line)
+		default:
+			r.server = append(r.server, replayLine{line: entry.Line, after: len(r.client)})
+		}
+	}
+	r.cond = sync.NewCond(&r.Mutex)
+	return r
+}
+
+func (r *Replayer) ignored(line string) bool {
+	return r.ignore[ParseLine(line).Command]
+}
+
+func (r *Replayer) Read(b []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	for len(r.pending) == 0 {
+		for !r.closed && r.served < len(r.server) && r.written < r.server[r.served].after {
+			r.cond.Wait()
+		}
+		if r.closed || r.served >= len(r.server) {
+			return 0, io.EOF
+		}
+		r.pending = []byte(r.server[r.served].line + "\r\n")
+		r.served++
+	}
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *Replayer) Write(b []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		return 0, net.ErrClosed
+	}
+	for _, line := range r.split.feed(b) {
+		if r.ignored(line) {
+			continue
+		}
+		if r.written >= len(r.client) {
+			r.errs = append(r.errs, fmt.Errorf("%w: unexpected %q", ErrMismatch, line))
+			continue
+		}
+		if expected := r.client[r.written]; !matchLine(expected, line) {
+			r.errs = append(r.errs, fmt.Errorf("%w: expected %q, got %q", ErrMismatch, expected, line))
+		}
+		r.written++
+	}
+	r.cond.Broadcast()
+	return len(b), nil
+}
+
+// Compares client line with transcript one, redacted part matches anything
+func matchLine(expected string, line string) bool {
+	if i := strings.Index(expected, Redacted); i >= 0 {
+		return strings.HasPrefix(line, expected[:i])
+	}
+	return expected == line
+}
+
+// Mismatches between client output and transcript
+func (r *Replayer) Errs() []error {
+	r.Lock()
+	defer r.Unlock()
+	return append([]error{}, r.errs...)
+}
+
+// Reports whether the whole transcript was replayed
+func (r *Replayer) Done() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.served >= len(r.server) && r.written >= len(r.client)
+}
+
+// Waits until transcript is replayed, returns false on timeout
+func (r *Replayer) Wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !r.Done() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func (r *Replayer) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+	return nil
+}
+
+func (r *Replayer) LocalAddr() net.Addr                { return replayAddr{} }
+func (r *Replayer) RemoteAddr() net.Addr               { return replayAddr{} }
+func (r *Replayer) SetDeadline(t time.Time) error      { return nil }
+func (r *Replayer) SetReadDeadline(t time.Time) error  { return nil }
+func (r *Replayer) SetWriteDeadline(t time.Time) error { return nil }
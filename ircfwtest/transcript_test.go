@@ -0,0 +1,118 @@
+package ircfwtest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func session(t *testing.T, c *testClient, topic string) {
+	c.send("NICK alice")
+	c.send("USER alice 0 * :alice")
+	c.expect("376")
+	c.send("JOIN #test")
+	c.expect("366")
+	c.send("TOPIC #test :" + topic)
+	c.expect("TOPIC")
+	c.send("QUIT :bye")
+	c.expect("ERROR")
+}
+
+func TestRecordReplay(t *testing.T) {
+	server := New()
+	defer server.Close()
+	var transcript bytes.Buffer
+	recorder := NewRecorder(server.Conn(), &transcript)
+	session(t, &testClient{t: t, conn: recorder, reader: bufio.NewReader(recorder)}, "recorded")
+	if recorder.Err() != nil {
+		t.Fatal(recorder.Err())
+	}
+	entries, err := ReadTranscript(strings.NewReader(transcript.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || entries[0] != (Entry{Time: entries[0].Time, Dir: FromClient, Line: "NICK alice"}) {
+		t.Fatalf("unexpected transcript %q", transcript.String())
+	}
+
+	replayer := NewReplayer(entries)
+	session(t, &testClient{t: t, conn: replayer, reader: bufio.NewReader(replayer)}, "recorded")
+	if !replayer.Wait(time.Second) {
+		t.Error("transcript was not replayed")
+	}
+	if errs := replayer.Errs(); len(errs) > 0 {
+		t.Errorf("unexpected mismatches %v", errs)
+	}
+
+	replayer = NewReplayer(entries)
+	session(t, &testClient{t: t, conn: replayer, reader: bufio.NewReader(replayer)}, "changed")
+	errs := replayer.Errs()
+	if len(errs) != 1 || !errors.Is(errs[0], ErrMismatch) {
+		t.Errorf("expected a mismatch, got %v", errs)
+	}
+}
+
+func TestReadTranscript(t *testing.T) {
+	if _, err := ReadTranscript(strings.NewReader("yesterday > NICK alice\n")); err == nil {
+		t.Error("malformed timestamp accepted")
+	}
+	entries, err := ReadTranscript(strings.NewReader("2024-01-02T15:04:05.5Z < :irc PING :x\n\n2024-01-02T15:04:06Z > PONG :x\n"))
+	if err != nil || len(entries) != 2 || entries[0].Dir != FromServer || entries[1].Line != "PONG :x" {
+		t.Errorf("unexpected %v %v", entries, err)
+	}
+	replayer := NewReplayer(entries, "ping", "PONG")
+	if !replayer.Done() {
+		t.Error("ignored commands are replayed")
+	}
+}
+
+func TestRedactCredentials(t *testing.T) {
+	for line, expected := range map[string]string{
+		"PASS :secret":                            "PASS " + Redacted,
+		"@label=1 OPER admin secret":              "@label=1 OPER admin " + Redacted,
+		"AUTHENTICATE PLAIN":                      "AUTHENTICATE PLAIN",
+		"AUTHENTICATE +":                          "AUTHENTICATE +",
+		"AUTHENTICATE YWxpY2UAYWxpY2UAc2VjcmV0":   "AUTHENTICATE " + Redacted,
+		"PRIVMSG NickServ :identify secret":       "PRIVMSG NickServ :identify " + Redacted,
+		"PRIVMSG nickserv@services :GHOST a pass": "PRIVMSG nickserv@services :GHOST " + Redacted,
+		"NS IDENTIFY alice secret":                "NS IDENTIFY " + Redacted,
+		"PRIVMSG NickServ :info alice":            "PRIVMSG NickServ :info alice",
+		"PRIVMSG #test :identify secret":          "PRIVMSG #test :identify secret",
+	} {
+		if got := RedactCredentials(FromClient, line); got != expected {
+			t.Errorf("%q redacted to %q", line, got)
+		}
+	}
+	if got := RedactCredentials(FromServer, "PASS :secret"); got != "PASS :secret" {
+		t.Errorf("server line redacted to %q", got)
+	}
+
+	server := New()
+	defer server.Close()
+	var transcript bytes.Buffer
+	recorder := NewRecorder(server.Conn(), &transcript)
+	login := func(c *testClient) {
+		c.send("PASS :secret")
+		c.send("NICK alice")
+		c.send("USER alice 0 * :alice")
+		c.send("PRIVMSG NickServ :identify secret")
+		c.send("QUIT :bye")
+		c.expect("ERROR")
+	}
+	login(&testClient{t: t, conn: recorder, reader: bufio.NewReader(recorder)})
+	if strings.Contains(transcript.String(), "secret") {
+		t.Fatalf("credentials were recorded: %q", transcript.String())
+	}
+	entries, err := ReadTranscript(strings.NewReader(transcript.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayer := NewReplayer(entries)
+	login(&testClient{t: t, conn: replayer, reader: bufio.NewReader(replayer)})
+	if errs := replayer.Errs(); len(errs) > 0 {
+		t.Errorf("redacted lines do not match: %v", errs)
+	}
+}
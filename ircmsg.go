@@ -11,11 +11,30 @@ type ircMsg struct {
 	time     time.Time
 	deadline time.Time
 	prefix   string
-	text     []string
+	// cmd and target override PRIVMSG to channel
+	cmd, target string
+	text        []string
+	msgid       string
+	historical  bool
+	// client-only tags attached to outbound messages
+	tags map[string]string
+	// set when echo of the message is awaited
+	delivery *delivery
 	channel  *Channel
 	client   *Client
 }
 
+// Calculate allowed text len for cmd sent to target
+func msgLimit(prefix string, cmd string, target string) int {
+	// IRC message structure:
+	// :prefix CMD target :text with spaces\r\n
+	limit := MAXMSGSIZE - 1 - len(prefix) - len(cmd) - 2 - len(target) - 4
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
 func NewIRCMsg(text []string, channel *Channel, client *Client) Msg {
 	return ircMsg{
 		time:     time.Now(),
@@ -30,6 +49,14 @@ func (m ircMsg) Time() time.Time {
 	return m.time
 }
 
+func (m ircMsg) MsgID() string {
+	return m.msgid
+}
+
+func (m ircMsg) IsHistorical() bool {
+	return m.historical
+}
+
 func (m ircMsg) Nick() string {
 	return strings.Split(m.prefix, "!")[0]
 }
@@ -46,15 +73,28 @@ func (m ircMsg) Client() *Client {
 	return m.client
 }
 
+func (m ircMsg) limit() int {
+	if m.target == "" {
+		return m.Channel().MsgLimit()
+	}
+	return msgLimit(m.client.Prefix(), m.command(), m.target)
+}
+
+func (m ircMsg) command() string {
+	if m.cmd == "" {
+		return "PRIVMSG"
+	}
+	return m.cmd
+}
+
 func (m ircMsg) WrappedText() []string {
-	lenLimit := m.Channel().MsgLimit()
-	textLength := textLen(m.Text())
-	if textLength <= lenLimit {
+	lenLimit := m.limit()
+	if textLen(m.Text(), m.client.encodedLen) <= lenLimit {
 		return m.Text()
 	}
 	result := make([]string, 0, len(m.Text()))
 	for _, line := range m.Text() {
-		result = append(result, splitByLen(line, lenLimit, 0)...)
+		result = append(result, splitByLen(line, lenLimit, m.client.encodedLen)...)
 	}
 	return result
 }
@@ -64,49 +104,100 @@ func (m ircMsg) Text() []string {
 }
 
 func (m ircMsg) Logf(format string, params ...interface{}) {
-	m.channel.Logf(format, params...)
+	m.client.Logf(format, params...)
 }
 
 func (m ircMsg) Debug(format string, params ...interface{}) {
-	m.channel.Debug(format, params...)
+	m.client.Debug(format, params...)
 }
 
 func (m ircMsg) IsPrivate() bool {
-	return m.channel.name == ""
+	if m.channel == nil {
+		return isNick(m.target)
+	}
+	return m.channel.Peer() != ""
 }
 
-func (m ircMsg) Reply(ctx context.Context, text []string) {
-	deadline, ok := ctx.Deadline()
-	if !ok {
-		deadline = time.Time{}
-	}
+func (m ircMsg) reply(ctx context.Context, text []string) ircMsg {
+	deadline, _ := ctx.Deadline()
 	msg := ircMsg{
 		time:     time.Now(),
 		deadline: deadline,
-		prefix:   m.Prefix(),
+		prefix:   m.client.Prefix(),
 		text:     text,
 		channel:  m.channel,
 		client:   m.client,
 	}
-	select {
-	case <-ctx.Done():
-		m.Logf("reply timed out: %#v", msg)
+	if m.msgid != "" && m.client.HasCap(MessageTagsCap) {
+		msg.tags = map[string]string{ReplyTag: m.msgid}
+	}
+	return msg
+}
+
+func (m ircMsg) Reply(ctx context.Context, text []string) error {
+	if err := validateText(text); err != nil {
+		return invalid("text", err)
+	}
+	return m.channel.post(ctx, m.reply(ctx, text))
+}
+
+func (m ircMsg) ReplyConfirmed(ctx context.Context, text []string) ([]Msg, error) {
+	if err := validateText(text); err != nil {
+		return nil, invalid("text", err)
+	}
+	return m.channel.deliver(ctx, m.reply(ctx, text))
+}
+
+func (m ircMsg) Typing() {
+	if m.channel == nil || m.historical {
 		return
-	case m.channel.send <- msg:
 	}
+	m.channel.Typing(m.client.tomb.Context(nil))
+}
+
+// Target of replies: channel name or nick of query peer
+func (m ircMsg) replyTarget() string {
+	if m.channel == nil {
+		return m.target
+	}
+	return m.channel.Name()
+}
+
+func (m ircMsg) React(ctx context.Context, emoji string) error {
+	if m.msgid == "" {
+		return fmt.Errorf("react: %w", ErrNoMsgID)
+	}
+	return m.client.TagMsg(ctx, m.replyTarget(), map[string]string{
+		ReplyTag: m.msgid,
+		ReactTag: emoji,
+	})
 }
 
 func (m ircMsg) String() string {
-	return fmt.Sprintf("ircfw.ircMsg{time: %q, prefix: %q, channel: %q, client: %q, text %q}", m.time.Format("2006-01-02 15:04:05"), m.prefix, m.channel.name, m.client.name, m.text)
+	return fmt.Sprintf("ircfw.ircMsg{time: %q, prefix: %q, channel: %q, client: %q, text %q}", m.time.Format("2006-01-02 15:04:05"), m.prefix, m.channel, m.client, m.text)
 }
 
 func (m ircMsg) Messages() (messages []message) {
-	chanName := m.channel.Name()
-	if m.IsPrivate() {
-		chanName = m.Nick()
+	chanName := m.target
+	if chanName == "" {
+		chanName = m.channel.Name()
+	}
+	cmd := []byte(m.command())
+	if m.cmd == "TAGMSG" {
+		return []message{newTaggedMessage(m.tags, cmd, [][]byte{[]byte(chanName)}, m.deadline, m.client)}
+	}
+	wrapped := m.WrappedText()
+	if len(wrapped) > 1 && m.client != nil {
+		if limits, ok := m.client.multilineLimits(); ok {
+			// multiline batch has a single target
+			for _, target := range strings.Split(chanName, ",") {
+				messages = append(messages, m.multilineMessages(target, limits)...)
+			}
+			return
+		}
 	}
-	for _, line := range m.WrappedText() {
-		messages = append(messages, newMessage([]byte("PRIVMSG"), [][]byte{[]byte(chanName), []byte(line)}, m.deadline, m.client))
+	for _, line := range wrapped {
+		messages = append(messages, newTaggedMessage(m.tags, cmd, [][]byte{[]byte(chanName), []byte(line)}, m.deadline, m.client))
 	}
 	return
 }
@@ -0,0 +1,301 @@
+package ircfw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	LabeledResponseCap   = "labeled-response"
+	LabeledResponseBatch = "labeled-response"
+)
+
+var (
+	ErrRejected     = errors.New("rejected by server")
+	ErrUncorrelated = errors.New("replies can't be correlated without labeled-response")
+)
+
+// Numerics answering command when labeled-response is missing,
+// reply collection stops at any of end numerics
+type replySpec struct {
+	replies, end []string
+}
+
+var replySpecs = map[string]replySpec{
+	"WHOIS": {
+		replies: []string{"275", "276", "301", "307", "311", "312", "313", "317", "319", "320", "330", "338", "378", "379", "671"},
+		end:     []string{"318", "401", "402", "431"},
+	},
+	"WHOWAS": {
+		replies: []string{"312", "314"},
+		end:     []string{"369", "406", "431"},
+	},
+	"MODE": {
+		replies: []string{"329", "367", "346", "348"},
+		end:     []string{"221", "324", "368", "347", "349", "403", "442", "472", "481", "482", "501", "502"},
+	},
+	"TOPIC": {
+		replies: []string{"332"},
+		end:     []string{"TOPIC", "331", "333", "403", "442", "482"},
+	},
+	"NICK": {
+		end: []string{"NICK", "431", "432", "433", "436", "437", "484"},
+	},
+	"PART": {
+		end: []string{"PART", "403", "442"},
+	},
+	"NAMES": {
+		replies: []string{"353"},
+		end:     []string{"366"},
+	},
+	"WHO": {
+		replies: []string{"352", "354"},
+		end:     []string{"315"},
+	},
+	"LIST": {
+		replies: []string{"321", "322"},
+		end:     []string{"323"},
+	},
+	"PING": {
+		end: []string{"PONG", "409"},
+	},
+}
+
+// Only queries of current modes and of ban, exception and invite lists
+// are answered with numerics, mode changes may get no reply at all
+func isModeQuery(params []string) bool {
+	if len(params) < 2 {
+		return true
+	}
+	if len(params) > 2 {
+		return false
+	}
+	modes := strings.TrimPrefix(params[1], "+")
+	return modes != "" && strings.Trim(modes, "beI") == ""
+}
+
+type request struct {
+	label, cmd, target string
+	spec               replySpec
+	// replies come as batch of this type targeted at target
+	batchType string
+	lines     []Line
+	done      chan []Line
+}
+
+type requests struct {
+	sync.Mutex
+	byLabel map[string]*request
+	// awaiting numeric replies
+	pending []*request
+}
+
+func newRequests() *requests {
+	return &requests{byLabel: make(map[string]*request)}
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *requests) add(req *request) {
+	r.Lock()
+	defer r.Unlock()
+	if req.label != "" {
+		r.byLabel[req.label] = req
+		return
+	}
+	r.pending = append(r.pending, req)
+}
+
+func (r *requests) remove(req *request) {
+	r.Lock()
+	defer r.Unlock()
+	if req.label != "" {
+		delete(r.byLabel, req.label)
+		return
+	}
+	for i, pending := range r.pending {
+		if pending == req {
+			r.pending = append(r.pending[:i], r.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// Completes request labeled with label, returns false if there is none
+func (r *requests) resolve(label string, lines []Line) bool {
+	r.Lock()
+	req, ok := r.byLabel[label]
+	delete(r.byLabel, label)
+	r.Unlock()
+	if !ok {
+		return false
+	}
+	req.done <- lines
+	return true
+}
+
+func (req *request) matches(line Line) bool {
+	if req.batchType != "" {
+		return false
+	}
+	if !contains(req.spec.replies, line.Command) && !contains(req.spec.end, line.Command) {
+		return false
+	}
+	if req.target == "" {
+		return true
+	}
+	for _, param := range line.Params {
+		if strings.EqualFold(param, req.target) {
+			return true
+		}
+	}
+	return false
+}
+
+// FAIL standard reply naming command of the request ends it when
+// the target of the request is among its context parameters
+func (req *request) failedBy(line Line) bool {
+	reply, ok := parseStandardReply(line)
+	if !ok || reply.Type != "FAIL" || !strings.EqualFold(reply.Command, req.cmd) {
+		return false
+	}
+	if req.target == "" {
+		return true
+	}
+	for _, param := range reply.Context {
+		if lowcase(param) == lowcase(req.target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Feeds message to requests awaiting numeric replies
+func (r *requests) observe(msg message) {
+	line := newLine(msg)
+	r.Lock()
+	defer r.Unlock()
+	remaining := r.pending[:0]
+	for _, req := range r.pending {
+		if req.failedBy(line) {
+			req.done <- append(req.lines, line)
+			continue
+		}
+		if !req.matches(line) {
+			remaining = append(remaining, req)
+			continue
+		}
+		req.lines = append(req.lines, line)
+		if contains(req.spec.end, line.Command) {
+			req.done <- req.lines
+			continue
+		}
+		remaining = append(remaining, req)
+	}
+	r.pending = remaining
+}
+
+// Completes request awaiting batch of this type and target
+func (r *requests) resolveBatch(batch *Batch) bool {
+	if len(batch.Params) == 0 {
+		return false
+	}
+	r.Lock()
+	defer r.Unlock()
+	for i, req := range r.pending {
+		if req.batchType == batch.Type && strings.EqualFold(req.target, batch.Params[0]) {
+			r.pending = append(r.pending[:i], r.pending[i+1:]...)
+			req.done <- batchLines(batch)
+			return true
+		}
+	}
+	return false
+}
+
+// Flattens batch into lines of its messages and nested batches
+func batchLines(batch *Batch) []Line {
+	lines := append([]Line{}, batch.Messages...)
+	for _, nested := range batch.Batches {
+		lines = append(lines, batchLines(nested)...)
+	}
+	return lines
+}
+
+// Routes single labeled reply, batched replies are routed once batch completes
+func (c *Client) resolveLabel(msg message) {
+	label, ok := msg.Tag("label")
+	if !ok || msg.Cmd() == "BATCH" {
+		return
+	}
+	var lines []Line
+	if msg.Cmd() != "ACK" {
+		lines = []Line{newLine(msg)}
+	}
+	if !c.requests.resolve(label, lines) {
+		c.Debug("Got reply for unknown label %q", label)
+	}
+}
+
+// First error numeric among replies
+func replyError(lines []Line) error {
+	for _, line := range lines {
+		if reply, ok := parseStandardReply(line); ok && reply.Type == "FAIL" {
+			return reply
+		}
+		if len(line.Command) == 3 && (line.Command[0] == '4' || line.Command[0] == '5') {
+			text := ""
+			if len(line.Params) > 0 {
+				text = line.Params[len(line.Params)-1]
+			}
+			return fmt.Errorf("%w: %s %s", ErrRejected, line.Command, text)
+		}
+	}
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, cmd string, params []string) ([]Line, error) {
+	req := &request{cmd: cmd, done: make(chan []Line, 1)}
+	deadline, _ := ctx.Deadline()
+	var msg message
+	if c.HasCap(LabeledResponseCap) {
+		req.label = c.nextID()
+		msg = newTaggedMessage(map[string]string{"label": req.label}, []byte(cmd), stringsToBytes(params), deadline, c)
+	} else if cmd == "CHATHISTORY" && len(params) > 1 {
+		req.batchType = ChathistoryBatch
+		req.target = params[1]
+		msg = newMessage([]byte(cmd), stringsToBytes(params), deadline, c)
+	} else {
+		spec, ok := replySpecs[cmd]
+		if !ok || cmd == "MODE" && !isModeQuery(params) {
+			return nil, fmt.Errorf("%s: %w", cmd, ErrUncorrelated)
+		}
+		req.spec = spec
+		if len(params) > 0 {
+			req.target = params[0]
+		}
+		msg = newMessage([]byte(cmd), stringsToBytes(params), deadline, c)
+	}
+	c.requests.add(req)
+	defer c.requests.remove(req)
+	if err := c.enqueue(ctx, []message{msg}); err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.tomb.Dying():
+		return nil, ErrClientClosed
+	case lines := <-req.done:
+		return lines, replyError(lines)
+	}
+}
@@ -0,0 +1,84 @@
+package ircfw
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func parseLines(t *testing.T, lines []string) (result []message) {
+	for _, line := range lines {
+		msg, err := parseUTF8Message([]byte(line), time.Time{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, msg)
+	}
+	return
+}
+
+func TestRequestsHeuristics(t *testing.T) {
+	r := newRequests()
+	whois := &request{cmd: "WHOIS", target: "demsh", spec: replySpecs["WHOIS"], done: make(chan []Line, 1)}
+	topic := &request{cmd: "TOPIC", target: "#ircfw-test", spec: replySpecs["TOPIC"], done: make(chan []Line, 1)}
+	r.add(whois)
+	r.add(topic)
+	for _, msg := range parseLines(t, []string{
+		":irc.demsh.org 311 ircfw demsh ~demsh 12a8e790 * :demsh",
+		":irc.demsh.org 332 ircfw #ircfw-test :topic",
+		":irc.demsh.org 311 ircfw other ~other 12a8e790 * :other",
+		":irc.demsh.org 319 ircfw demsh :#ircfw-test",
+		":irc.demsh.org 318 ircfw demsh :End of WHOIS list",
+		":irc.demsh.org 403 ircfw #ircfw-test :No such channel",
+	}) {
+		r.observe(msg)
+	}
+	lines := <-whois.done
+	if len(lines) != 3 || lines[2].Command != "318" {
+		t.Fatalf("bad WHOIS replies: %#v", lines)
+	}
+	lines = <-topic.done
+	if len(lines) != 2 || !errors.Is(replyError(lines), ErrRejected) {
+		t.Fatalf("bad TOPIC replies: %#v", lines)
+	}
+	if len(r.pending) != 0 {
+		t.Fatalf("requests leaked: %#v", r.pending)
+	}
+}
+
+func TestModeRequests(t *testing.T) {
+	for _, params := range [][]string{{"#ircfw-test"}, {"ircfw"}, {"#ircfw-test", "b"}, {"#ircfw-test", "+bI"}} {
+		if !isModeQuery(params) {
+			t.Errorf("%q should be a query", params)
+		}
+	}
+	client := newTestClient(t, nil)
+	for _, params := range [][]string{{"#ircfw-test", "+o", "demsh"}, {"#ircfw-test", "+m"}, {"#ircfw-test", "-b"}, {"ircfw", "+i"}} {
+		if _, err := client.do(context.Background(), "MODE", params); !errors.Is(err, ErrUncorrelated) {
+			t.Errorf("MODE %q: %v", params, err)
+		}
+	}
+}
+
+func TestRequestsLabels(t *testing.T) {
+	r := newRequests()
+	req := &request{label: "ircfw1", cmd: "WHOIS", done: make(chan []Line, 1)}
+	r.add(req)
+	batch := &Batch{Type: LabeledResponseBatch, Tags: map[string]string{"label": "ircfw1"}}
+	for _, msg := range parseLines(t, []string{
+		"@batch=1 :irc.demsh.org 311 ircfw demsh ~demsh 12a8e790 * :demsh",
+		"@batch=1 :irc.demsh.org 318 ircfw demsh :End of WHOIS list",
+	}) {
+		batch.add(msg)
+	}
+	if !r.resolve("ircfw1", batchLines(batch)) {
+		t.Fatalf("label was not resolved")
+	}
+	if lines := <-req.done; len(lines) != 2 {
+		t.Fatalf("bad replies: %#v", lines)
+	}
+	if r.resolve("ircfw1", nil) {
+		t.Fatalf("label resolved twice")
+	}
+}
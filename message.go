@@ -5,13 +5,17 @@ import (
 	"time"
 )
 
-func parseMessage(line []byte, deadline time.Time, client *Client) (msg message, err error) {
+func parseMessage(line []byte, received time.Time, client *Client) (msg message, err error) {
 	if hasNULL(string(line)) {
 		return nil, fmt.Errorf("contains NULL")
 	}
-	return parseUTF8Message(line, deadline, client)
+	return parseUTF8Message(line, received, client)
 }
 
 func newMessage(cmd []byte, params [][]byte, deadline time.Time, client *Client) message {
-	return newUTF8Message(cmd, params, deadline, client)
+	return newUTF8Message(nil, cmd, params, deadline, client)
+}
+
+func newTaggedMessage(tags map[string]string, cmd []byte, params [][]byte, deadline time.Time, client *Client) message {
+	return newUTF8Message(tags, cmd, params, deadline, client)
 }
@@ -0,0 +1,158 @@
+package ircfw
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	MultilineCap    = "draft/multiline"
+	MultilineBatch  = "draft/multiline"
+	MultilineConcat = "draft/multiline-concat"
+)
+
+// https://ircv3.net/specs/extensions/multiline
+type multilineLimits struct {
+	maxBytes, maxLines int
+}
+
+type multilineBatch struct {
+	target string
+	// tags of BATCH itself, e.g. msgid
+	tags  map[string]string
+	first message
+	lines []string
+}
+
+func (c *Client) multilineLimits() (limits multilineLimits, ok bool) {
+	if !c.HasCap(MultilineCap) || !c.HasCap("batch") {
+		return
+	}
+	value, _ := c.capValue(MultilineCap)
+	params := capParams(value)
+	limits.maxBytes, _ = strconv.Atoi(params["max-bytes"])
+	limits.maxLines, _ = strconv.Atoi(params["max-lines"])
+	// max-bytes is mandatory
+	return limits, limits.maxBytes > 0
+}
+
+// Unique reference for batches and labels
+func (c *Client) nextID() string {
+	return "ircfw" + strconv.FormatUint(atomic.AddUint64(&c.lastID, 1), 36)
+}
+
+// Splits line into chunks which concatenate back into the line
+func splitConcat(line string, limit int, size func(string) int) (result []string) {
+	if limit <= 0 {
+		return
+	}
+	for line != "" {
+		cut := fitPrefix(line, limit, size)
+		if cut >= len(line) {
+			return append(result, line)
+		}
+		if cut == 0 {
+			cut = nextUnit(line)
+		} else if i := strings.LastIndex(line[:cut], " "); i > 0 {
+			// keep the space at the end of the chunk
+			cut = i + 1
+		} else {
+			cut = breakPoint(line, cut)
+		}
+		result = append(result, line[:cut])
+		line = line[cut:]
+	}
+	return
+}
+
+// Wraps text into draft/multiline batches, concat chunks are
+// tagged to be glued to the preceding line
+func (m ircMsg) multilineMessages(target string, limits multilineLimits) (messages []message) {
+	type chunk struct {
+		text   string
+		concat bool
+	}
+	var chunks []chunk
+	for _, line := range m.Text() {
+		parts := splitConcat(line, m.limit(), m.client.encodedLen)
+		if len(parts) == 0 {
+			parts = []string{""}
+		}
+		for i, part := range parts {
+			chunks = append(chunks, chunk{part, i > 0})
+		}
+	}
+	cmd := []byte(m.command())
+	var id string
+	lines, size := 0, 0
+	closeBatch := func() {
+		if id != "" {
+			messages = append(messages, newMessage([]byte("BATCH"), stringsToBytes([]string{"-" + id}), m.deadline, m.client))
+		}
+	}
+	for _, chunk := range chunks {
+		chunkSize := m.client.encodedLen(chunk.text) + 1
+		if id == "" || (limits.maxLines > 0 && lines == limits.maxLines) || size+chunkSize > limits.maxBytes {
+			closeBatch()
+			id = m.client.nextID()
+			lines, size = 0, 0
+			chunk.concat = false
+			// client-only tags apply to the whole batch
+			messages = append(messages, newTaggedMessage(m.tags, []byte("BATCH"), stringsToBytes([]string{"+" + id, MultilineBatch, target}), m.deadline, m.client))
+		}
+		tags := map[string]string{"batch": id}
+		if chunk.concat {
+			tags[MultilineConcat] = ""
+		}
+		messages = append(messages, newTaggedMessage(tags, cmd, [][]byte{[]byte(target), []byte(chunk.text)}, m.deadline, m.client))
+		lines++
+		size += chunkSize
+	}
+	closeBatch()
+	return
+}
+
+func (b *multilineBatch) add(msg message) {
+	text := ""
+	if len(msg.Params()) > 1 {
+		text = msg.Params()[1]
+	}
+	if _, concat := msg.Tag(MultilineConcat); concat && len(b.lines) > 0 {
+		b.lines[len(b.lines)-1] += text
+		return
+	}
+	if b.first == nil {
+		b.first = msg
+	}
+	b.lines = append(b.lines, text)
+}
+
+// Reassembles batch into single message carrying all lines
+func (b *multilineBatch) message() message {
+	first, ok := b.first.(utf8message)
+	if !ok {
+		return nil
+	}
+	tags := make(map[string]string)
+	for key, value := range first.tags {
+		if key != "batch" && key != MultilineConcat {
+			tags[key] = value
+		}
+	}
+	for key, value := range b.tags {
+		if key != "batch" && key != "label" {
+			tags[key] = value
+		}
+	}
+	return utf8message{
+		tags:     tags,
+		prefix:   first.prefix,
+		cmd:      first.cmd,
+		params:   []string{b.target, join(b.lines, "\n")},
+		lines:    b.lines,
+		time:     first.time,
+		deadline: first.deadline,
+		client:   first.client,
+	}
+}
@@ -0,0 +1,100 @@
+package ircfw
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMultilineMessages(t *testing.T) {
+	client := newTestClient(t, map[string]string{"batch": "", MultilineCap: "max-bytes=1024,max-lines=4"})
+	text := []string{"first line", strings.Repeat("long line ", 100), "last line"}
+	msg := ircMsg{cmd: "PRIVMSG", target: "#ircfw-test", text: text, client: client}
+	var batches, lines int
+	var assembled []string
+	for _, message := range msg.Messages() {
+		raw := string(message.Export())
+		if len(raw)-len(exportTags(message.Tags())) > MAXMSGSIZE {
+			t.Fatalf("%q is too long", raw)
+		}
+		switch message.Cmd() {
+		case "BATCH":
+			if strings.HasPrefix(message.Params()[0], "+") {
+				batches++
+				lines = 0
+			}
+		case "PRIVMSG":
+			lines++
+			if lines > 4 {
+				t.Fatalf("batch has more than max-lines messages")
+			}
+			line := message.Params()[1]
+			if _, concat := message.Tag(MultilineConcat); concat {
+				assembled[len(assembled)-1] += line
+			} else {
+				assembled = append(assembled, line)
+			}
+		}
+	}
+	if batches < 2 {
+		t.Fatalf("expected several batches, got %d", batches)
+	}
+	if strings.Join(assembled, "\n") != strings.Join(text, "\n") {
+		t.Fatalf("%q != %q", assembled, text)
+	}
+
+	// without the capability text is sent as plain messages
+	msg.client = newTestClient(t, nil)
+	for _, message := range msg.Messages() {
+		if message.Cmd() != "PRIVMSG" || len(message.Tags()) != 0 {
+			t.Fatalf("unexpected %q", message.Export())
+		}
+	}
+}
+
+func TestMultilineTargets(t *testing.T) {
+	client := newTestClient(t, map[string]string{"batch": "", MultilineCap: "max-bytes=1024"})
+	msg := ircMsg{cmd: "PRIVMSG", target: "#ircfw-test,demsh", text: []string{"first", "second"}, client: client}
+	var targets []string
+	for _, message := range msg.Messages() {
+		params := message.Params()
+		if message.Cmd() == "BATCH" && strings.HasPrefix(params[0], "+") {
+			targets = append(targets, params[2])
+		}
+		if message.Cmd() == "PRIVMSG" && strings.Contains(params[0], ",") {
+			t.Fatalf("batched message to several targets: %q", message.Export())
+		}
+	}
+	if strings.Join(targets, " ") != "#ircfw-test demsh" {
+		t.Fatalf("batches opened for %q", targets)
+	}
+}
+
+func TestMultilineReassembly(t *testing.T) {
+	samples := []string{
+		"@batch=123 :demsh!~demsh@12a8e790 PRIVMSG #ircfw-test :hello",
+		"@batch=123 :demsh!~demsh@12a8e790 PRIVMSG #ircfw-test :multiline ",
+		"@batch=123;draft/multiline-concat :demsh!~demsh@12a8e790 PRIVMSG #ircfw-test :world",
+		"@batch=123 :demsh!~demsh@12a8e790 PRIVMSG #ircfw-test :",
+	}
+	batch := &multilineBatch{target: "#ircfw-test"}
+	for _, sample := range samples {
+		msg, err := parseUTF8Message([]byte(sample), time.Time{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch.add(msg)
+	}
+	msg := batch.message()
+	if msg.Nick() != "demsh" || msg.Cmd() != "PRIVMSG" {
+		t.Fatalf("bad reassembly: %#v", msg)
+	}
+	if _, ok := msg.Tag("batch"); ok {
+		t.Fatalf("batch tag leaked: %#v", msg.Tags())
+	}
+	valid := []string{"hello", "multiline world", ""}
+	lines := msg.(utf8message).lines
+	if strings.Join(lines, "\n") != strings.Join(valid, "\n") {
+		t.Fatalf("%q != %q", lines, valid)
+	}
+}
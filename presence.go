@@ -0,0 +1,303 @@
+package ircfw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+const (
+	presenceMonitor = "MONITOR"
+	presenceWatch   = "WATCH"
+	presenceISON    = "ISON"
+	// how often ISON is polled when neither MONITOR nor WATCH is available
+	isonInterval = time.Minute
+)
+
+var ErrMonitorFull = errors.New("monitor list is full")
+
+// Called in separate goroutine whenever monitored nick goes online or offline,
+// quick changes may be reported out of order, IsOnline has the latest state
+type PresenceHandler func(nick string, online bool)
+
+type presenceState struct {
+	sync.Mutex
+	// monitored nicks as given by user, keyed by lowercase nick
+	watched map[string]string
+	online  map[string]bool
+	// nicks of ISON queries awaiting replies in order of sending
+	isonPending [][]string
+	// closed to stop ISON polling, nil if not polling
+	stopPolling chan struct{}
+}
+
+func newPresenceState() *presenceState {
+	return &presenceState{
+		watched: make(map[string]string),
+		online:  make(map[string]bool),
+	}
+}
+
+// Best mechanism advertised by server and its target limit, 0 means no limit
+func (c *Client) presenceMode() (string, int) {
+	c.Lock()
+	defer c.Unlock()
+	for _, mode := range []string{presenceMonitor, presenceWatch} {
+		if value, ok := c.params[mode]; ok {
+			limit, _ := strconv.Atoi(value)
+			return mode, limit
+		}
+	}
+	return presenceISON, 0
+}
+
+// Groups nicks into commands which fit message size limit
+func presenceCommands(cmd string, first string, nicks []string, sep string) (commands [][]string) {
+	limit := MAXMSGSIZE - len(cmd) - len(first) - 4
+	var group []string
+	size := 0
+	for _, nick := range nicks {
+		if len(group) > 0 && size+len(sep)+len(nick) > limit {
+			commands = append(commands, group)
+			group, size = nil, 0
+		}
+		group = append(group, nick)
+		size += len(sep) + len(nick)
+	}
+	if len(group) > 0 {
+		commands = append(commands, group)
+	}
+	return
+}
+
+func (c *Client) sendPresence(ctx context.Context, mode string, add bool, nicks []string) error {
+	deadline, _ := ctx.Deadline()
+	sign := "-"
+	if add {
+		sign = "+"
+	}
+	var messages []message
+	switch mode {
+	case presenceMonitor:
+		for _, group := range presenceCommands(mode, sign, nicks, ",") {
+			messages = append(messages, newMessage([]byte(mode), stringsToBytes([]string{sign, join(group, ",")}), deadline, c))
+		}
+	case presenceWatch:
+		var signed []string
+		for _, nick := range nicks {
+			signed = append(signed, sign+nick)
+		}
+		for _, group := range presenceCommands(mode, "", signed, " ") {
+			messages = append(messages, newMessage([]byte(mode), stringsToBytes(group), deadline, c))
+		}
+	}
+	return c.enqueue(ctx, messages)
+}
+
+// Starts tracking presence of nicks with MONITOR, WATCH or ISON polling,
+// whichever server supports
+func (c *Client) Monitor(ctx context.Context, nicks ...string) error {
+	for _, nick := range nicks {
+		if err := validateNick(nick, c.nickLen()); err != nil {
+			return invalid(fmt.Sprintf("nick %q", nick), err)
+		}
+	}
+	// mechanism is known once ISUPPORT is received
+	if err := c.awaitStarted(ctx); err != nil {
+		return err
+	}
+	mode, limit := c.presenceMode()
+	p := c.presence
+	p.Lock()
+	var added []string
+	for _, nick := range nicks {
+		if _, ok := p.watched[lowcase(nick)]; !ok {
+			added = append(added, nick)
+		}
+	}
+	if limit > 0 && len(p.watched)+len(added) > limit {
+		p.Unlock()
+		return fmt.Errorf("%s limit %d: %w", mode, limit, ErrMonitorFull)
+	}
+	for _, nick := range added {
+		p.watched[lowcase(nick)] = nick
+	}
+	var stop chan struct{}
+	if mode == presenceISON && p.stopPolling == nil && len(added) > 0 {
+		stop = make(chan struct{})
+		p.stopPolling = stop
+	}
+	p.Unlock()
+	if stop != nil {
+		c.tomb.Go(func() error {
+			return c.isonLoop(stop)
+		})
+	}
+	if len(added) == 0 || mode == presenceISON {
+		return nil
+	}
+	return c.sendPresence(ctx, mode, true, added)
+}
+
+// Stops tracking presence of nicks
+func (c *Client) Unmonitor(ctx context.Context, nicks ...string) error {
+	mode, _ := c.presenceMode()
+	p := c.presence
+	p.Lock()
+	var removed []string
+	for _, nick := range nicks {
+		if _, ok := p.watched[lowcase(nick)]; ok {
+			delete(p.watched, lowcase(nick))
+			delete(p.online, lowcase(nick))
+			removed = append(removed, nick)
+		}
+	}
+	if len(p.watched) == 0 && p.stopPolling != nil {
+		close(p.stopPolling)
+		p.stopPolling = nil
+	}
+	p.Unlock()
+	if len(removed) == 0 || mode == presenceISON {
+		return nil
+	}
+	return c.sendPresence(ctx, mode, false, removed)
+}
+
+// Reports whether monitored nick is online, known is false until server tells
+func (c *Client) IsOnline(nick string) (online bool, known bool) {
+	c.presence.Lock()
+	defer c.presence.Unlock()
+	online, known = c.presence.online[lowcase(nick)]
+	return
+}
+
+// Records presence of monitored nick and notifies handlers on change
+func (c *Client) setPresence(nick string, online bool) {
+	p := c.presence
+	p.Lock()
+	key := lowcase(nick)
+	if _, ok := p.watched[key]; !ok {
+		p.Unlock()
+		return
+	}
+	previous, known := p.online[key]
+	p.online[key] = online
+	p.Unlock()
+	if known && previous == online {
+		return
+	}
+	for _, handler := range c.presenceHandlers {
+		go handler(nick, online)
+	}
+}
+
+// meant to run in separate goroutine, stops when nothing is monitored
+func (c *Client) isonLoop(stop chan struct{}) error {
+	ticker := time.NewTicker(isonInterval)
+	defer ticker.Stop()
+	for {
+		c.pollISON()
+		select {
+		case <-c.tomb.Dying():
+			c.Debug("isonLoop dying")
+			return tomb.ErrDying
+		case <-stop:
+			c.Debug("isonLoop stopped")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Client) pollISON() {
+	p := c.presence
+	p.Lock()
+	// replies are matched to queries in order, so lock is held until
+	// the query is queued to keep the order of isonPending
+	defer p.Unlock()
+	nicks := make([]string, 0, len(p.watched))
+	for _, nick := range p.watched {
+		nicks = append(nicks, nick)
+	}
+	ctx, cancel := context.WithTimeout(c.tomb.Context(nil), time.Second)
+	defer cancel()
+	for _, group := range presenceCommands(presenceISON, "", nicks, " ") {
+		msg := newMessage([]byte(presenceISON), stringsToBytes([]string{join(group, " ")}), time.Time{}, c)
+		if err := c.enqueue(ctx, []message{msg}); err != nil {
+			c.Debug("ISON poll failed: %s", err)
+			return
+		}
+		p.isonPending = append(p.isonPending, group)
+	}
+}
+
+// RPL_ISON lists online nicks out of the oldest pending query
+func handleISON(msg message) {
+	client := msg.Client()
+	params := msg.Params()
+	p := client.presence
+	p.Lock()
+	if len(p.isonPending) == 0 {
+		p.Unlock()
+		client.Debug("Got unsolicited ISON reply: %#v", msg)
+		return
+	}
+	queried := p.isonPending[0]
+	p.isonPending = p.isonPending[1:]
+	p.Unlock()
+	online := NewSet()
+	if len(params) > 1 {
+		for _, nick := range strings.Fields(params[len(params)-1]) {
+			online.Add(lowcase(nick))
+		}
+	}
+	for _, nick := range queried {
+		client.setPresence(nick, online.Has(lowcase(nick)))
+	}
+}
+
+// RPL_MONONLINE and RPL_MONOFFLINE carry comma-separated nick!user@host list
+func handleMonitor(msg message) {
+	params := msg.Params()
+	if len(params) < 2 {
+		return
+	}
+	online := msg.Cmd() == "730"
+	for _, target := range strings.Split(params[len(params)-1], ",") {
+		if nick, _ := pop(target, "!"); nick != "" {
+			msg.Client().setPresence(nick, online)
+		}
+	}
+}
+
+// ERR_MONLISTFULL: server refused to monitor targets
+func handleMonitorFull(msg message) {
+	params := msg.Params()
+	if len(params) < 3 {
+		return
+	}
+	client := msg.Client()
+	client.Logf("MONITOR list is full, dropping %q", params[2])
+	client.presence.Lock()
+	defer client.presence.Unlock()
+	for _, nick := range strings.Split(params[2], ",") {
+		delete(client.presence.watched, lowcase(nick))
+		delete(client.presence.online, lowcase(nick))
+	}
+}
+
+// RPL_LOGON, RPL_NOWON, RPL_LOGOFF and RPL_NOWOFF of WATCH
+func handleWatch(msg message) {
+	params := msg.Params()
+	if len(params) < 2 {
+		return
+	}
+	online := msg.Cmd() == "600" || msg.Cmd() == "604"
+	msg.Client().setPresence(params[1], online)
+}
@@ -0,0 +1,172 @@
+package ircfw
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type presenceEvent struct {
+	nick   string
+	online bool
+}
+
+// OnPresence option sending events into returned channel
+func presenceEvents() (Option, chan presenceEvent) {
+	events := make(chan presenceEvent, 8)
+	return OnPresence(func(nick string, online bool) {
+		events <- presenceEvent{nick, online}
+	}), events
+}
+
+// Collects n events, handlers run concurrently so order is not preserved
+func collectPresence(t *testing.T, events chan presenceEvent, n int) (got []presenceEvent) {
+	for i := 0; i < n; i++ {
+		select {
+		case event := <-events:
+			got = append(got, event)
+		case <-time.After(time.Second):
+			t.Fatalf("got %d events out of %d", len(got), n)
+		}
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected %#v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return
+}
+
+func TestMonitor(t *testing.T) {
+	onPresence, events := presenceEvents()
+	client := newTestClient(t, nil, onPresence)
+	client.params = map[string]string{"MONITOR": "2"}
+	ctx := context.Background()
+	if err := client.Monitor(ctx, "demsh", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string((<-client.writes).Export()); got != "MONITOR + :demsh,other\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if err := client.Monitor(ctx, "third"); !errors.Is(err, ErrMonitorFull) {
+		t.Errorf("expected ErrMonitorFull, got %v", err)
+	}
+	for _, line := range []string{
+		":irc.demsh.org 730 ircfw :demsh!~demsh@12a8e790",
+		":irc.demsh.org 731 ircfw :other",
+		":irc.demsh.org 730 ircfw :demsh!~demsh@12a8e790",
+	} {
+		msg, _ := parseUTF8Message([]byte(line), time.Now(), client)
+		client.dispatch(msg)
+	}
+	// repeated state is not reported
+	got := collectPresence(t, events, 2)
+	if len(got) == 2 && !((got[0] == presenceEvent{"demsh", true} && got[1] == presenceEvent{"other", false}) ||
+		(got[1] == presenceEvent{"demsh", true} && got[0] == presenceEvent{"other", false})) {
+		t.Errorf("unexpected events %v", got)
+	}
+	msg, _ := parseUTF8Message([]byte(":irc.demsh.org 731 ircfw :demsh"), time.Now(), client)
+	client.dispatch(msg)
+	if got := collectPresence(t, events, 1); got[0] != (presenceEvent{"demsh", false}) {
+		t.Errorf("unexpected events %v", got)
+	}
+	if online, known := client.IsOnline("DEMSH"); online || !known {
+		t.Errorf("IsOnline: %v %v", online, known)
+	}
+	if err := client.Unmonitor(ctx, "demsh"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string((<-client.writes).Export()); got != "MONITOR - :demsh\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	onPresence, events := presenceEvents()
+	client := newTestClient(t, nil, onPresence)
+	client.params = map[string]string{"WATCH": "128"}
+	if err := client.Monitor(context.Background(), "demsh"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string((<-client.writes).Export()); got != "WATCH :+demsh\r\n" {
+		t.Errorf("got %q", got)
+	}
+	msg, _ := parseUTF8Message([]byte(":irc.demsh.org 604 ircfw demsh ~demsh 12a8e790 1700000000 :is online"), time.Now(), client)
+	client.dispatch(msg)
+	if got := collectPresence(t, events, 1); got[0] != (presenceEvent{"demsh", true}) {
+		t.Errorf("unexpected events %v", got)
+	}
+}
+
+func TestISON(t *testing.T) {
+	onPresence, events := presenceEvents()
+	client := newTestClient(t, nil, onPresence)
+	client.presence.watched = map[string]string{"demsh": "demsh", "other": "other"}
+	client.presence.isonPending = [][]string{{"demsh", "other"}}
+	msg, _ := parseUTF8Message([]byte(":irc.demsh.org 303 ircfw :Demsh"), time.Now(), client)
+	client.dispatch(msg)
+	got := map[string]bool{}
+	for _, event := range collectPresence(t, events, 2) {
+		got[event.nick] = event.online
+	}
+	if !got["demsh"] || got["other"] {
+		t.Errorf("unexpected presence %v", got)
+	}
+}
+
+func TestISONPolling(t *testing.T) {
+	client := newTestClient(t, nil)
+	ctx := context.Background()
+	if err := client.Monitor(ctx, "demsh"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string((<-client.writes).Export()); got != "ISON :demsh\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if err := client.Unmonitor(ctx, "demsh"); err != nil {
+		t.Fatal(err)
+	}
+	// isonLoop is the only goroutine of the tomb
+	select {
+	case <-client.tomb.Dead():
+	case <-time.After(time.Second):
+		t.Fatal("isonLoop was not stopped")
+	}
+
+	// queries which were not sent are not awaited
+	client = newTestClient(t, nil)
+	client.presence.watched = map[string]string{"demsh": "demsh"}
+	close(client.closing)
+	client.pollISON()
+	if len(client.presence.isonPending) != 0 {
+		t.Errorf("unsent query is pending: %v", client.presence.isonPending)
+	}
+}
+
+func TestMonitorClosed(t *testing.T) {
+	client := newTestClient(t, nil)
+	client.started = make(chan struct{})
+	client.tomb.Kill(nil)
+	if err := client.Monitor(context.Background(), "demsh"); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("expected ErrClientClosed, got %v", err)
+	}
+}
+
+func TestPresenceCommands(t *testing.T) {
+	var nicks []string
+	for i := 0; i < 100; i++ {
+		nicks = append(nicks, strings.Repeat("n", 29)+string(rune('a'+i%26)))
+	}
+	total := 0
+	for _, group := range presenceCommands("ISON", "", nicks, " ") {
+		if size := len("ISON :" + join(group, " ") + "\r\n"); size > MAXMSGSIZE {
+			t.Errorf("command of %d bytes", size)
+		}
+		total += len(group)
+	}
+	if total != len(nicks) {
+		t.Errorf("%d nicks out of %d", total, len(nicks))
+	}
+}
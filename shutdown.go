@@ -0,0 +1,143 @@
+package ircfw
+
+import (
+	"context"
+	"fmt"
+)
+
+// Outcome of graceful shutdown
+type ShutdownReport struct {
+	// queued lines that were never written to the server
+	Dropped []Line
+	// QUIT was written to the socket
+	QuitSent bool
+	// server answered with ERROR or closed the connection
+	Acknowledged bool
+}
+
+// Stops accepting new messages, writes out already queued ones followed
+// by QUIT, waits for the server to close the link and stops the client.
+// Whatever was not written before ctx expired is reported as dropped.
+func (c *Client) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	return c.shutdown(ctx, "")
+}
+
+func (c *Client) isClosing() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return !c.tomb.Alive()
+	}
+}
+
+func (c *Client) closeServer() {
+	c.Lock()
+	safeClose(c.serverClosed)
+	c.Unlock()
+}
+
+func (c *Client) shutdown(ctx context.Context, reason string) (report ShutdownReport, err error) {
+	c.Lock()
+	if c.isClosing() {
+		c.Unlock()
+		return report, ErrClientClosed
+	}
+	close(c.closing)
+	var channels []*Channel
+	for _, channel := range c.channels {
+		channels = append(channels, channel)
+	}
+	for _, query := range c.queries {
+		channels = append(channels, query)
+	}
+	c.Unlock()
+
+	if err = c.drain(ctx, channels, reason); err == nil {
+		report.QuitSent = true
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-c.serverClosed:
+		case <-c.tomb.Dying():
+			// readLoop closes serverClosed before its error kills the tomb
+		}
+		report.Acknowledged = isDone(c.serverClosed)
+		if err == nil && !report.Acknowledged {
+			err = ErrClientClosed
+		}
+	}
+
+	c.Lock()
+	c.killChannels()
+	c.Unlock()
+	c.killDCC()
+	c.tomb.Kill(fmt.Errorf("user request: %q", reason))
+	c.socket.Close()
+	<-c.tomb.Dead()
+	report.Dropped = c.dropped(channels)
+	return report, err
+}
+
+// Hands queued channel messages to writeLoop, then QUIT, and waits until
+// QUIT is written
+func (c *Client) drain(ctx context.Context, channels []*Channel, reason string) error {
+	for _, channel := range channels {
+		if err := channel.flush(ctx); err != nil {
+			return err
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	quit := newMessage([]byte("QUIT"), [][]byte{[]byte(reason)}, deadline, c)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.tomb.Dying():
+		return ErrClientClosed
+	case c.writes <- quit:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.tomb.Dying():
+		return ErrClientClosed
+	case <-c.quitSent:
+		return nil
+	}
+}
+
+// Lines left in queues once writeLoop has stopped
+func (c *Client) dropped(channels []*Channel) (lines []Line) {
+	for {
+		select {
+		case msg := <-c.writes:
+			lines = append(lines, newLine(msg))
+			continue
+		default:
+		}
+		break
+	}
+	for _, channel := range channels {
+		for {
+			select {
+			case msg := <-channel.send:
+				for _, m := range msg.Messages() {
+					lines = append(lines, newLine(m))
+				}
+				continue
+			default:
+			}
+			break
+		}
+	}
+	return
+}
+
+func isDone(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
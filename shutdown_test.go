@@ -0,0 +1,93 @@
+package ircfw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"gitea.demsh.org/demsh/ircfw/ircfwtest"
+)
+
+func TestShutdown(t *testing.T) {
+	server := ircfwtest.New()
+	defer server.Close()
+	client := newServerClient(t, server, "ircfw")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancel()
+	channel, err := client.Join(ctx, jchannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const lines = 20
+	for i := 0; i < lines; i++ {
+		if err := channel.Say(ctx, fmt.Sprintf("line %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := client.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.QuitSent || !report.Acknowledged || len(report.Dropped) != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if _, err := server.ExpectCommand(timeout*time.Second, "QUIT"); err != nil {
+		t.Fatal(err)
+	}
+	said := 0
+	for _, line := range server.Received() {
+		switch line.Command {
+		case "PRIVMSG":
+			if want := fmt.Sprintf("line %d", said); line.Trailing() != want {
+				t.Errorf("got %q, expected %q", line.Trailing(), want)
+			}
+			said++
+		case "QUIT":
+			if said != lines {
+				t.Errorf("QUIT after %d of %d lines", said, lines)
+			}
+		}
+	}
+	if _, err := client.Shutdown(ctx); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("second shutdown: %v", err)
+	}
+	if err := channel.Say(ctx, "after shutdown"); !errors.Is(err, ErrClientClosed) && !errors.Is(err, ErrNotJoined) {
+		t.Errorf("say after shutdown: %v", err)
+	}
+}
+
+func TestShutdownStalled(t *testing.T) {
+	local, remote := net.Pipe()
+	// remote end never reads, so nothing can be written
+	defer remote.Close()
+	client, cancel := NewClient(Socket(local), SetLogger(nopLogger{}), Handler(func(Msg) {}))
+	defer cancel()
+	ctx, cancelSend := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancelSend()
+	for i := 0; i < 3; i++ {
+		if err := client.Privmsg(ctx, "demsh", fmt.Sprintf("line %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	short, cancelShort := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelShort()
+	report, err := client.Shutdown(short)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("stalled shutdown: %v", err)
+	}
+	if report.QuitSent || report.Acknowledged {
+		t.Errorf("unexpected report %+v", report)
+	}
+	said := 0
+	for _, line := range report.Dropped {
+		if line.Command == "PRIVMSG" {
+			said++
+		}
+	}
+	if said != 3 {
+		t.Errorf("dropped %d PRIVMSG in %v", said, report.Dropped)
+	}
+}
@@ -0,0 +1,90 @@
+package ircfw
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Called in separate goroutine for every FAIL, WARN and NOTE received
+type StandardReplyHandler func(reply StandardReply)
+
+// FAIL, WARN or NOTE reply, FAIL ones are returned as errors by Join and Do
+// and, when labeled-response is negotiated, by Send, Say and Reply
+// https://ircv3.net/specs/extensions/standard-replies
+type StandardReply struct {
+	Type    string
+	Command string
+	Code    string
+	Context []string
+	// human-readable description
+	Description string
+}
+
+func (r StandardReply) Error() string {
+	context := ""
+	if len(r.Context) > 0 {
+		context = " " + strings.Join(r.Context, " ")
+	}
+	return fmt.Sprintf("%s %s %s%s: %s", r.Type, r.Command, r.Code, context, r.Description)
+}
+
+// FAIL replies match ErrRejected with errors.Is
+func (r StandardReply) Unwrap() error {
+	if r.Type == "FAIL" {
+		return ErrRejected
+	}
+	return nil
+}
+
+func isStandardReply(cmd string) bool {
+	return cmd == "FAIL" || cmd == "WARN" || cmd == "NOTE"
+}
+
+// FAIL <command> <code> [<context>...] <description>
+func parseStandardReply(line Line) (StandardReply, bool) {
+	if !isStandardReply(line.Command) || len(line.Params) < 3 {
+		return StandardReply{}, false
+	}
+	params := line.Params
+	return StandardReply{
+		Type:        line.Command,
+		Command:     strings.ToUpper(params[0]),
+		Code:        params[1],
+		Context:     append([]string{}, params[2:len(params)-1]...),
+		Description: params[len(params)-1],
+	}, true
+}
+
+func handleStandardReply(msg message) {
+	client := msg.Client()
+	reply, ok := parseStandardReply(newLine(msg))
+	if !ok {
+		client.Debug("Got malformed standard reply: %#v", msg)
+		return
+	}
+	if reply.Type == "NOTE" {
+		client.Debug("%s", reply)
+	} else {
+		client.Logf("%s", reply)
+	}
+	if reply.Type == "FAIL" && reply.Command == "JOIN" && len(reply.Context) > 0 {
+		client.failJoin(reply.Context[0], reply)
+	}
+	for _, handler := range client.replyHandlers {
+		go handler(reply)
+	}
+}
+
+// Aborts pending Join of chanName with err
+func (c *Client) failJoin(chanName string, err error) {
+	c.Lock()
+	channel := c.fetchChannel(chanName)
+	if channel == nil || channel.isStarted() {
+		c.Unlock()
+		return
+	}
+	delete(c.channels, chanName)
+	c.Unlock()
+	channel.err = err
+	channel.kill()
+}
@@ -0,0 +1,123 @@
+package ircfw
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStandardReplyErrors(t *testing.T) {
+	r := newRequests()
+	req := &request{cmd: "CHATHISTORY", batchType: ChathistoryBatch, target: "#ircfw-test", done: make(chan []Line, 1)}
+	other := &request{cmd: "CHATHISTORY", batchType: ChathistoryBatch, target: "#other", done: make(chan []Line, 1)}
+	r.add(req)
+	r.add(other)
+	for _, msg := range parseLines(t, []string{
+		":irc.demsh.org FAIL CHATHISTORY INVALID_TARGET LATEST #ircfw-test :Messages could not be retrieved",
+	}) {
+		r.observe(msg)
+	}
+	select {
+	case lines := <-req.done:
+		err := replyError(lines)
+		var reply StandardReply
+		if !errors.As(err, &reply) || !errors.Is(err, ErrRejected) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if reply.Code != "INVALID_TARGET" || len(reply.Context) != 2 || reply.Context[1] != "#ircfw-test" || reply.Description != "Messages could not be retrieved" {
+			t.Errorf("unexpected %#v", reply)
+		}
+	default:
+		t.Fatal("request was not completed by FAIL")
+	}
+	if len(r.pending) != 1 || r.pending[0] != other {
+		t.Error("FAIL did not end only the request of its target")
+	}
+}
+
+func TestStandardReplyEvents(t *testing.T) {
+	replies := make(chan StandardReply, 2)
+	client := newTestClient(t, nil, OnStandardReply(func(reply StandardReply) { replies <- reply }))
+	channel := client.createChannel("#ircfw-test")
+	for _, line := range []string{
+		":irc.demsh.org FAIL JOIN CHANNEL_FULL #ircfw-test :Channel is full",
+		":irc.demsh.org WARN REHASH CERTS_EXPIRED :Certificate has expired",
+	} {
+		msg, _ := parseUTF8Message([]byte(line), time.Now(), client)
+		client.dispatch(msg)
+	}
+	select {
+	case <-channel.quit:
+		var reply StandardReply
+		if !errors.As(channel.err, &reply) || reply.Code != "CHANNEL_FULL" {
+			t.Errorf("unexpected join error %v", channel.err)
+		}
+	default:
+		t.Error("join was not failed")
+	}
+	got := map[string]string{}
+	for i := 0; i < 2; i++ {
+		reply := <-replies
+		got[reply.Type] = reply.Code
+	}
+	if got["FAIL"] != "CHANNEL_FULL" || got["WARN"] != "CERTS_EXPIRED" {
+		t.Errorf("unexpected events %v", got)
+	}
+	if err := (StandardReply{Type: "WARN"}); errors.Is(err, ErrRejected) {
+		t.Error("WARN is a rejection")
+	}
+}
+
+func TestSayConfirmedFail(t *testing.T) {
+	client := newTestClient(t, map[string]string{EchoMessageCap: "", LabeledResponseCap: ""})
+	channel := newChannel("#ircfw-test", client)
+	client.channels["#ircfw-test"] = channel
+	channel.start()
+	defer channel.kill()
+
+	go func() {
+		sent := <-client.writes
+		label, _ := sent.Tag("label")
+		fail, _ := parseUTF8Message([]byte("@label="+label+" :irc.demsh.org FAIL PRIVMSG CANNOT_SEND #ircfw-test :Moderated"), time.Now(), client)
+		client.resolveLabel(fail)
+	}()
+	_, err := channel.SayConfirmed(context.Background(), []string{"hello"})
+	var reply StandardReply
+	if !errors.As(err, &reply) || reply.Code != "CANNOT_SEND" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSayFail(t *testing.T) {
+	client := newTestClient(t, map[string]string{LabeledResponseCap: ""})
+	channel := newChannel("#ircfw-test", client)
+	client.channels["#ircfw-test"] = channel
+	channel.start()
+	defer channel.kill()
+
+	answer := func(reply string) {
+		sent := <-client.writes
+		label, _ := sent.Tag("label")
+		msg, _ := parseUTF8Message([]byte("@label="+label+" :irc.demsh.org "+reply), time.Now(), client)
+		client.resolveLabel(msg)
+	}
+	ctx := context.Background()
+	go answer("ACK")
+	if err := channel.Say(ctx, "hello"); err != nil {
+		t.Errorf("accepted text: %v", err)
+	}
+	go answer("FAIL PRIVMSG CANNOT_SEND #ircfw-test :Moderated")
+	var reply StandardReply
+	if err := channel.Say(ctx, "hello"); !errors.As(err, &reply) || reply.Code != "CANNOT_SEND" {
+		t.Errorf("Say: unexpected error %v", err)
+	}
+	go answer("FAIL NOTICE CANNOT_SEND demsh :Blocked")
+	if err := client.Notice(ctx, "demsh", "hello"); !errors.As(err, &reply) || reply.Command != "NOTICE" {
+		t.Errorf("Notice: unexpected error %v", err)
+	}
+	go answer("FAIL AWAY TOO_LONG :Message is too long")
+	if err := client.Send(ctx, "AWAY", "lunch"); !errors.As(err, &reply) || reply.Command != "AWAY" {
+		t.Errorf("Send: unexpected error %v", err)
+	}
+}
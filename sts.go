@@ -0,0 +1,176 @@
+package ircfw
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const STSCap = "sts"
+
+// https://ircv3.net/specs/extensions/sts
+type STSPolicy struct {
+	// TLS port the policy was received on
+	Port    int
+	Expires time.Time
+	Preload bool
+}
+
+func (p STSPolicy) Valid() bool {
+	return time.Now().Before(p.Expires)
+}
+
+// Persists STS policies per host between connections
+type STSStore interface {
+	Policy(host string) (STSPolicy, bool)
+	SetPolicy(host string, policy STSPolicy)
+	DeletePolicy(host string)
+}
+
+type MemorySTSStore struct {
+	sync.Mutex
+	policies map[string]STSPolicy
+}
+
+func NewMemorySTSStore() *MemorySTSStore {
+	return &MemorySTSStore{policies: make(map[string]STSPolicy)}
+}
+
+func (s *MemorySTSStore) Policy(host string) (STSPolicy, bool) {
+	s.Lock()
+	defer s.Unlock()
+	policy, ok := s.policies[lowcase(host)]
+	return policy, ok
+}
+
+func (s *MemorySTSStore) SetPolicy(host string, policy STSPolicy) {
+	s.Lock()
+	defer s.Unlock()
+	s.policies[lowcase(host)] = policy
+}
+
+func (s *MemorySTSStore) DeletePolicy(host string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.policies, lowcase(host))
+}
+
+// Returned by Client.Wait when plaintext connection has to be replaced
+// with TLS one to Port
+type STSUpgradeError struct {
+	Host string
+	Port int
+}
+
+func (e *STSUpgradeError) Error() string {
+	return fmt.Sprintf("sts: %s requires TLS on port %d", e.Host, e.Port)
+}
+
+// Implemented by *tls.Conn and by wrappers passing its state through,
+// like ircfwtest.Recorder
+type tlsConn interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// Handshake of *tls.Conn may still be pending, wrappers are trusted
+// once they report completed one
+func (c *Client) isTLS() bool {
+	if _, ok := c.socket.(*tls.Conn); ok {
+		return true
+	}
+	conn, ok := c.socket.(tlsConn)
+	return ok && conn.ConnectionState().HandshakeComplete
+}
+
+func socketPort(socket net.Conn) int {
+	_, port, err := net.SplitHostPort(socket.RemoteAddr().String())
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// Refuses plaintext socket while host has valid policy
+func (c *Client) checkSTS() error {
+	if c.stsStore == nil || c.isTLS() {
+		return nil
+	}
+	if policy, ok := c.stsStore.Policy(c.stsHost); ok && policy.Valid() {
+		return &STSUpgradeError{Host: c.stsHost, Port: policy.Port}
+	}
+	return nil
+}
+
+// Applies sts capability advertised in CAP LS or CAP NEW,
+// returns true if client is disconnecting to upgrade to TLS
+func (c *Client) applySTS() bool {
+	value, ok := c.capValue(STSCap)
+	if !ok || c.stsStore == nil {
+		return false
+	}
+	params := capParams(value)
+	if !c.isTLS() {
+		// policy received over plaintext is not persisted, only upgrade is requested
+		port, err := strconv.Atoi(params["port"])
+		if err != nil || port <= 0 {
+			c.Debug("Ignoring sts without port over plaintext: %q", value)
+			return false
+		}
+		c.Logf("Server requires TLS on port %d, disconnecting", port)
+		c.tomb.Kill(&STSUpgradeError{Host: c.stsHost, Port: port})
+		c.socket.Close()
+		return true
+	}
+	seconds, err := strconv.Atoi(params["duration"])
+	if err != nil || seconds < 0 {
+		c.Debug("Ignoring sts with invalid duration: %q", value)
+		return false
+	}
+	if seconds == 0 {
+		c.stsStore.DeletePolicy(c.stsHost)
+		return false
+	}
+	_, preload := params["preload"]
+	c.stsStore.SetPolicy(c.stsHost, STSPolicy{
+		Port:    socketPort(c.socket),
+		Expires: time.Now().Add(time.Duration(seconds) * time.Second),
+		Preload: preload,
+	})
+	return false
+}
+
+// Connects to host respecting its STS policy from store: while the policy is
+// valid plaintext connection is upgraded to TLS on policy port. Pass nil
+// config for plaintext connection
+func Dial(ctx context.Context, host string, port int, store STSStore, config *tls.Config) (net.Conn, error) {
+	if store != nil {
+		if policy, ok := store.Policy(host); ok && policy.Valid() {
+			if config == nil {
+				config = &tls.Config{ServerName: host}
+			}
+			if policy.Port > 0 {
+				port = policy.Port
+			}
+		}
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil || config == nil {
+		return conn, err
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,115 @@
+package ircfw
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"gitea.demsh.org/demsh/ircfw/ircfwtest"
+)
+
+func TestSTSRefusesPlaintext(t *testing.T) {
+	store := NewMemorySTSStore()
+	store.SetPolicy("irc.demsh.org", STSPolicy{Port: 6697, Expires: time.Now().Add(time.Hour)})
+	local, remote := net.Pipe()
+	defer remote.Close()
+	client, cancel := NewClient(Socket(local), SetLogger(nopLogger{}), STS("IRC.demsh.org", store), Password("secret"))
+	defer cancel()
+	var upgrade *STSUpgradeError
+	if err := client.Wait(); !errors.As(err, &upgrade) || upgrade.Port != 6697 {
+		t.Errorf("expected STSUpgradeError, got %v", err)
+	}
+	if n, _ := remote.Read(make([]byte, 64)); n != 0 {
+		t.Errorf("%d bytes sent over plaintext", n)
+	}
+}
+
+func TestApplySTS(t *testing.T) {
+	store := NewMemorySTSStore()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	client := newTestClient(t, nil, Socket(local), STS("irc.demsh.org", store))
+
+	client.availCaps[STSCap] = "port=6697,duration=300"
+	if !client.applySTS() {
+		t.Fatal("no upgrade over plaintext")
+	}
+	var upgrade *STSUpgradeError
+	if !errors.As(client.tomb.Err(), &upgrade) || upgrade.Port != 6697 {
+		t.Errorf("unexpected %v", client.tomb.Err())
+	}
+	if _, ok := store.Policy("irc.demsh.org"); ok {
+		t.Error("policy from plaintext connection persisted")
+	}
+
+	client.socket = tls.Client(remote, &tls.Config{})
+	client.availCaps[STSCap] = "duration=300,preload"
+	client.applySTS()
+	policy, ok := store.Policy("irc.demsh.org")
+	if !ok || !policy.Valid() || !policy.Preload || policy.Expires.After(time.Now().Add(300*time.Second)) {
+		t.Errorf("unexpected policy %#v", policy)
+	}
+	client.availCaps[STSCap] = "duration=0"
+	client.applySTS()
+	if _, ok := store.Policy("irc.demsh.org"); ok {
+		t.Error("policy was not removed")
+	}
+}
+
+func TestDialSTS(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	tlsPort, _ := strconv.Atoi(port)
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	store := NewMemorySTSStore()
+	store.SetPolicy("127.0.0.1", STSPolicy{Port: tlsPort, Expires: time.Now().Add(time.Hour)})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := Dial(ctx, "127.0.0.1", 6667, store, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Errorf("got %T", conn)
+	}
+}
+
+func TestRecordedTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	tlsPort, _ := strconv.Atoi(port)
+	conn, err := Dial(ctx, "127.0.0.1", tlsPort, nil, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := newTestClient(t, nil)
+	client.socket = ircfwtest.NewRecorder(conn, io.Discard)
+	if !client.isTLS() {
+		t.Error("recorded TLS connection treated as plaintext")
+	}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	client.socket = ircfwtest.NewRecorder(local, io.Discard)
+	if client.isTLS() {
+		t.Error("recorded plaintext connection treated as TLS")
+	}
+}
@@ -0,0 +1,96 @@
+package ircfw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	MessageTagsCap = "message-tags"
+	ReplyTag       = "+draft/reply"
+	ReactTag       = "+draft/react"
+)
+
+var ErrNoMsgID = errors.New("message has no msgid")
+
+// Called in separate goroutine for every TAGMSG received
+type TagMsgHandler func(tm TagMsg)
+
+// Message carrying only tags, e.g. reaction or typing notification
+// https://ircv3.net/specs/extensions/message-tags#the-tagmsg-tag-only-message
+type TagMsg struct {
+	Time    time.Time
+	Prefix  string
+	Target  string
+	Tags    map[string]string
+	Channel *Channel
+}
+
+func (t TagMsg) Nick() string {
+	nick, _ := pop(t.Prefix, "!")
+	return nick
+}
+
+// msgid of message the tags refer to, empty if none
+func (t TagMsg) ReplyTo() string {
+	return t.Tags[ReplyTag]
+}
+
+// Reaction emoji, empty if TAGMSG is not a reaction
+func (t TagMsg) Reaction() string {
+	return t.Tags[ReactTag]
+}
+
+// Sends TAGMSG with client-only tags to target
+func (c *Client) TagMsg(ctx context.Context, target string, tags map[string]string) error {
+	if !c.HasCap(MessageTagsCap) {
+		return fmt.Errorf("TAGMSG: %s not negotiated", MessageTagsCap)
+	}
+	if err := validateTargets([]string{target}, c.nickLen()); err != nil {
+		return fmt.Errorf("TAGMSG: %w", invalid("target", err))
+	}
+	if len(tags) == 0 {
+		return fmt.Errorf("TAGMSG: %w", invalid("tags", errors.New("none given")))
+	}
+	for key := range tags {
+		if !strings.HasPrefix(key, "+") {
+			return fmt.Errorf("TAGMSG: %w", invalid("tag", fmt.Errorf("%q is not client-only", key)))
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	msg := newTaggedMessage(tags, []byte("TAGMSG"), [][]byte{[]byte(target)}, deadline, c)
+	return c.enqueue(ctx, []message{msg})
+}
+
+func handleTagmsg(msg message) {
+	client := msg.Client()
+	if len(msg.Params()) == 0 {
+		client.Debug("Got TAGMSG without target: %#v", msg)
+		return
+	}
+	if client.dropEcho(msg) {
+		return
+	}
+	target := msg.Params()[0]
+	tm := TagMsg{
+		Time:   msg.Time(),
+		Prefix: msg.Prefix(),
+		Target: target,
+		Tags:   msg.Tags(),
+	}
+	if isChannel(target) {
+		tm.Channel = msg.Channel()
+	} else {
+		// queryNick takes the client lock itself
+		nick := queryNick(msg)
+		client.Lock()
+		tm.Channel = client.fetchQuery(nick)
+		client.Unlock()
+	}
+	for _, handler := range client.tagHandlers {
+		go handler(tm)
+	}
+}
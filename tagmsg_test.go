@@ -0,0 +1,94 @@
+package ircfw
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReplyThreading(t *testing.T) {
+	client := newTestClient(t, map[string]string{MessageTagsCap: ""})
+	channel := newChannel("#ircfw-test", client)
+	msg := ircMsg{msgid: "abc", prefix: "demsh!~demsh@12a8e790", text: []string{"ping"}, channel: channel, client: client}
+	msg.Reply(context.Background(), []string{"pong"})
+	reply := <-channel.send
+	exported := string(reply.Messages()[0].Export())
+	if exported != "@+draft/reply=abc PRIVMSG #ircfw-test :pong\r\n" {
+		t.Errorf("got %q", exported)
+	}
+
+	client.enabledCaps.Remove(MessageTagsCap)
+	msg.Reply(context.Background(), []string{"pong"})
+	reply = <-channel.send
+	exported = string(reply.Messages()[0].Export())
+	if exported != "PRIVMSG #ircfw-test :pong\r\n" {
+		t.Errorf("got %q", exported)
+	}
+}
+
+func TestReact(t *testing.T) {
+	client := newTestClient(t, map[string]string{MessageTagsCap: ""})
+	channel := newChannel("#ircfw-test", client)
+	msg := ircMsg{msgid: "abc", channel: channel, client: client}
+	if err := msg.React(context.Background(), "👍"); err != nil {
+		t.Fatal(err)
+	}
+	exported := string((<-client.writes).Export())
+	if exported != "@+draft/react=👍;+draft/reply=abc TAGMSG :#ircfw-test\r\n" {
+		t.Errorf("got %q", exported)
+	}
+	msg.msgid = ""
+	if err := msg.React(context.Background(), "👍"); !errors.Is(err, ErrNoMsgID) {
+		t.Errorf("expected ErrNoMsgID, got %v", err)
+	}
+	if err := client.TagMsg(context.Background(), "#ircfw-test", map[string]string{"draft/react": "👍"}); err == nil {
+		t.Error("server tag was accepted")
+	}
+}
+
+func TestHandleTagmsg(t *testing.T) {
+	received := make(chan TagMsg, 1)
+	client := newTestClient(t, nil, OnTagMsg(func(tm TagMsg) { received <- tm }))
+	channel := newChannel("#ircfw-test", client)
+	client.channels["#ircfw-test"] = channel
+	msg, err := parseUTF8Message([]byte("@+draft/react=🎉;+draft/reply=abc :demsh!~demsh@12a8e790 TAGMSG #ircfw-test"), time.Now(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleTagmsg(msg)
+	tm := <-received
+	if tm.Nick() != "demsh" || tm.Channel != channel || tm.Reaction() != "🎉" || tm.ReplyTo() != "abc" {
+		t.Errorf("unexpected %#v", tm)
+	}
+}
+
+func TestPrivateTagmsg(t *testing.T) {
+	received := make(chan TagMsg, 1)
+	client := newTestClient(t, map[string]string{EchoMessageCap: ""}, KeepEchoes(),
+		OnTagMsg(func(tm TagMsg) { received <- tm }))
+	query := newQuery("demsh", client)
+	client.queries["demsh"] = query
+	for _, line := range []string{
+		"@+typing=active :demsh!~demsh@12a8e790 TAGMSG ircfw",
+		"@+typing=active :ircfw!~ircfw@5838b91c TAGMSG demsh",
+	} {
+		msg, err := parseUTF8Message([]byte(line), time.Now(), client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dispatched := make(chan struct{})
+		go func() {
+			client.dispatch(msg)
+			close(dispatched)
+		}()
+		select {
+		case <-dispatched:
+		case <-time.After(time.Second):
+			t.Fatalf("dispatch of %q is stuck", line)
+		}
+		if tm := <-received; tm.Channel != query {
+			t.Errorf("%q: unexpected channel %v", line, tm.Channel)
+		}
+	}
+}
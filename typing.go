@@ -0,0 +1,158 @@
+package ircfw
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// https://ircv3.net/specs/client-tags/typing
+const (
+	TypingTag    = "+typing"
+	TypingActive = "active"
+	TypingPaused = "paused"
+	TypingDone   = "done"
+	// active notifications are not sent more often than this
+	typingInterval = 3 * time.Second
+)
+
+type typingState struct {
+	sync.Mutex
+	// closed when indicator stops, nil if not typing
+	stop chan struct{}
+	last time.Time
+	// active notification was sent and not ended yet
+	shown bool
+}
+
+// Typing state of the sender, empty if TAGMSG is not a typing notification
+func (t TagMsg) Typing() string {
+	return t.Tags[TypingTag]
+}
+
+func (c *Channel) typingMsg(state string) ircMsg {
+	return ircMsg{
+		time:    time.Now(),
+		cmd:     "TAGMSG",
+		tags:    map[string]string{TypingTag: state},
+		channel: c,
+		client:  c.client,
+	}
+}
+
+// Shows the channel that client is typing until done is called, ctx expires
+// or a message is sent to the channel
+func (c *Channel) Typing(ctx context.Context) (done func()) {
+	if c.dcc != nil || !c.client.HasCap(MessageTagsCap) {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	c.typing.Lock()
+	if c.typing.stop != nil {
+		close(c.typing.stop)
+	}
+	c.typing.stop = stop
+	c.typing.Unlock()
+	go c.typingLoop(ctx, stop)
+	return func() {
+		c.endTyping(stop)
+	}
+}
+
+func (c *Channel) typingStop() chan struct{} {
+	c.typing.Lock()
+	defer c.typing.Unlock()
+	return c.typing.stop
+}
+
+// Ends indicator started by handler with Msg.Typing if there was no reply,
+// before is the indicator running when the handler was called
+func (c *Channel) endHandlerTyping(before chan struct{}) {
+	if stop := c.typingStop(); stop != nil && stop != before {
+		c.endTyping(stop)
+	}
+}
+
+// Stops indicator started with stop and tells the channel that client is done
+func (c *Channel) endTyping(stop chan struct{}) {
+	c.typing.Lock()
+	if c.typing.stop != stop {
+		c.typing.Unlock()
+		return
+	}
+	close(c.typing.stop)
+	c.typing.stop = nil
+	c.typing.Unlock()
+	c.sendTyping(context.Background(), nil, TypingDone)
+}
+
+// Hands notification to txLoop like queue does, returns false if ctx
+// expired, stop was closed, the channel is gone or shutdown started
+func (c *Channel) sendTyping(ctx context.Context, stop chan struct{}, state string) bool {
+	// select picks randomly, buffer may still have room after closing
+	if c.client.isClosing() {
+		return false
+	}
+	select {
+	case <-ctx.Done():
+	case <-stop:
+	case <-c.quit:
+	case <-c.client.closing:
+	case <-c.client.tomb.Dying():
+	case c.send <- c.typingMsg(state):
+		return true
+	}
+	return false
+}
+
+// meant to run in separate goroutine
+func (c *Channel) typingLoop(ctx context.Context, stop chan struct{}) {
+	ticker := time.NewTicker(typingInterval)
+	defer ticker.Stop()
+	for {
+		if !c.sendTyping(ctx, stop, TypingActive) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-c.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Called by txLoop before sending msg, filters out notifications which are
+// stale, too frequent or redundant, sent text ends typing by itself
+func (c *Channel) typingFilter(msg Msg) (send bool) {
+	c.typing.Lock()
+	defer c.typing.Unlock()
+	m, ok := msg.(ircMsg)
+	if !ok || m.cmd != "TAGMSG" {
+		if c.typing.stop != nil {
+			close(c.typing.stop)
+			c.typing.stop = nil
+		}
+		c.typing.last = time.Time{}
+		c.typing.shown = false
+		return true
+	}
+	switch m.tags[TypingTag] {
+	case TypingActive:
+		if c.typing.stop == nil || time.Since(c.typing.last) < typingInterval {
+			return false
+		}
+		c.typing.last = time.Now()
+		c.typing.shown = true
+	case TypingDone:
+		if !c.typing.shown {
+			return false
+		}
+		c.typing.last = time.Time{}
+		c.typing.shown = false
+	}
+	return true
+}
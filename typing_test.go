@@ -0,0 +1,131 @@
+package ircfw
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func nextWrite(t *testing.T, client *Client) string {
+	select {
+	case msg := <-client.writes:
+		return string(msg.Export())
+	case <-time.After(time.Second):
+		t.Fatal("nothing was written")
+	}
+	return ""
+}
+
+func TestTyping(t *testing.T) {
+	client := newTestClient(t, map[string]string{MessageTagsCap: ""})
+	channel := newChannel("#ircfw-test", client)
+	channel.start()
+	defer channel.kill()
+
+	done := channel.Typing(context.Background())
+	if got := nextWrite(t, client); got != "@+typing=active TAGMSG :#ircfw-test\r\n" {
+		t.Errorf("got %q", got)
+	}
+	channel.send <- ircMsg{text: []string{"result"}, channel: channel, client: client}
+	if got := nextWrite(t, client); got != "PRIVMSG #ircfw-test :result\r\n" {
+		t.Errorf("got %q", got)
+	}
+	// the message itself ends typing
+	done()
+	select {
+	case msg := <-client.writes:
+		t.Errorf("unexpected %q after reply", msg.Export())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// restarted indicator is not throttled by the previous one
+	done = channel.Typing(context.Background())
+	if got := nextWrite(t, client); got != "@+typing=active TAGMSG :#ircfw-test\r\n" {
+		t.Errorf("got %q", got)
+	}
+	done()
+	if got := nextWrite(t, client); got != "@+typing=done TAGMSG :#ircfw-test\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if len(channel.Recent()) != 1 {
+		t.Errorf("typing notifications were remembered: %v", channel.Recent())
+	}
+}
+
+func TestMsgTyping(t *testing.T) {
+	typing := make(chan struct{})
+	client := newTestClient(t, map[string]string{MessageTagsCap: ""}, HandleContext(func(ctx context.Context, msg Msg) {
+		msg.Typing()
+		<-typing
+		if msg.Text()[0] == "reply" {
+			msg.Reply(ctx, []string{"result"})
+		}
+	}))
+	channel := newChannel("#ircfw-test", client)
+	channel.start()
+	defer channel.kill()
+
+	client.dispatcher.push(dispatchJob(channel, "demsh", "reply"))
+	if got := nextWrite(t, client); got != "@+typing=active TAGMSG :#ircfw-test\r\n" {
+		t.Errorf("got %q", got)
+	}
+	typing <- struct{}{}
+	if got := nextWrite(t, client); got != "PRIVMSG #ircfw-test :result\r\n" {
+		t.Errorf("got %q", got)
+	}
+	select {
+	case msg := <-client.writes:
+		t.Errorf("unexpected %q after reply", msg.Export())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// handler returning without reply ends typing
+	client.dispatcher.push(dispatchJob(channel, "demsh", "ignore"))
+	if got := nextWrite(t, client); got != "@+typing=active TAGMSG :#ircfw-test\r\n" {
+		t.Errorf("got %q", got)
+	}
+	typing <- struct{}{}
+	if got := nextWrite(t, client); got != "@+typing=done TAGMSG :#ircfw-test\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTypingWithoutTags(t *testing.T) {
+	client := newTestClient(t, nil)
+	channel := newChannel("#ircfw-test", client)
+	channel.Typing(context.Background())()
+	if len(channel.send) != 0 {
+		t.Error("typing sent without message-tags")
+	}
+}
+
+func TestTypingClosing(t *testing.T) {
+	client := newTestClient(t, map[string]string{MessageTagsCap: ""})
+	channel := newChannel("#ircfw-test", client)
+	defer channel.kill()
+	// txLoop is not running, so the queue stays full
+	for i := 0; i < cap(channel.send); i++ {
+		channel.send <- ircMsg{text: []string{"queued"}, channel: channel, client: client}
+	}
+	done := channel.Typing(context.Background())
+	close(client.closing)
+	ended := make(chan struct{})
+	go func() {
+		done()
+		close(ended)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		t.Fatal("ending typing blocked after shutdown started")
+	}
+
+	channel = newChannel("#ircfw-test", client)
+	defer channel.kill()
+	channel.Typing(context.Background())()
+	select {
+	case msg := <-channel.send:
+		t.Errorf("%q queued after shutdown started", msg.Messages()[0].Export())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
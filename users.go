@@ -0,0 +1,220 @@
+package ircfw
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	ExtendedJoinCap  = "extended-join"
+	AccountNotifyCap = "account-notify"
+	AccountTagCap    = "account-tag"
+	AwayNotifyCap    = "away-notify"
+	ChghostCap       = "chghost"
+	SetnameCap       = "setname"
+)
+
+// What is known about user sharing a channel with the client
+type User struct {
+	Nick, Ident, Host string
+	// services account, empty if not logged in
+	Account  string
+	Realname string
+	// away message, empty if user is present
+	Away string
+}
+
+type trackedUser struct {
+	User
+	channels map[string]struct{}
+}
+
+type userTracker struct {
+	sync.Mutex
+	users map[string]*trackedUser
+}
+
+func newUserTracker() *userTracker {
+	return &userTracker{users: make(map[string]*trackedUser)}
+}
+
+// Returns user by nick, nil if it is not tracked, meant to be called with lock held
+func (t *userTracker) get(nick string) *trackedUser {
+	return t.users[lowcase(nick)]
+}
+
+func (t *userTracker) add(nick string, chanName string) *trackedUser {
+	user := t.get(nick)
+	if user == nil {
+		user = &trackedUser{User: User{Nick: nick}, channels: make(map[string]struct{})}
+		t.users[lowcase(nick)] = user
+	}
+	user.channels[lowcase(chanName)] = struct{}{}
+	return user
+}
+
+func (t *userTracker) part(nick string, chanName string) {
+	user := t.get(nick)
+	if user == nil {
+		return
+	}
+	delete(user.channels, lowcase(chanName))
+	if len(user.channels) == 0 {
+		delete(t.users, lowcase(nick))
+	}
+}
+
+// Forgets channel client has left
+func (t *userTracker) partAll(chanName string) {
+	for _, user := range t.users {
+		t.part(user.Nick, chanName)
+	}
+}
+
+func (t *userTracker) rename(oldnick string, newnick string) {
+	user := t.get(oldnick)
+	if user == nil {
+		return
+	}
+	delete(t.users, lowcase(oldnick))
+	user.Nick = newnick
+	t.users[lowcase(newnick)] = user
+}
+
+func (t *userTracker) quit(nick string) {
+	delete(t.users, lowcase(nick))
+}
+
+// Applies f to user if it is tracked
+func (t *userTracker) update(nick string, f func(user *trackedUser)) {
+	t.Lock()
+	defer t.Unlock()
+	if user := t.get(nick); user != nil {
+		f(user)
+	}
+}
+
+// "*" stands for no account in extended-join and account-notify
+func accountName(param string) string {
+	if param == "*" {
+		return ""
+	}
+	return param
+}
+
+// Splits nick!ident@host
+func splitPrefix(prefix string) (nick, ident, host string) {
+	nick, rest := pop(prefix, "!")
+	ident, host = pop(rest, "@")
+	return
+}
+
+// Keeps ident, host and account-tag of sender up to date
+func (c *Client) observeUser(msg message) {
+	nick, ident, host := splitPrefix(msg.Prefix())
+	if host == "" {
+		return
+	}
+	account, tagged := msg.Tag("account")
+	trackAccount := c.HasCap(AccountTagCap)
+	c.users.update(nick, func(user *trackedUser) {
+		user.Ident, user.Host = ident, host
+		if trackAccount {
+			user.Account = ""
+			if tagged {
+				user.Account = account
+			}
+		}
+	})
+}
+
+// Known state of user sharing a channel with the client
+func (c *Client) User(nick string) (User, bool) {
+	c.users.Lock()
+	defer c.users.Unlock()
+	user := c.users.get(nick)
+	if user == nil {
+		return User{}, false
+	}
+	return user.User, true
+}
+
+func (c *Client) trackJoin(msg message) {
+	params := msg.Params()
+	nick, ident, host := splitPrefix(msg.Prefix())
+	c.users.Lock()
+	defer c.users.Unlock()
+	user := c.users.add(nick, params[0])
+	user.Ident, user.Host = ident, host
+	// JOIN #channel account :realname
+	if len(params) >= 3 && c.HasCap(ExtendedJoinCap) {
+		user.Account = accountName(params[1])
+		user.Realname = params[2]
+	}
+}
+
+// Tracks users listed in RPL_NAMREPLY, nicks may carry membership
+// prefixes and userhost-in-names hosts
+func (c *Client) trackNames(chanName string, names []string) {
+	c.Lock()
+	statuses := "~&@%+"
+	if prefix, ok := c.params["PREFIX"]; ok {
+		if i := strings.Index(prefix, ")"); i >= 0 {
+			statuses = prefix[i+1:]
+		}
+	}
+	c.Unlock()
+	c.users.Lock()
+	defer c.users.Unlock()
+	for _, name := range names {
+		name = strings.TrimLeft(name, statuses)
+		if name == "" {
+			continue
+		}
+		nick, ident, host := splitPrefix(name)
+		user := c.users.add(nick, chanName)
+		if host != "" {
+			user.Ident, user.Host = ident, host
+		}
+	}
+}
+
+func handleAccount(msg message) {
+	params := msg.Params()
+	if len(params) == 0 {
+		return
+	}
+	msg.Client().users.update(msg.Nick(), func(user *trackedUser) {
+		user.Account = accountName(params[0])
+	})
+}
+
+func handleAway(msg message) {
+	away := ""
+	if params := msg.Params(); len(params) > 0 {
+		away = params[len(params)-1]
+	}
+	msg.Client().users.update(msg.Nick(), func(user *trackedUser) {
+		user.Away = away
+	})
+}
+
+func handleChghost(msg message) {
+	params := msg.Params()
+	if len(params) < 2 {
+		return
+	}
+	msg.Client().users.update(msg.Nick(), func(user *trackedUser) {
+		user.Ident, user.Host = params[0], params[1]
+	})
+}
+
+func handleSetname(msg message) {
+	params := msg.Params()
+	if len(params) == 0 {
+		return
+	}
+	msg.Client().users.update(msg.Nick(), func(user *trackedUser) {
+		user.Realname = params[len(params)-1]
+	})
+}
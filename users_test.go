@@ -0,0 +1,78 @@
+package ircfw
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserTracking(t *testing.T) {
+	client := newTestClient(t, map[string]string{
+		ExtendedJoinCap:  "",
+		AccountNotifyCap: "",
+		AccountTagCap:    "",
+		AwayNotifyCap:    "",
+		ChghostCap:       "",
+		SetnameCap:       "",
+	})
+	client.params = map[string]string{"PREFIX": "(ov)@+"}
+	channel := newChannel("#ircfw-test", client)
+	client.channels["#ircfw-test"] = channel
+	run := func(line string) {
+		msg, err := parseUTF8Message([]byte(line), time.Now(), client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.dispatch(msg)
+	}
+	user := func(nick string) User {
+		user, ok := client.User(nick)
+		if !ok {
+			t.Fatalf("%q is not tracked", nick)
+		}
+		return user
+	}
+
+	run("@account=demsh :demsh!~demsh@12a8e790 JOIN #ircfw-test demsh :Dmitry")
+	run(":irc.demsh.org 353 ircfw = #ircfw-test :@other +third")
+	if u := user("DEMSH"); u.Account != "demsh" || u.Realname != "Dmitry" || u.Host != "12a8e790" {
+		t.Errorf("after join %#v", u)
+	}
+	if u := user("other"); u.Nick != "other" {
+		t.Errorf("after names %#v", u)
+	}
+
+	run("@account=demsh :demsh!~demsh@12a8e790 AWAY :lunch")
+	run("@account=demsh :demsh!~demsh@12a8e790 CHGHOST dmitry new.host")
+	if u := user("demsh"); u.Ident != "dmitry" || u.Host != "new.host" {
+		t.Errorf("after chghost %#v", u)
+	}
+	run("@account=demsh :demsh!dmitry@new.host SETNAME :Dmitry S")
+	run(":demsh!dmitry@new.host ACCOUNT *")
+	if u := user("demsh"); u.Away != "lunch" || u.Ident != "dmitry" || u.Host != "new.host" || u.Realname != "Dmitry S" || u.Account != "" {
+		t.Errorf("after updates %#v", u)
+	}
+	run("@account=demsh :demsh!dmitry@new.host PRIVMSG #ircfw-test :back")
+	run("@account=demsh :demsh!dmitry@new.host AWAY")
+	if u := user("demsh"); u.Account != "demsh" || u.Away != "" {
+		t.Errorf("after account-tag %#v", u)
+	}
+
+	run("@account=demsh :demsh!dmitry@new.host NICK ds")
+	if _, ok := client.User("demsh"); ok {
+		t.Error("old nick is still tracked")
+	}
+	if u := user("ds"); u.Nick != "ds" || u.Account != "demsh" {
+		t.Errorf("after nick %#v", u)
+	}
+	run(":other!~other@host PART #ircfw-test")
+	run(":ds!dmitry@new.host QUIT :bye")
+	for _, nick := range []string{"other", "ds"} {
+		if _, ok := client.User(nick); ok {
+			t.Errorf("%q is still tracked", nick)
+		}
+	}
+	run(":ircfw!~ircfw@5838b91c PART #ircfw-test")
+	if _, ok := client.User("third"); ok {
+		t.Error("user is tracked after leaving the channel")
+	}
+}
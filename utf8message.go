@@ -1,49 +1,130 @@
 package ircfw
 
 import (
+	"errors"
+	"sort"
 	"strings"
 	"time"
 )
 
 type utf8message struct {
+	tags        map[string]string
 	prefix, cmd string
 	params      []string
-	deadline    time.Time
-	client      *Client
+	// full text of reassembled multiline batch
+	lines    []string
+	time     time.Time
+	deadline time.Time
+	client   *Client
+}
+
+var (
+	tagEscapes   = strings.NewReplacer("\\", "\\\\", ";", "\\:", " ", "\\s", "\r", "\\r", "\n", "\\n")
+	tagUnescapes = map[byte]string{':': ";", 's': " ", '\\': "\\", 'r': "\r", 'n': "\n"}
+)
+
+// https://ircv3.net/specs/extensions/message-tags#escaping-values
+func unescapeTag(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i == len(value) {
+			break
+		}
+		if unescaped, ok := tagUnescapes[value[i]]; ok {
+			b.WriteString(unescaped)
+		} else {
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+func parseTags(line string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(line, ";") {
+		key, value := pop(tag, "=")
+		if key == "" {
+			continue
+		}
+		tags[key] = unescapeTag(value)
+	}
+	return tags
+}
+
+func exportTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if value := tags[key]; value != "" {
+			keys[i] = key + "=" + tagEscapes.Replace(value)
+		}
+	}
+	return strings.Join(keys, ";")
 }
 
 func (m utf8message) Deadline() time.Time {
 	return m.deadline
 }
 
+// Middle parameters are separated by one or more spaces, nothing else,
+// trailing one is kept verbatim
 func parseParams(line string) (result []string) {
 	if len(line) == 0 {
 		return
 	}
 	if line[0] == ':' {
-		result = []string{strings.TrimSpace(line[1:])}
+		result = []string{line[1:]}
 		return
 	}
-	i := strings.Index(line, " :")
-	if i == -1 {
-		result = strings.Split(strings.TrimSpace(line), " ")
-		return
+	params_wo_spaces, last_param, trailing := line, "", false
+	if i := strings.Index(line, " :"); i != -1 {
+		params_wo_spaces, last_param, trailing = line[:i], line[i+2:], true
+	}
+	for _, param := range strings.Split(params_wo_spaces, " ") {
+		if param != "" {
+			result = append(result, param)
+		}
+	}
+	if trailing {
+		result = append(result, last_param)
 	}
-	params_wo_spaces, last_param := line[:i], line[i:][2:]
-	result = strings.Split(strings.TrimSpace(params_wo_spaces), " ")
-	result = append(result, last_param)
 	return
 }
 
-func parseUTF8Message(bytes []byte, deadline time.Time, client *Client) (msg message, err error) {
+// Parses message received at given time, server-time tag takes precedence
+func parseUTF8Message(bytes []byte, received time.Time, client *Client) (msg message, err error) {
 	line := string(bytes)
 	if err = validate(line); err != nil {
 		return
 	}
+	if line == "" {
+		return nil, errors.New("empty line")
+	}
 	var (
 		prefix, cmd string
 		params      []string
+		tags        map[string]string
 	)
+	if line[0] == '@' {
+		var rawTags string
+		rawTags, line = pop(line[1:], " ")
+		tags = parseTags(rawTags)
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			return nil, errors.New("no command")
+		}
+	}
 	if line[0] == ':' {
 		prefix, line = pop(line[1:], " ")
 		cmd, line = pop(line, " ")
@@ -52,29 +133,62 @@ func parseUTF8Message(bytes []byte, deadline time.Time, client *Client) (msg mes
 		cmd, line = pop(line, " ")
 		params = parseParams(line)
 	}
+	if cmd == "" {
+		return nil, errors.New("no command")
+	}
 	msg = utf8message{
-		prefix:   prefix,
-		cmd:      cmd,
-		params:   params,
-		deadline: deadline,
-		client:   client,
+		tags:   tags,
+		prefix: prefix,
+		cmd:    cmd,
+		params: params,
+		time:   messageTime(tags, received, client),
+		client: client,
 	}
 	return
 }
 
+// https://ircv3.net/specs/extensions/server-time
+func messageTime(tags map[string]string, received time.Time, client *Client) time.Time {
+	value, ok := tags["time"]
+	if !ok || client == nil || !client.HasCap(ServerTimeCap) {
+		return received
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		client.Debug("Invalid server-time %q: %s", value, err)
+		return received
+	}
+	return t
+}
+
+func (m utf8message) Time() time.Time {
+	return m.time
+}
+
 // Implemented this way to deny format string injections in the future
 func (m utf8message) Export() []byte {
 	var b strings.Builder
 	b.Grow(MAXMSGSIZE)
+	if len(m.tags) > 0 {
+		b.WriteString("@")
+		b.WriteString(exportTags(m.tags))
+		b.WriteString(" ")
+	}
 	b.WriteString(m.cmd)
+	if len(m.params) == 0 {
+		b.WriteString("\r\n")
+		return []byte(b.String())
+	}
 	if m.cmd == "PONG" || m.cmd == "PING" || m.cmd == "NICK" || m.cmd == "QUIT" {
 		b.WriteString(" :")
 		b.WriteString(strings.Join(m.params, " "))
 		b.WriteString("\r\n")
 		return []byte(b.String())
 	}
-	b.WriteString(" ")
-	b.WriteString(strings.Join(m.params[:len(m.params)-1], " "))
+	for _, param := range m.params[:len(m.params)-1] {
+		b.WriteString(" ")
+		b.WriteString(param)
+	}
 	b.WriteString(" :")
 	b.WriteString(m.params[len(m.params)-1])
 	b.WriteString("\r\n")
@@ -97,24 +211,30 @@ func (m utf8message) fetchChannel() *Channel {
 func (m utf8message) Msg() Msg {
 	channel := m.Channel()
 	if channel == nil {
-		channel = m.client.private
+		channel = m.client.createQuery(queryNick(m))
+	}
+	text := m.lines
+	if text == nil {
+		text = []string{strings.TrimSpace(m.params[1])}
 	}
 	return ircMsg{
-		time:     time.Now(),
+		time:     m.time,
 		deadline: m.deadline,
 		prefix:   m.Prefix(),
-		text:     []string{strings.TrimSpace(m.params[1])},
+		text:     text,
+		msgid:    m.tags["msgid"],
 		channel:  channel,
 		client:   m.client,
 	}
 }
 
-func newUTF8Message(cmd []byte, params [][]byte, deadline time.Time, client *Client) message {
+func newUTF8Message(tags map[string]string, cmd []byte, params [][]byte, deadline time.Time, client *Client) message {
 	var uparams []string
 	for _, param := range params {
 		uparams = append(uparams, string(param))
 	}
 	return utf8message{
+		tags:     tags,
 		cmd:      string(cmd),
 		params:   uparams,
 		deadline: deadline,
@@ -159,3 +279,12 @@ func (m utf8message) Params() []string {
 func (m utf8message) Prefix() string {
 	return m.prefix
 }
+
+func (m utf8message) Tags() map[string]string {
+	return m.tags
+}
+
+func (m utf8message) Tag(key string) (string, bool) {
+	value, ok := m.tags[key]
+	return value, ok
+}
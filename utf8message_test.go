@@ -1,6 +1,7 @@
 package ircfw
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -154,11 +155,24 @@ func TestExportMsg(t *testing.T) {
 			params: []string{"irc.demsh.org"},
 			client: nil,
 		},
+		utf8message{
+			prefix: "",
+			cmd:    "JOIN",
+			params: []string{"#ircfw-test"},
+			client: nil,
+		},
+		utf8message{
+			prefix: "",
+			cmd:    "AWAY",
+			client: nil,
+		},
 	}
 	corrects := []string{
 		"PRIVMSG #ircfw-test :heyo people!\r\n",
 		"PING :irc.demsh.org\r\n",
 		"PONG :irc.demsh.org\r\n",
+		"JOIN :#ircfw-test\r\n",
+		"AWAY\r\n",
 	}
 	for i, sample := range samples {
 		if export := sample.Export(); string(export) != corrects[i] {
@@ -166,3 +180,59 @@ func TestExportMsg(t *testing.T) {
 		}
 	}
 }
+
+func TestParseTags(t *testing.T) {
+	sample := "@time=2021-10-15T14:01:02.000Z;msgid=abc;+draft/reply=x\\sy\\:z;empty :demsh!~demsh@12a8e790 PRIVMSG #ircfw-test :hi"
+	msg, err := parseUTF8Message([]byte(sample), time.Time{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := map[string]string{
+		"time":         "2021-10-15T14:01:02.000Z",
+		"msgid":        "abc",
+		"+draft/reply": "x y;z",
+		"empty":        "",
+	}
+	for key, value := range valid {
+		if tag, ok := msg.Tag(key); !ok || tag != value {
+			t.Fatalf("tag %q: %q != %q", key, tag, value)
+		}
+	}
+	if msg.Cmd() != "PRIVMSG" || msg.Nick() != "demsh" || msg.Text() != "hi" {
+		t.Fatalf("Invalid parse: %#v", msg)
+	}
+	exported := newTaggedMessage(msg.Tags(), []byte("TAGMSG"), [][]byte{[]byte("#ircfw-test")}, time.Time{}, nil).Export()
+	if string(exported) != "@+draft/reply=x\\sy\\:z;empty;msgid=abc;time=2021-10-15T14:01:02.000Z TAGMSG :#ircfw-test\r\n" {
+		t.Fatalf("Invalid export: %q", exported)
+	}
+	if _, err := parseUTF8Message([]byte("@only=tags"), time.Time{}, nil); err == nil {
+		t.Fatalf("message without command should be invalid")
+	}
+}
+
+func TestServerTime(t *testing.T) {
+	sample := "@time=2021-10-15T14:01:02.123Z :demsh!~demsh@12a8e790 PRIVMSG #ircfw-test :hi"
+	received := time.Date(2021, 10, 15, 15, 0, 0, 0, time.UTC)
+	client := newTestClient(t, nil)
+	msg, err := parseUTF8Message([]byte(sample), received, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Time().Equal(received) {
+		t.Fatalf("time tag should be ignored without server-time: %s", msg.Time())
+	}
+	client.enabledCaps.Add(ServerTimeCap)
+	for _, sample := range []string{sample, "@time=garbage :demsh!~demsh@12a8e790 PRIVMSG #ircfw-test :hi"} {
+		msg, err = parseUTF8Message([]byte(sample), received, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		valid := received
+		if strings.HasPrefix(sample, "@time=2021") {
+			valid = time.Date(2021, 10, 15, 14, 1, 2, 123000000, time.UTC)
+		}
+		if !msg.Time().Equal(valid) {
+			t.Fatalf("%q: %s != %s", sample, msg.Time(), valid)
+		}
+	}
+}
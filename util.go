@@ -6,10 +6,6 @@ import (
 	"unicode/utf8"
 )
 
-const (
-	RecursionLimit = 1000
-)
-
 func isUTF8(data []byte) bool {
 	return !strings.ContainsRune(string(data), utf8.RuneError)
 }
@@ -23,50 +19,6 @@ func safeClose(c chan struct{}) {
 	}
 }
 
-func splitByLen(line string, limit int, depth uint) (result []string) {
-	var color = NoColor
-	depth++
-	if depth == RecursionLimit {
-		return
-	}
-	if limit == 0 || len(line) == 0 {
-		return
-	}
-	line = strings.TrimSpace(line)
-	if string(line[0]) == ColorTag {
-		color = lookupColor(string(line[1:3]))
-		if limit < 3 {
-			return
-		}
-		limit -= 2
-	}
-	length := len(line)
-	if length > limit {
-		i := strings.LastIndex(line[:limit], " ")
-		subline := ""
-		if i == -1 {
-			i = limit
-		}
-		result = append(result, line[:i])
-		if color == NoColor {
-			subline = strings.TrimSpace(line[i:])
-		} else {
-			subline = ColorTag + color.String() + strings.TrimSpace(line[i:])
-		}
-		if color != NoColor {
-			limit += 2
-		}
-		if len(subline) > limit {
-			result = append(result, splitByLen(subline, limit, depth)...)
-		} else {
-			result = append(result, subline)
-		}
-	} else {
-		result = append(result, line)
-	}
-	return
-}
-
 func pop(line string, separator string) (string, string) {
 	splitted := strings.SplitN(line, separator, 2)
 	if len(splitted) == 2 {
@@ -79,13 +31,17 @@ func join(lines []string, separator string) string {
 	return strings.Join(lines, separator)
 }
 
-func textLen(lines []string) (result int) {
+func textLen(lines []string, size func(string) int) (result int) {
 	for _, line := range lines {
-		result += len(line)
+		result += size(line)
 	}
 	return
 }
 
+func byteLen(s string) int {
+	return len(s)
+}
+
 func bytepop(line []byte, separator []byte) ([]byte, []byte) {
 	splitted := bytes.SplitN(line, separator, 2)
 	if len(splitted) == 2 {
@@ -106,7 +62,7 @@ func scanMsg(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	if atEOF && len(data) == 0 {
 		return 0, nil, nil
 	}
-	if i := bytes.Index(data, []byte("\r\n")); i > 0 {
+	if i := bytes.Index(data, []byte("\r\n")); i >= 0 {
 		return i + 2, dropCRLF(data[0:i]), nil
 	}
 	if atEOF {
@@ -118,3 +74,10 @@ func scanMsg(data []byte, atEOF bool) (advance int, token []byte, err error) {
 func lowcase(s string) string {
 	return strings.ToLower(s)
 }
+
+func stringsToBytes(s []string) (result [][]byte) {
+	for _, e := range s {
+		result = append(result, []byte(e))
+	}
+	return
+}
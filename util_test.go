@@ -23,7 +23,7 @@ func TestSplitByLen(t *testing.T) {
 	}
 
 	for _, line := range lines {
-		result := splitByLen(line, MLIMIT, 0)
+		result := splitByLen(line, MLIMIT, byteLen)
 		for _, subline := range result {
 			if len(subline) > MLIMIT {
 				t.Fatalf("%q != %q", line, result)
@@ -2,12 +2,16 @@ package ircfw
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 	"unicode"
 )
 
 const (
 	CHAN_LENGTH_LIMIT = 200
+	// nick length limit until server announces NICKLEN
+	NICK_LENGTH_LIMIT = 200
+	PARAMS_LIMIT      = 15
 )
 
 // https://stackoverflow.com/questions/53069040/checking-a-string-contains-only-ascii-characters
@@ -58,12 +62,29 @@ func validate(s string) error {
 	return nil
 }
 
-func validateNick(nick string) error {
+// Filename advertised in DCC offers, quotes can't be escaped
+func validateFilename(filename string) error {
+	if len(filename) == 0 {
+		return errors.New("empty")
+	}
+	if strings.Trim(filename, ".") == "" {
+		return errors.New("dots only")
+	}
+	for _, c := range filename {
+		if c == '"' || c < ' ' || c == 0x7f {
+			return errors.New("illegal symbol")
+		}
+	}
+	return nil
+}
+
+// Limit is NICKLEN of the server, see Client.nickLen
+func validateNick(nick string, limit int) error {
 	if len(nick) == 0 {
 		return errors.New("empty")
 	}
-	if len(nick) > 9 {
-		return errors.New("longer than 9 bytes")
+	if len(nick) > limit {
+		return fmt.Errorf("longer than %d bytes", limit)
 	}
 	if !isASCII(nick) {
 		return errors.New("non-ASCII")
@@ -77,9 +98,94 @@ func validateNick(nick string) error {
 	return nil
 }
 
+// Nicks received from server are not checked against NICKLEN
 func isNick(nick string) bool {
-	if err := validateNick(nick); err != nil {
+	if err := validateNick(nick, NICK_LENGTH_LIMIT); err != nil {
 		return false
 	}
 	return true
 }
+
+
+// Lines of message text, line breaks would inject commands
+func validateText(lines []string) error {
+	if strings.Join(lines, "") == "" {
+		return errors.New("empty")
+	}
+	for i, line := range lines {
+		if strings.ContainsAny(line, "\r\n\x00") {
+			return fmt.Errorf("line %d: illegal symbol", i)
+		}
+	}
+	return nil
+}
+
+// Targets are channels or nicks up to nickLen bytes
+func validateTargets(targets []string, nickLen int) error {
+	if len(targets) == 0 {
+		return errors.New("no targets")
+	}
+	for _, target := range targets {
+		if !isChannel(target) && validateNick(target, nickLen) != nil {
+			return fmt.Errorf("invalid target %q", target)
+		}
+	}
+	return nil
+}
+
+// Command is either a word of ASCII letters or 3-digit numeric
+func validateCommand(cmd string) error {
+	if len(cmd) == 0 {
+		return errors.New("empty")
+	}
+	if len(cmd) == 3 && strings.Trim(cmd, "0123456789") == "" {
+		return nil
+	}
+	for _, c := range cmd {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z') {
+			return errors.New("illegal symbol")
+		}
+	}
+	return nil
+}
+
+// Only the last parameter may be empty, contain spaces or start with ':'
+func validateParams(params []string) error {
+	if len(params) > PARAMS_LIMIT {
+		return fmt.Errorf("more than %d parameters", PARAMS_LIMIT)
+	}
+	for i, param := range params {
+		if strings.ContainsAny(param, "\r\n\x00") {
+			return fmt.Errorf("parameter %d: illegal symbol", i)
+		}
+		if i == len(params)-1 {
+			break
+		}
+		if param == "" || strings.HasPrefix(param, ":") || strings.Contains(param, " ") {
+			return fmt.Errorf("parameter %d: only the last one may be empty, start with ':' or contain spaces", i)
+		}
+	}
+	return nil
+}
+
+// Validation error matching ErrInvalid with errors.Is
+type invalidError struct {
+	what string
+	err  error
+}
+
+func invalid(what string, err error) error {
+	return invalidError{what: what, err: err}
+}
+
+func (e invalidError) Error() string {
+	return "invalid " + e.what + ": " + e.err.Error()
+}
+
+func (e invalidError) Unwrap() error {
+	return e.err
+}
+
+func (e invalidError) Is(target error) bool {
+	return target == ErrInvalid
+}
@@ -56,3 +56,58 @@ func TestValidateChannel(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateFilename(t *testing.T) {
+	for _, valid := range []string{"file.txt", "my file.tar.gz", "файл"} {
+		if err := validateFilename(valid); err != nil {
+			t.Errorf("%q should be valid, err: %q", valid, err)
+		}
+	}
+	for _, invalid := range []string{"", "\"quoted\".txt", "line\nbreak", "tab\tname", "del\x7f", ".", ".."} {
+		if err := validateFilename(invalid); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	valids := []string{"PRIVMSG", "notice", "001", "CAP"}
+	invalids := []string{"", "PRIV MSG", "0001", "12", "JOIN\r\n", "ПРИВЕТ"}
+	for _, valid := range valids {
+		if err := validateCommand(valid); err != nil {
+			t.Fatalf("%q should be valid, err: %q", valid, err)
+		}
+	}
+	for _, invalid := range invalids {
+		if err := validateCommand(invalid); err == nil {
+			t.Fatalf("%q should be invalid", invalid)
+		}
+	}
+}
+
+func TestValidateParams(t *testing.T) {
+	valids := [][]string{
+		{},
+		{"#ircfw-test"},
+		{"#ircfw-test", "hello world"},
+		{"#ircfw-test", ""},
+		{"ircfw", ":-)"},
+	}
+	invalids := [][]string{
+		{"#ircfw-test", "hello\r\nQUIT"},
+		{"#ircfw test", "hello"},
+		{"", "hello"},
+		{":ircfw", "hello"},
+		{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13", "14", "15", "16"},
+	}
+	for _, valid := range valids {
+		if err := validateParams(valid); err != nil {
+			t.Fatalf("%q should be valid, err: %q", valid, err)
+		}
+	}
+	for _, invalid := range invalids {
+		if err := validateParams(invalid); err == nil {
+			t.Fatalf("%q should be invalid", invalid)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package ircfw
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gitea.demsh.org/demsh/ircfw/format"
+)
+
+const (
+	zwj = '\u200d'
+	// URL-like tokens are preferably broken after these
+	breakAfter = "/?&=-_.,;:"
+)
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// Runes attaching to the preceding one within grapheme cluster
+func isExtender(r rune) bool {
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc):
+		return true
+	case r == zwj:
+		return true
+	case r >= 0xfe00 && r <= 0xfe0f, r >= 0xe0100 && r <= 0xe01ef:
+		// variation selectors
+		return true
+	case r >= 0x1f3fb && r <= 0x1f3ff:
+		// emoji skin tone modifiers
+		return true
+	case r >= 0xe0020 && r <= 0xe007f:
+		// emoji tag sequences
+		return true
+	}
+	return false
+}
+
+// Length of the first unbreakable unit of text: formatting code or grapheme cluster.
+// Clustering approximates UAX #29 for combining marks, ZWJ sequences,
+// variation selectors, emoji modifiers and flags.
+func nextUnit(text string) int {
+	if len(text) == 0 {
+		return 0
+	}
+	if n := format.CodeLen(text); n > 0 {
+		return n
+	}
+	r, n := utf8.DecodeRuneInString(text)
+	if isRegionalIndicator(r) {
+		if next, size := utf8.DecodeRuneInString(text[n:]); isRegionalIndicator(next) {
+			return n + size
+		}
+		return n
+	}
+	prev := r
+	for n < len(text) {
+		next, size := utf8.DecodeRuneInString(text[n:])
+		if !isExtender(next) && prev != zwj {
+			break
+		}
+		prev = next
+		n += size
+	}
+	return n
+}
+
+// Byte index of the longest prefix of text fitting limit when measured by size,
+// 0 if even the first unit does not fit
+func fitPrefix(text string, limit int, size func(string) int) int {
+	i, total := 0, 0
+	for i < len(text) {
+		n := nextUnit(text[i:])
+		total += size(text[i : i+n])
+		if total > limit {
+			break
+		}
+		i += n
+	}
+	return i
+}
+
+// Byte index of the longest prefix of text made of whole runes fitting limit
+func fitRunes(text string, limit int, size func(string) int) int {
+	i, total := 0, 0
+	for i < len(text) {
+		_, n := utf8.DecodeRuneInString(text[i:])
+		total += size(text[i : i+n])
+		if total > limit {
+			break
+		}
+		i += n
+	}
+	return i
+}
+
+// Byte index to break text at, preferring spaces and URL separators
+// in the second half of the chunk. Only unit boundaries are considered
+// so that formatting codes like "\x034,5" are never broken.
+func breakPoint(text string, cut int) int {
+	space, sep := -1, -1
+	for i := 0; i < cut; {
+		n := nextUnit(text[i:])
+		if text[i] == ' ' {
+			space = i
+		} else if n == 1 && strings.IndexByte(breakAfter, text[i]) >= 0 {
+			sep = i
+		}
+		i += n
+	}
+	if space > 0 {
+		return space
+	}
+	if sep >= cut/2 && sep > 0 {
+		return sep + 1
+	}
+	return cut
+}
+
+// Splits line into chunks of at most limit bytes as measured by size without
+// breaking runes, formatting codes or grapheme clusters fitting limit.
+// Continuation lines start with formatting codes active at the split point.
+func splitByLen(line string, limit int, size func(string) int) (result []string) {
+	if limit <= 0 {
+		return
+	}
+	var style format.Style
+	line = strings.TrimSpace(line)
+	for line != "" {
+		text := line
+		if codes := style.Codes(); codes != "" && size(codes) < limit/2 {
+			text = style.Apply(line)
+		}
+		codesLen := len(text) - len(line)
+		cut := fitPrefix(text, limit, size)
+		if cut <= codesLen && codesLen > 0 {
+			// carried formatting leaves no room for the next unit, drop it
+			text, codesLen = line, 0
+			cut = fitPrefix(text, limit, size)
+		}
+		if cut >= len(text) {
+			result = append(result, text)
+			break
+		}
+		if cut <= codesLen {
+			if n := format.CodeLen(line); n > 0 {
+				// formatting code longer than limit, send it as is
+				cut = codesLen + n
+			} else if n := fitRunes(line, limit, size); n > 0 {
+				// grapheme cluster longer than limit, break it between runes
+				cut = codesLen + n
+			} else {
+				// rune longer than limit, send it as is
+				_, n := utf8.DecodeRuneInString(line)
+				cut = codesLen + n
+			}
+		} else {
+			cut = codesLen + breakPoint(line, cut-codesLen)
+		}
+		head := strings.TrimRight(text[:cut], " ")
+		if head != "" {
+			result = append(result, head)
+		}
+		style = format.StyleAt(text[:cut])
+		line = strings.TrimLeft(text[cut:], " ")
+	}
+	return
+}
@@ -0,0 +1,99 @@
+package ircfw
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"gitea.demsh.org/demsh/ircfw/format"
+)
+
+func TestSplitByLenRunes(t *testing.T) {
+	var lines = []string{
+		strings.Repeat("язык", 50),
+		strings.Repeat("👩‍👩‍👧", 20),
+		strings.Repeat("🇷🇺🇺🇦", 20),
+		strings.Repeat("é", 60),
+		"see https://demsh.org/" + strings.Repeat("very/long/path?with=query&", 10) + " for details",
+		strings.Repeat("x", 10000),
+	}
+	for _, line := range lines {
+		result := splitByLen(line, MLIMIT, byteLen)
+		for _, subline := range result {
+			if len(subline) > MLIMIT {
+				t.Fatalf("%q is longer than %d", subline, MLIMIT)
+			}
+			if !utf8.ValidString(subline) {
+				t.Fatalf("%q is not valid UTF-8", subline)
+			}
+			if first, _ := utf8.DecodeRuneInString(subline); isExtender(first) {
+				t.Fatalf("%q starts in the middle of grapheme cluster", subline)
+			}
+		}
+		if strings.ReplaceAll(strings.Join(result, ""), " ", "") != strings.ReplaceAll(line, " ", "") {
+			t.Fatalf("%q lost text: %q", line, result)
+		}
+	}
+}
+
+func TestSplitByLenLongCluster(t *testing.T) {
+	// single grapheme cluster of 21 bytes
+	line := "e" + strings.Repeat("\u0301", 10)
+	result := splitByLen(line, 8, byteLen)
+	if strings.Join(result, "") != line {
+		t.Fatalf("%q split into %q", line, result)
+	}
+	for _, subline := range result {
+		if len(subline) > 8 || !utf8.ValidString(subline) {
+			t.Fatalf("invalid chunk %q of %q", subline, result)
+		}
+	}
+}
+
+func TestSplitByLenURL(t *testing.T) {
+	url := "https://demsh.org/" + strings.Repeat("segment/", 20)
+	result := splitByLen(url, MLIMIT, byteLen)
+	for _, subline := range result[:len(result)-1] {
+		if !strings.HasSuffix(subline, "/") {
+			t.Fatalf("%q should be broken after separator", subline)
+		}
+	}
+}
+
+func TestSplitByLenEncoding(t *testing.T) {
+	line := strings.Repeat("слово ", 20)
+	runes := func(s string) int { return utf8.RuneCountInString(s) }
+	result := splitByLen(line, MLIMIT, runes)
+	for _, subline := range result {
+		if runes(subline) > MLIMIT {
+			t.Fatalf("%q is longer than %d", subline, MLIMIT)
+		}
+	}
+	if len(result) != 2 {
+		t.Fatalf("%d lines instead of 2: %q", len(result), result)
+	}
+}
+
+func TestSplitByLenColorCode(t *testing.T) {
+	line := strings.Repeat("a", MLIMIT-2) + format.Colored("colored", format.Red, format.Blue)
+	result := splitByLen(line, MLIMIT, byteLen)
+	if len(result) != 2 || result[0] != strings.Repeat("a", MLIMIT-2) || !strings.HasPrefix(result[1], format.ColorTag+"04,02") {
+		t.Fatalf("colour code was broken: %q", result)
+	}
+}
+
+func TestSplitByLenStyle(t *testing.T) {
+	line := format.Bold("bold") + " " + format.Colored(strings.Repeat("word ", 40), format.Red, format.Black)
+	result := splitByLen(line, MLIMIT, byteLen)
+	if len(result) < 2 {
+		t.Fatalf("%q was not split", line)
+	}
+	for _, subline := range result[1:] {
+		if len(subline) > MLIMIT {
+			t.Fatalf("%q is longer than %d", subline, MLIMIT)
+		}
+		if style := format.ParseFormatting(subline)[0].Style; style != (format.Style{Fg: Red, Bg: Black}) {
+			t.Fatalf("%q starts with %#v", subline, style)
+		}
+	}
+}
@@ -4,19 +4,20 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"log/syslog"
+	"net"
 	"testing"
 	"time"
 
+	"gitea.demsh.org/demsh/ircfw/ircfwtest"
 	"golang.org/x/text/encoding/charmap"
 )
 
 const (
-	proto    = "tcp"
-	server   = "irc.demsh.org:6697"
 	jchannel = "#ircfw-test"
 	timeout  = 10
 )
@@ -52,6 +53,33 @@ func TestScanMsg(t *testing.T) {
 	}
 }
 
+func TestTargMax(t *testing.T) {
+	samples := []map[string]string{
+		{},
+		{"TARGMAX": "PRIVMSG:3,NOTICE:"},
+		{"MAXTARGETS": "4"},
+	}
+	valids := [][]int{
+		{1, 1},
+		{3, 0},
+		{4, 4},
+	}
+	for i, sample := range samples {
+		client := newTestClient(t, nil)
+		client.params = sample
+		if n := client.targMax("PRIVMSG"); n != valids[i][0] {
+			t.Fatalf("%#v: PRIVMSG %d != %d", sample, n, valids[i][0])
+		}
+		if n := client.targMax("NOTICE"); n != valids[i][1] {
+			t.Fatalf("%#v: NOTICE %d != %d", sample, n, valids[i][1])
+		}
+	}
+	groups := groupTargets([]string{"a", "b", "c", "d", "e"}, 2)
+	if len(groups) != 3 || len(groups[2]) != 1 {
+		t.Fatalf("bad grouping: %q", groups)
+	}
+}
+
 type testLogger struct {
 	debug  bool
 	logger *log.Logger
@@ -91,32 +119,43 @@ func newLogger(debug bool, logger *log.Logger) (out testLogger, err error) {
 }
 
 func TestNewClient(t *testing.T) {
-	socket, err := tls.Dial(proto, server, nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	logger, err := newLogger(true, nil)
+	server := ircfwtest.New()
+	defer server.Close()
+	logger, err := newLogger(testing.Verbose(), log.Default())
 	if err != nil {
 		t.Fatal(err)
 	}
-	//mock := newMockProxy(socket, logger)
-	//client := NewClient(nick, user, realname, password, mock, logger)
 	charmap := charmap.Windows1251
 	rootCtx := context.Background()
-	client, cancelClient := NewClient(Context(rootCtx), Socket(socket), SetLogger(logger), Handler(drainHandler), Charmap(charmap))
+	client, cancelClient := NewClient(Context(rootCtx), Socket(server.Conn()), SetLogger(logger), HandleContext(drainHandler), HandlerTimeout(5*time.Second), Charmap(charmap))
 	defer cancelClient()
-	ctx, cancel := context.WithTimeout(rootCtx, 5*time.Second)
+	ctx, cancel := context.WithTimeout(rootCtx, timeout*time.Second)
 	_, err = client.Join(ctx, jchannel)
 	cancel()
 	if err != nil {
-		logger.Log(err)
+		t.Fatal(err)
+	}
+
+	other := server.Conn()
+	defer other.Close()
+	go io.Copy(io.Discard, other)
+	fmt.Fprintf(other, "NICK demsh\r\nUSER demsh 0 * :demsh\r\nJOIN %s\r\n", jchannel)
+	fmt.Fprintf(other, "PRIVMSG %s :!say hello\r\n", jchannel)
+	if _, err := server.Expect(timeout*time.Second, func(line ircfwtest.Line) bool {
+		return line.Command == "PRIVMSG" && line.Trailing() == "hello"
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(other, "PRIVMSG %s :!quit\r\n", jchannel)
+	if _, err := server.ExpectCommand(timeout*time.Second, "QUIT"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Wait(); err == nil {
+		t.Error("client quit without error")
 	}
-	log.Printf("err: %q", client.Wait())
 }
 
-func drainHandler(m Msg) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func drainHandler(ctx context.Context, m Msg) {
 	client := m.Client()
 	channel := m.Channel()
 	for _, line := range m.Text() {
@@ -125,11 +164,11 @@ func drainHandler(m Msg) {
 			return
 		}
 		if lowcase(line) == "!part" {
-			channel.Part()
+			channel.Part(ctx)
 			return
 		}
 		if lowcase(line) == "!quit" {
-			client.Quit("Requested by privmsg")
+			client.Quit(ctx, "Requested by privmsg")
 		}
 		if lowcase(line) == "!status" {
 			return
@@ -138,10 +177,41 @@ func drainHandler(m Msg) {
 			channel.queryTopic()
 		}
 		if len(line) > 7 && lowcase(line[:7]) == "!whois " {
-			client.Whois(line[7:])
+			client.Whois(ctx, line[7:])
 		}
 		if len(line) > 6 && lowcase(line[:6]) == "!join " {
 			client.Join(ctx, line[6:])
 		}
 	}
 }
+
+// Session recorded against fake server is replayed to a fresh client
+func TestReplay(t *testing.T) {
+	join := func(socket net.Conn) {
+		client, cancelClient := NewClient(Socket(socket), SetLogger(nopLogger{}))
+		defer client.Wait()
+		defer cancelClient()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+		defer cancel()
+		if _, err := client.Join(ctx, jchannel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := ircfwtest.New(ircfwtest.Caps(map[string]string{"message-tags": "", "server-time": ""}))
+	defer server.Close()
+	var transcript bytes.Buffer
+	recorder := ircfwtest.NewRecorder(server.Conn(), &transcript)
+	join(recorder)
+	entries, err := ircfwtest.ReadTranscript(&transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayer := ircfwtest.NewReplayer(entries, "PING", "PONG")
+	join(replayer)
+	if !replayer.Wait(timeout * time.Second) {
+		t.Error("transcript was not replayed")
+	}
+	for _, err := range replayer.Errs() {
+		t.Error(err)
+	}
+}